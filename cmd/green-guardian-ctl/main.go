@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+	"github.com/pojntfx/green-guardian-gateway/pkg/services"
+	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
+)
+
+var (
+	errUnknownCommand = errors.New("unknown command")
+	errInvalidArgs    = errors.New("invalid arguments")
+	errInvalidState   = errors.New("state must be on or off")
+	errInvalidRuntime = errors.New("duration must be positive and is only supported when turning an actuator on")
+	errNoPeerFound    = errors.New("no peer found")
+)
+
+const usage = `Usage: %v [flags] <command>
+
+Commands:
+  hubs                                     List the connected hubs and the rooms and plants they have registered
+  registrations                            List the hubs which have registered each fan and sprinkler
+  measurements                             List the last measurement of each room and plant
+  fan <roomID> <on|off> [duration]         Turn the fan of a room on or off, optionally turning it off again after a duration (i.e. 2m)
+  sprinkler <plantID> <on|off> [duration]  Turn the sprinkler of a plant on or off, optionally turning it off again after a duration (i.e. 2m)
+
+Flags:
+`
+
+func main() {
+	// Use command line flags to allow customization of certain parameters
+	// For each setting, if not provided in command-line args, defaults are taken from environment variables.
+	// Otherwise, a default value is used.
+	adminSocket := flag.String("admin-socket", utils.GetStringEnvOrDefault("ADMIN_SOCKET", filepath.Join(os.TempDir(), "green-guardian-gateway.sock")), "Path of the gateway's admin socket")
+
+	timeoutDefault, err := utils.GetDurationEnvOrDefault("TIMEOUT", time.Second*10)
+	if err != nil {
+		panic(err)
+	}
+	timeout := flag.Duration("timeout", timeoutDefault, "Amount of time after which a command is assumed to have failed")
+
+	jsonOutput := flag.Bool("json", utils.GetBoolEnvOrDefault("JSON", false), "Whether to print the output as JSON")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+
+		flag.PrintDefaults()
+	}
+
+	// Parse all defined flags
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Connect to the gateway's admin socket
+	conn, err := net.Dial("unix", *adminSocket)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	ready := make(chan string)
+	registry := rpc.NewRegistry(
+		struct{}{},
+		services.AdminRemote{},
+
+		*timeout,
+		ctx,
+		&rpc.Options{
+			ResponseBufferLen: rpc.DefaultResponseBufferLen,
+			OnClientConnect: func(remoteID string) {
+				ready <- remoteID
+			},
+		},
+	)
+
+	// Link RPCs
+	linkErrs := make(chan error, 1)
+	go func() {
+		linkErrs <- registry.Link(conn)
+	}()
+
+	// Wait for connection
+	var remoteID string
+	select {
+	case remoteID = <-ready:
+	case err := <-linkErrs:
+		panic(err)
+	}
+
+	gateway, ok := registry.Peers()[remoteID]
+	if !ok {
+		panic(errNoPeerFound)
+	}
+
+	if err := run(ctx, gateway, flag.Args(), *jsonOutput); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		os.Exit(1)
+	}
+}
+
+// run executes a command against the gateway and prints its output
+func run(ctx context.Context, gateway services.AdminRemote, args []string, jsonOutput bool) error {
+	switch args[0] {
+	case "hubs":
+		hubs, err := gateway.ListHubs(ctx)
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			return printJSON(hubs)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PEER ID\tIDENTITY\tROOMS\tPLANTS")
+		for _, hub := range hubs {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", hub.PeerID, formatValue(hub.Identity), formatList(hub.Rooms), formatList(hub.Plants))
+		}
+
+		return w.Flush()
+
+	case "registrations":
+		registrations, err := gateway.GetRegistrations(ctx)
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			return printJSON(registrations)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tID\tPEER IDS")
+		for _, id := range getSortedKeys(registrations.Fans) {
+			fmt.Fprintf(w, "fan\t%v\t%v\n", id, formatList(registrations.Fans[id]))
+		}
+		for _, id := range getSortedKeys(registrations.Sprinklers) {
+			fmt.Fprintf(w, "sprinkler\t%v\t%v\n", id, formatList(registrations.Sprinklers[id]))
+		}
+
+		return w.Flush()
+
+	case "measurements":
+		measurements, err := gateway.GetMeasurements(ctx)
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			return printJSON(measurements)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tID\tVALUE\tDEFAULT\tTIME")
+		for _, id := range getSortedKeys(measurements.Temperatures) {
+			measurement := measurements.Temperatures[id]
+
+			fmt.Fprintf(w, "temperature\t%v\t%v %v\t%v %v\t%v\n", id, measurement.Value, measurement.Unit, measurement.DefaultValue, measurement.Unit, formatTimestamp(measurement.Timestamp))
+		}
+		for _, id := range getSortedKeys(measurements.Moistures) {
+			measurement := measurements.Moistures[id]
+
+			fmt.Fprintf(w, "moisture\t%v\t%v %v\t%v %v\t%v\n", id, measurement.Value, measurement.Unit, measurement.DefaultValue, measurement.Unit, formatTimestamp(measurement.Timestamp))
+		}
+
+		return w.Flush()
+
+	case "fan", "sprinkler":
+		if len(args) != 3 && len(args) != 4 {
+			return errInvalidArgs
+		}
+
+		on, err := parseState(args[2])
+		if err != nil {
+			return err
+		}
+
+		var runtime time.Duration
+		if len(args) == 4 {
+			if runtime, err = parseRuntime(args[3], on); err != nil {
+				return err
+			}
+		}
+
+		if args[0] == "fan" {
+			return gateway.SetFanOn(ctx, args[1], on, runtime)
+		}
+
+		return gateway.SetSprinklerOn(ctx, args[1], on, runtime)
+
+	default:
+		return fmt.Errorf("%w: %v", errUnknownCommand, args[0])
+	}
+}
+
+// parseState parses whether to turn an actuator on or off
+func parseState(state string) (bool, error) {
+	switch state {
+	case "on":
+		return true, nil
+
+	case "off":
+		return false, nil
+
+	default:
+		return false, errInvalidState
+	}
+}
+
+// parseRuntime parses after how long to turn an actuator off again
+func parseRuntime(runtime string, on bool) (time.Duration, error) {
+	duration, err := time.ParseDuration(runtime)
+	if err != nil {
+		return 0, err
+	}
+
+	if !on || duration <= 0 {
+		return 0, errInvalidRuntime
+	}
+
+	return duration, nil
+}
+
+// printJSON prints a value as indented JSON
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(v)
+}
+
+// formatValue returns a placeholder for empty values so that the columns stay aligned
+func formatValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
+
+// formatList joins a list of IDs
+func formatList(ids []string) string {
+	return formatValue(strings.Join(ids, ","))
+}
+
+// formatTimestamp formats a Unix time in milliseconds
+func formatTimestamp(timestamp int64) string {
+	if timestamp == 0 {
+		return "-"
+	}
+
+	return time.UnixMilli(timestamp).Format(time.RFC3339)
+}
+
+// getSortedKeys returns the keys of a map in a stable order
+func getSortedKeys[T any](m map[string]T) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
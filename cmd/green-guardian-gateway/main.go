@@ -3,20 +3,34 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"flag"
-	"log"
+	"log/slog"
+	"maps"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pojntfx/dudirekta/pkg/rpc"
+	"github.com/pojntfx/green-guardian-gateway/pkg/brokers"
+	"github.com/pojntfx/green-guardian-gateway/pkg/config"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+	"github.com/pojntfx/green-guardian-gateway/pkg/metrics"
+	"github.com/pojntfx/green-guardian-gateway/pkg/probes"
+	"github.com/pojntfx/green-guardian-gateway/pkg/queue"
 	"github.com/pojntfx/green-guardian-gateway/pkg/services"
 	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
 )
 
+var (
+	errTLSCARequiresTLSCert = errors.New("--tls-ca requires --tls-cert")
+	errAllowlistRequiresCA  = errors.New("--allowlist requires --tls-ca since hubs are identified by their client certificates")
+)
+
 func main() {
 	// Get the current working directory
 	pwd, err := os.Getwd()
@@ -31,70 +45,271 @@ func main() {
 	// For each setting, if not provided in command-line args, defaults are taken from environment variables.
 	// Otherwise, a default value is used.
 	laddr := flag.String("laddr", utils.GetStringEnvOrDefault("LADDR", ":1337"), "Listen address")
-	verbose := flag.Bool("verbose", utils.GetBoolEnvOrDefault("VERBOSE", false), "Whether to enable verbose logging")
+	tlsCert := flag.String("tls-cert", utils.GetStringEnvOrDefault("TLS_CERT", ""), "Certificate to serve the connections to hubs over TLS with (set to an empty string to accept hubs over plain TCP)")
+	tlsKey := flag.String("tls-key", utils.GetStringEnvOrDefault("TLS_KEY", ""), "Secret key of the certificate to serve the connections to hubs over TLS with")
+	tlsCA := flag.String("tls-ca", utils.GetStringEnvOrDefault("TLS_CA", ""), "CA to verify the client certificates of hubs with; if set, hubs have to authenticate with a certificate signed by it and are identified by its common name")
+	allowlistFile := flag.String("allowlist", utils.GetStringEnvOrDefault("ALLOWLIST", ""), "YAML or JSON file which maps the identities of hubs to the rooms and plants they may register and report on (requires --tls-ca; set to an empty string to allow all hubs to use all rooms and plants)")
+	verbose := flag.Bool("verbose", utils.GetBoolEnvOrDefault("VERBOSE", false), "Whether to enable verbose logging (same as --log-level debug)")
+	logLevel := flag.String("log-level", utils.GetStringEnvOrDefault("LOG_LEVEL", "info"), "Minimum level of log records to write (debug, info, warn or error)")
+	logFormat := flag.String("log-format", utils.GetStringEnvOrDefault("LOG_FORMAT", string(logging.FormatText)), "Format to write log records in (text or json)")
+	adminSocket := flag.String("admin-socket", utils.GetStringEnvOrDefault("ADMIN_SOCKET", filepath.Join(os.TempDir(), "green-guardian-gateway.sock")), "Path of the Unix socket which green-guardian-ctl connects to (set to an empty string to disable it)")
+	httpLaddr := flag.String("http-laddr", utils.GetStringEnvOrDefault("HTTP_LADDR", ""), "Listen address for the HTTP server which exposes Prometheus metrics on /metrics and health checks on /healthz and /readyz (set to an empty string to disable it)")
 
 	// Define AWS key, cert and ca location or path
 	awsKey := flag.String("aws-key", utils.GetStringEnvOrDefault("AWS_KEY", filepath.Join(crypto, "key.pem")), "AWS mTLS secret key")
 	awsCert := flag.String("aws-cert", utils.GetStringEnvOrDefault("AWS_CERT", filepath.Join(crypto, "cert.pem")), "AWS mTLS certificate")
 	awsCA := flag.String("aws-ca", utils.GetStringEnvOrDefault("AWS_CA", filepath.Join(crypto, "ca.pem")), "AWS mTLS CA")
 
-	// Define endpoint and thing name
-	endpoint := flag.String("endpoint", utils.GetStringEnvOrDefault("ENDPOINT", "ssl://ad218s2flbk57-ats.iot.eu-central-1.amazonaws.com:8883"), "AWS MQTT endpoint to connect to")
+	// Define the broker profile, endpoint and thing name
+	brokerProfile := flag.String("broker-profile", utils.GetStringEnvOrDefault("BROKER_PROFILE", string(brokers.ProfileAWS)), "Broker profile to use (aws for AWS IoT with mTLS, generic for any MQTT broker)")
+	endpoint := flag.String("endpoint", utils.GetStringEnvOrDefault("ENDPOINT", "ssl://ad218s2flbk57-ats.iot.eu-central-1.amazonaws.com:8883"), "MQTT endpoint to connect to (the generic profile supports tcp://, mqtt://, ssl://, tls://, mqtts://, ws:// and wss://)")
 	thingName := flag.String("thing-name", utils.GetStringEnvOrDefault("THING_NAME", "DEVICE-Device_1"), "Thing name (for topic to publish too; invalid thing names are denied using the )")
 
+	// Define whether the state of fans and sprinklers is synchronised with the cloud
+	shadows := flag.Bool("shadows", utils.GetBoolEnvOrDefault("SHADOWS", false), "Whether to synchronise fans and sprinklers with named AWS IoT Device Shadows (room-<roomID> and plant-<plantID>), applying their desired state and reporting the state they have been switched to")
+
+	// Define where the schedules which are managed with the schedules topic are persisted
+	schedulesFile := flag.String("schedules-file", utils.GetStringEnvOrDefault("SCHEDULES_FILE", filepath.Join(pwd, "schedules.json")), "File to persist the schedules which are set on /gateways/<thing>/schedules in, so that they keep running while the broker is unreachable (set to an empty string to disable schedules)")
+
+	// Define the authentication options for the generic broker profile
+	brokerUsername := flag.String("broker-username", utils.GetStringEnvOrDefault("BROKER_USERNAME", ""), "Username to authenticate to the broker with (generic profile only)")
+	brokerPassword := flag.String("broker-password", utils.GetStringEnvOrDefault("BROKER_PASSWORD", ""), "Password to authenticate to the broker with (generic profile only)")
+	brokerCA := flag.String("broker-ca", utils.GetStringEnvOrDefault("BROKER_CA", ""), "CA to verify the broker's certificate with; if empty, the system's CAs are used (generic profile only)")
+	brokerCert := flag.String("broker-cert", utils.GetStringEnvOrDefault("BROKER_CERT", ""), "Client certificate to authenticate to the broker with (generic profile only)")
+	brokerKey := flag.String("broker-key", utils.GetStringEnvOrDefault("BROKER_KEY", ""), "Client secret key to authenticate to the broker with (generic profile only)")
+	brokerInsecure := flag.Bool("broker-insecure", utils.GetBoolEnvOrDefault("BROKER_INSECURE", false), "Whether to skip verifying the broker's certificate (generic profile only)")
+
+	// Define where and how many measurements are buffered while the broker is unreachable
+	bufferDir := flag.String("buffer-dir", utils.GetStringEnvOrDefault("BUFFER_DIR", filepath.Join(pwd, "buffer")), "Directory to buffer measurements in while the broker is unreachable (set to an empty string to disable buffering)")
+
+	bufferMaxSizeDefault, err := utils.GetIntEnvOrDefault("BUFFER_MAX_SIZE", 100000)
+	if err != nil {
+		panic(err)
+	}
+	bufferMaxSize := flag.Int("buffer-max-size", bufferMaxSizeDefault, "Maximum amount of buffered measurements after which the oldest ones are dropped (0 for no limit)")
+
+	bufferMaxAgeDefault, err := utils.GetDurationEnvOrDefault("BUFFER_MAX_AGE", time.Hour*24)
+	if err != nil {
+		panic(err)
+	}
+	bufferMaxAge := flag.Duration("buffer-max-age", bufferMaxAgeDefault, "Maximum age of buffered measurements after which they are dropped (0 for no limit)")
+
+	// Define the format of published measurements
+	payloadFormat := flag.String("payload-format", utils.GetStringEnvOrDefault("PAYLOAD_FORMAT", string(services.PayloadFormatLegacy)), "Format of published measurements (v2 for versioned floating-point measurements with units, legacy for integer-only measurements)")
+
+	// Define how the gateway handles fans and sprinklers which are registered by more than one hub
+	registrationPolicy := flag.String("registration-policy", utils.GetStringEnvOrDefault("REGISTRATION_POLICY", string(services.RegistrationPolicyLastWins)), "How to handle a room or plant which is registered by more than one hub (reject refuses the registration, last-wins sends commands to the hub which registered it last and logs a warning, fan-out sends commands to all hubs which registered it)")
+
+	// Define how the gateway controls fans and sprinklers by itself
+	rulesMode := flag.String("rules-mode", utils.GetStringEnvOrDefault("RULES_MODE", string(services.RulesModeCloud)), "Local automation rules mode (off disables local rules, cloud only applies them while the broker is unreachable, local ignores cloud commands)")
+
+	rulesFanOnOffsetDefault, err := utils.GetFloatEnvOrDefault("RULES_FAN_ON_OFFSET", 2)
+	if err != nil {
+		panic(err)
+	}
+	rulesFanOnOffset := flag.Float64("rules-fan-on-offset", rulesFanOnOffsetDefault, "Amount above the default temperature at which local rules turn a fan on")
+
+	rulesFanOffOffsetDefault, err := utils.GetFloatEnvOrDefault("RULES_FAN_OFF_OFFSET", 0)
+	if err != nil {
+		panic(err)
+	}
+	rulesFanOffOffset := flag.Float64("rules-fan-off-offset", rulesFanOffOffsetDefault, "Amount above the default temperature at which local rules turn a fan off")
+
+	rulesSprinklerOnOffsetDefault, err := utils.GetFloatEnvOrDefault("RULES_SPRINKLER_ON_OFFSET", 5)
+	if err != nil {
+		panic(err)
+	}
+	rulesSprinklerOnOffset := flag.Float64("rules-sprinkler-on-offset", rulesSprinklerOnOffsetDefault, "Amount below the default moisture at which local rules turn a sprinkler on")
+
+	rulesSprinklerOffOffsetDefault, err := utils.GetFloatEnvOrDefault("RULES_SPRINKLER_OFF_OFFSET", 0)
+	if err != nil {
+		panic(err)
+	}
+	rulesSprinklerOffOffset := flag.Float64("rules-sprinkler-off-offset", rulesSprinklerOffOffsetDefault, "Amount below the default moisture at which local rules turn a sprinkler off")
+
+	rulesMinOnTimeDefault, err := utils.GetDurationEnvOrDefault("RULES_MIN_ON_TIME", time.Minute)
+	if err != nil {
+		panic(err)
+	}
+	rulesMinOnTime := flag.Duration("rules-min-on-time", rulesMinOnTimeDefault, "Minimum amount of time local rules keep an actuator on")
+
+	rulesMinOffTimeDefault, err := utils.GetDurationEnvOrDefault("RULES_MIN_OFF_TIME", time.Minute)
+	if err != nil {
+		panic(err)
+	}
+	rulesMinOffTime := flag.Duration("rules-min-off-time", rulesMinOffTimeDefault, "Minimum amount of time local rules keep an actuator off")
+
 	// Parse all defined flags
 	flag.Parse()
 
+	// Set up structured logging
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		panic(err)
+	}
+
+	if *verbose {
+		level = slog.LevelDebug
+	}
+
+	recordFormat, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		panic(err)
+	}
+
+	baseLogger := logging.NewLogger(os.Stderr, recordFormat, level)
+	logger := baseLogger.With(logging.KeyThingName, *thingName)
+
+	// Also write records of libraries which use the standard logger in the configured format
+	slog.SetDefault(logger)
+
+	mqttLogger := logging.WithSubsystem(logger, logging.SubsystemMQTT)
+	rpcLogger := logging.WithSubsystem(logger, logging.SubsystemRPC)
+
+	// Validate the payload format
+	format, err := services.ParsePayloadFormat(*payloadFormat)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validate the TLS options and load the allowlist
+	if *tlsCA != "" && *tlsCert == "" {
+		panic(errTLSCARequiresTLSCert)
+	}
+
+	var allowlist services.Allowlist
+	if *allowlistFile != "" {
+		if *tlsCA == "" {
+			panic(errAllowlistRequiresCA)
+		}
+
+		allowlistConfig, err := config.LoadAllowlist(*allowlistFile)
+		if err != nil {
+			panic(err)
+		}
+
+		allowlist = services.Allowlist{}
+		for identity, hub := range allowlistConfig.Hubs {
+			allowlist[identity] = services.AllowedIDs{
+				Rooms:  hub.Rooms,
+				Plants: hub.Plants,
+			}
+		}
+	}
+
+	// Validate the registration policy
+	policy, err := services.ParseRegistrationPolicy(*registrationPolicy)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validate the rules mode
+	mode, err := services.ParseRulesMode(*rulesMode)
+	if err != nil {
+		panic(err)
+	}
+
+	// Validate the rules' thresholds
+	rules := &services.Rules{
+		Mode: mode,
+
+		FanOnOffset:  *rulesFanOnOffset,
+		FanOffOffset: *rulesFanOffOffset,
+
+		SprinklerOnOffset:  *rulesSprinklerOnOffset,
+		SprinklerOffOffset: *rulesSprinklerOffOffset,
+
+		MinOnTime:  *rulesMinOnTime,
+		MinOffTime: *rulesMinOffTime,
+	}
+	if err := services.ValidateRules(rules); err != nil {
+		panic(err)
+	}
+
 	// Create a cancellable context
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Load AWS certificate and keys
-	cert, err := tls.LoadX509KeyPair(*awsCert, *awsKey)
+	// Validate the broker profile
+	profile, err := brokers.ParseProfile(*brokerProfile)
 	if err != nil {
 		panic(err)
 	}
 
-	// Load AWS CA
-	ca, err := os.ReadFile(*awsCA)
+	// Define the broker's authentication options based on the profile
+	brokerOptions := brokers.Options{
+		Endpoint: *endpoint,
+		ClientID: *thingName,
+	}
+
+	if profile == brokers.ProfileAWS {
+		brokerOptions.CA = *awsCA
+		brokerOptions.Cert = *awsCert
+		brokerOptions.Key = *awsKey
+	} else {
+		brokerOptions.Username = *brokerUsername
+		brokerOptions.Password = *brokerPassword
+		brokerOptions.CA = *brokerCA
+		brokerOptions.Cert = *brokerCert
+		brokerOptions.Key = *brokerKey
+		brokerOptions.Insecure = *brokerInsecure
+	}
+
+	// Define the client options in MQTT
+	opts, err := brokers.NewClientOptions(profile, brokerOptions)
 	if err != nil {
 		panic(err)
 	}
 
-	// Append AWS certificate to certificate pool
-	pool := x509.NewCertPool()
-	pool.AppendCertsFromPEM(ca)
-
-	// Create a new TLS Config with root CAs from the pool and certificate
-	tlsConfig := &tls.Config{
-		RootCAs:      pool,
-		Certificates: []tls.Certificate{cert},
+	// Mark the gateway as offline if it disconnects unexpectedly
+	if err := services.SetGatewayWill(opts, *thingName); err != nil {
+		panic(err)
 	}
 
-	// Define the client options in MQTT
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(*endpoint)
-	opts.SetClientID(*thingName)
-	opts.SetTLSConfig(tlsConfig)
+	// Announce presence and replay buffered measurements every time the connection to the broker is (re-)established
+	var gateway *services.Gateway
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		if err := services.ResumeGateway(gateway); err != nil {
+			mqttLogger.Warn("Could not resume gateway, continuing", logging.KeyError, err)
+		}
+	})
 
-	// Create and connect the MQTT client
-	client := mqtt.NewClient(opts)
+	// Create the buffer for measurements
+	var buffer *queue.Queue
+	if *bufferDir != "" {
+		buffer = queue.NewQueue(*bufferDir, *bufferMaxSize, *bufferMaxAge)
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+		if err := queue.OpenQueue(buffer); err != nil {
+			panic(err)
+		}
 	}
-	defer client.Disconnect(1000)
 
-	log.Println("Connected to", *endpoint)
+	// Create the MQTT client
+	client := mqtt.NewClient(opts)
 
 	// Create a new Gateway
-	gateway := services.NewGateway(
-		*verbose,
+	gateway = services.NewGateway(
+		baseLogger,
 		ctx,
 		client,
 		*thingName,
+		format,
+		policy,
+		allowlist,
+		buffer,
+		rules,
+		*shadows,
+		*schedulesFile,
 	)
 
+	// Connect the MQTT client
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+	defer client.Disconnect(1000)
+
+	mqttLogger.Info("Connected to broker", logging.KeyAddress, *endpoint)
+
 	errs := make(chan error)
 	go func() {
 		if err := services.WaitGateway(gateway); err != nil {
@@ -102,37 +317,86 @@ func main() {
 		}
 	}()
 
+	// Expose metrics and health checks if enabled
+	if *httpLaddr != "" {
+		metrics.RegisterGateway()
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		mux.Handle("/healthz", probes.Handler(map[string]probes.Check{}))
+		mux.Handle("/readyz", probes.Handler(services.GetGatewayChecks(gateway)))
+
+		go func() {
+			logging.WithSubsystem(logger, logging.SubsystemHTTP).Info("Serving metrics and health checks", logging.KeyAddress, *httpLaddr)
+
+			if err := http.ListenAndServe(*httpLaddr, mux); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	// Hubs which are currently connected by their peer IDs
+	peers := map[string]services.HubRemote{}
+	var peersLock sync.Mutex
+
+	// Assign the connected hubs to Gateway's peers
+	gateway.Peers = func() map[string]services.HubRemote {
+		peersLock.Lock()
+		defer peersLock.Unlock()
+
+		return maps.Clone(peers)
+	}
+
 	if err := services.OpenGateway(gateway, ctx); err != nil {
 		panic(err)
 	}
 	defer services.CloseGateway(gateway)
 
-	clients := 0
+	// Link the RPCs to a hub's connection; every connection has its own registry so that the hub's peer ID can be mapped to its identity
+	link := func(conn net.Conn, identity string) error {
+		var registry *rpc.Registry[services.HubRemote]
+		registry = rpc.NewRegistry(
+			gateway,
+			services.HubRemote{},
+
+			time.Second*10,
+			ctx,
+			&rpc.Options{
+				ResponseBufferLen: rpc.DefaultResponseBufferLen,
+				// Callback when a client is connected or disconnected to update the number of active clients and announce its presence
+				OnClientConnect: func(remoteID string) {
+					peersLock.Lock()
+					peers[remoteID] = registry.Peers()[remoteID]
+					clients := len(peers)
+					peersLock.Unlock()
+
+					metrics.ConnectedHubs.Inc()
+
+					rpcLogger.Info("Hub connected", logging.KeyPeerID, remoteID, logging.KeyIdentity, identity, "clients", clients)
+
+					if err := services.ConnectHub(gateway, remoteID, identity); err != nil {
+						rpcLogger.Warn("Could not announce connected hub, continuing", logging.KeyPeerID, remoteID, logging.KeyError, err)
+					}
+				},
+				OnClientDisconnect: func(remoteID string) {
+					peersLock.Lock()
+					delete(peers, remoteID)
+					clients := len(peers)
+					peersLock.Unlock()
 
-	// Create a new registry which will manage remote procedure calls and manage peers.
-	registry := rpc.NewRegistry(
-		gateway,
-		services.HubRemote{},
+					metrics.ConnectedHubs.Dec()
 
-		time.Second*10,
-		ctx,
-		&rpc.Options{
-			ResponseBufferLen: rpc.DefaultResponseBufferLen,
-			// Callback when a client is connected or disconnected to update the number of active clients
-			OnClientConnect: func(remoteID string) {
-				clients++
+					rpcLogger.Info("Hub disconnected", logging.KeyPeerID, remoteID, logging.KeyIdentity, identity, "clients", clients)
 
-				log.Printf("%v clients connected", clients)
+					if err := services.DisconnectHub(gateway, remoteID); err != nil {
+						rpcLogger.Warn("Could not announce disconnected hub, continuing", logging.KeyPeerID, remoteID, logging.KeyError, err)
+					}
+				},
 			},
-			OnClientDisconnect: func(remoteID string) {
-				clients--
+		)
 
-				log.Printf("%v clients connected", clients)
-			},
-		},
-	)
-	// Assign this Registry's peers to Gateway's peers
-	gateway.Peers = registry.Peers
+		return registry.Link(conn)
+	}
 
 	// Start listening for TCP connections
 	lis, err := net.Listen("tcp", *laddr)
@@ -141,7 +405,19 @@ func main() {
 	}
 	defer lis.Close()
 
-	log.Println("Listening on", lis.Addr())
+	// Serve the connections over TLS if a certificate is set
+	if *tlsCert != "" {
+		tlsConfig, err := utils.NewServerTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			panic(err)
+		}
+
+		lis = tls.NewListener(lis, tlsConfig)
+	} else {
+		rpcLogger.Warn("Accepting hubs over plain TCP; any client which can reach the listen address can register rooms and plants")
+	}
+
+	rpcLogger.Info("Listening", logging.KeyAddress, lis.Addr(), "tls", *tlsCert != "", "mtls", *tlsCA != "")
 
 	// Accept new connections
 	go func() {
@@ -149,7 +425,7 @@ func main() {
 			conn, err := lis.Accept()
 			if err != nil {
 				if !utils.IsClosedErr(err) {
-					log.Println("could not accept connection, continuing:", err)
+					rpcLogger.Warn("Could not accept connection, continuing", logging.KeyError, err)
 				}
 
 				continue
@@ -162,19 +438,104 @@ func main() {
 
 					if err := recover(); err != nil {
 						if !utils.IsClosedErr(err.(error)) {
-							log.Printf("Client disconnected with error: %v", err)
+							rpcLogger.Warn("Client disconnected with error", logging.KeyAddress, conn.RemoteAddr(), logging.KeyError, err)
 						}
 					}
 				}()
 
+				// Identify the hub using its client certificate
+				identity := ""
+				if tlsConn, ok := conn.(*tls.Conn); ok && *tlsCA != "" {
+					handshakeCtx, cancel := context.WithTimeout(ctx, time.Second*10)
+					defer cancel()
+
+					var err error
+					if identity, err = utils.GetPeerIdentity(handshakeCtx, tlsConn); err != nil {
+						rpcLogger.Warn("Could not authenticate hub, closing connection", logging.KeyAddress, conn.RemoteAddr(), logging.KeyError, err)
+
+						return
+					}
+				}
+
 				// Link the RPCs to the connection
-				if err := registry.Link(conn); err != nil {
+				if err := link(conn, identity); err != nil {
 					panic(err)
 				}
 			}()
 		}
 	}()
 
+	// Let operators inspect and control the gateway using green-guardian-ctl if enabled
+	if *adminSocket != "" {
+		adminLogger := logging.WithSubsystem(logger, logging.SubsystemAdmin)
+
+		// Remove the socket of a previous gateway which didn't shut down cleanly
+		if info, err := os.Stat(*adminSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(*adminSocket); err != nil {
+				panic(err)
+			}
+		}
+
+		adminLis, err := net.Listen("unix", *adminSocket)
+		if err != nil {
+			panic(err)
+		}
+		defer adminLis.Close()
+
+		// Only the user the gateway runs as may connect
+		if err := os.Chmod(*adminSocket, 0600); err != nil {
+			panic(err)
+		}
+
+		adminLogger.Info("Listening", logging.KeyAddress, adminLis.Addr())
+
+		admin := services.NewAdmin(logger, gateway)
+
+		go func() {
+			for {
+				conn, err := adminLis.Accept()
+				if err != nil {
+					if utils.IsClosedErr(err) {
+						return
+					}
+
+					adminLogger.Warn("Could not accept connection, continuing", logging.KeyError, err)
+
+					continue
+				}
+
+				go func() {
+					defer func() {
+						// Close the connection
+						_ = conn.Close()
+
+						if err := recover(); err != nil {
+							if !utils.IsClosedErr(err.(error)) {
+								adminLogger.Warn("Client disconnected with error", logging.KeyError, err)
+							}
+						}
+					}()
+
+					registry := rpc.NewRegistry(
+						admin,
+						struct{}{},
+
+						time.Second*10,
+						ctx,
+						&rpc.Options{
+							ResponseBufferLen: rpc.DefaultResponseBufferLen,
+						},
+					)
+
+					// Link the RPCs to the connection
+					if err := registry.Link(conn); err != nil {
+						panic(err)
+					}
+				}()
+			}
+		}()
+	}
+
 	// Wait for any errors to occur
 	for err := range errs {
 		if err != nil {
@@ -2,19 +2,26 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"flag"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/pojntfx/dudirekta/pkg/rpc"
+	"github.com/pojntfx/green-guardian-gateway/pkg/config"
+	"github.com/pojntfx/green-guardian-gateway/pkg/drivers"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+	"github.com/pojntfx/green-guardian-gateway/pkg/metrics"
+	"github.com/pojntfx/green-guardian-gateway/pkg/probes"
 	"github.com/pojntfx/green-guardian-gateway/pkg/services"
 	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
-	"gitlab.mi.hdm-stuttgart.de/iotee/go-iotee"
 )
 
 var (
@@ -22,7 +29,21 @@ var (
 )
 
 func main() {
+	// Get the current working directory
+	pwd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+
 	// Define variables to get environment values or default ones if environment variables are not set
+	configFile := flag.String("config", utils.GetStringEnvOrDefault("CONFIG", filepath.Join(pwd, "green-guardian-hub.yaml")), "YAML or JSON file describing the rooms and plants with their sensors and actuators (keys can be overridden with CONFIG_-prefixed environment variables, i.e. CONFIG_ROOMS_1_FAN_PATH)")
+
+	configPollIntervalDefault, err := utils.GetDurationEnvOrDefault("CONFIG_POLL_INTERVAL", 5*time.Second)
+	if err != nil {
+		panic(err)
+	}
+	configPollInterval := flag.Duration("config-poll-interval", configPollIntervalDefault, "Interval in which the config file is checked for changes, which are applied without restarting (0 to disable; a reload can also be triggered with SIGHUP)")
+
 	baudDefault, err := utils.GetIntEnvOrDefault("BAUD", 115200)
 	if err != nil {
 		panic(err)
@@ -30,25 +51,36 @@ func main() {
 	baud := flag.Int("baud", baudDefault, "Baudrate to use to communicate with sensors and actuators")
 
 	raddr := flag.String("raddr", utils.GetStringEnvOrDefault("RADDR", "localhost:1337"), "Remote address")
-	verbose := flag.Bool("verbose", utils.GetBoolEnvOrDefault("VERBOSE", false), "Whether to enable verbose logging")
-
-	defaultTempDefault, err := utils.GetIntEnvOrDefault("DEFAULT_TEMPERATURE", 25)
+	tlsEnabled := flag.Bool("tls", utils.GetBoolEnvOrDefault("TLS", false), "Whether to connect to the gateway over TLS")
+	tlsCA := flag.String("tls-ca", utils.GetStringEnvOrDefault("TLS_CA", ""), "CA to verify the gateway's certificate with; if empty, the system's CAs are used")
+	tlsCert := flag.String("tls-cert", utils.GetStringEnvOrDefault("TLS_CERT", ""), "Client certificate to authenticate to the gateway with; its common name is the hub's identity")
+	tlsKey := flag.String("tls-key", utils.GetStringEnvOrDefault("TLS_KEY", ""), "Client secret key to authenticate to the gateway with")
+	tlsServerName := flag.String("tls-server-name", utils.GetStringEnvOrDefault("TLS_SERVER_NAME", ""), "Name to verify the gateway's certificate against (set to an empty string to use the host of the remote address)")
+	namespace := flag.String("namespace", utils.GetStringEnvOrDefault("NAMESPACE", ""), "Prefix for the IDs of rooms and plants registered with the gateway, i.e. greenhouse-1 registers room 1 as greenhouse-1.1 (set to an empty string to register them without a prefix)")
+	verbose := flag.Bool("verbose", utils.GetBoolEnvOrDefault("VERBOSE", false), "Whether to enable verbose logging (same as --log-level debug)")
+	logLevel := flag.String("log-level", utils.GetStringEnvOrDefault("LOG_LEVEL", "info"), "Minimum level of log records to write (debug, info, warn or error)")
+	logFormat := flag.String("log-format", utils.GetStringEnvOrDefault("LOG_FORMAT", string(logging.FormatText)), "Format to write log records in (text or json)")
+	httpLaddr := flag.String("http-laddr", utils.GetStringEnvOrDefault("HTTP_LADDR", ""), "Listen address for the HTTP server which exposes Prometheus metrics on /metrics and health checks on /healthz and /readyz (set to an empty string to disable it)")
+
+	defaultTempDefault, err := utils.GetFloatEnvOrDefault("DEFAULT_TEMPERATURE", 25)
 	if err != nil {
 		panic(err)
 	}
-	defaultTemperature := flag.Int("default-temperature", defaultTempDefault, "The default expected temperature")
+	defaultTemperature := flag.Float64("default-temperature", defaultTempDefault, "The default expected temperature (in the configured temperature unit) for rooms which don't set one")
 
-	defaultMoistureDefault, err := utils.GetIntEnvOrDefault("DEFAULT_MOISTURE", 30)
+	temperatureUnit := flag.String("temperature-unit", utils.GetStringEnvOrDefault("TEMPERATURE_UNIT", "celsius"), "Unit of temperature measurements (celsius or fahrenheit)")
+
+	defaultMoistureDefault, err := utils.GetFloatEnvOrDefault("DEFAULT_MOISTURE", 30)
 	if err != nil {
 		panic(err)
 	}
-	defaultMoisture := flag.Int("default-moisture", defaultMoistureDefault, "The default expected moisture")
+	defaultMoisture := flag.Float64("default-moisture", defaultMoistureDefault, "The default expected moisture (in %RH) for plants which don't set one")
 
 	measureIntervalDefault, err := utils.GetDurationEnvOrDefault("MEASURE_INTERVAL", time.Second)
 	if err != nil {
 		panic(err)
 	}
-	measureInterval := flag.Duration("measure-interval", measureIntervalDefault, "Amount of time after which a new measurement is taken")
+	measureInterval := flag.Duration("measure-interval", measureIntervalDefault, "Amount of time after which a new measurement is taken for sensors which don't set an interval")
 
 	measureTimeoutDefault, err := utils.GetDurationEnvOrDefault("MEASURE_TIMEOUT", time.Second)
 	if err != nil {
@@ -56,118 +88,239 @@ func main() {
 	}
 	measureTimeout := flag.Duration("measure-timeout", measureTimeoutDefault, "Amount of time after which it is assumed that a measurement has failed")
 
-	// Define a JSON structure for each peripheral device
-	fans := flag.String("fans", utils.GetStringEnvOrDefault("FANS", `{"1": "/dev/ttyACM0"}`), "JSON description in the format { roomID: devicePath }")
-	temperatureSensors := flag.String("temperature-sensors", utils.GetStringEnvOrDefault("TEMPERATURE_SENSORS", `{"1": "/dev/ttyACM0"}`), "JSON description in the format { roomID: devicePath }")
-	sprinklers := flag.String("sprinklers", utils.GetStringEnvOrDefault("SPRINKLERS", `{"1": "/dev/ttyACM0"}`), "JSON description in the format { plantID: devicePath }")
-	moistureSensors := flag.String("moisture-sensors", utils.GetStringEnvOrDefault("MOISTURE_SENSORS", `{"1": "/dev/ttyACM0"}`), "JSON description in the format { roomID: devicePath }")
+	maxRuntimeDefault, err := utils.GetDurationEnvOrDefault("MAX_RUNTIME", 0)
+	if err != nil {
+		panic(err)
+	}
+	maxRuntime := flag.Duration("max-runtime", maxRuntimeDefault, "Amount of time after which fans and sprinklers which don't set a maximum runtime are turned off again, even if no command turns them off (set to 0 to disable it)")
 
-	// Mock for development and testing purposes
-	mockDefault, err := utils.GetIntEnvOrDefault("MOCK", 0)
+	maxFailuresDefault, err := utils.GetIntEnvOrDefault("MAX_FAILURES", 3)
 	if err != nil {
 		panic(err)
 	}
-	mock := flag.Int("mock", mockDefault, "If set to >1, mock temperature and moisture using buttons, sending the default value +- the value of this flag")
+	maxFailures := flag.Int("max-failures", maxFailuresDefault, "Amount of consecutive failed measurements after which a sensor is reported as degraded")
 
-	// Parse command line flags
-	flag.Parse()
+	maxRetryBackoffDefault, err := utils.GetDurationEnvOrDefault("MAX_RETRY_BACKOFF", time.Minute)
+	if err != nil {
+		panic(err)
+	}
+	maxRetryBackoff := flag.Duration("max-retry-backoff", maxRetryBackoffDefault, "Maximum amount of time to wait before retrying a failed measurement")
 
-	// Cancelable context for managing long-running go routines
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	reconnectBackoffDefault, err := utils.GetDurationEnvOrDefault("RECONNECT_BACKOFF", time.Second)
+	if err != nil {
+		panic(err)
+	}
+	reconnectBackoff := flag.Duration("reconnect-backoff", reconnectBackoffDefault, "Amount of time to wait before reconnecting to the gateway for the first time, which doubles with every failed attempt")
+
+	reconnectMaxBackoffDefault, err := utils.GetDurationEnvOrDefault("RECONNECT_MAX_BACKOFF", time.Minute)
+	if err != nil {
+		panic(err)
+	}
+	reconnectMaxBackoff := flag.Duration("reconnect-max-backoff", reconnectMaxBackoffDefault, "Maximum amount of time to wait before reconnecting to the gateway")
 
-	// Declare a map to hold fan devices, then unmarshal JSON into this map
-	fanDevices := map[string]string{}
-	if err := json.Unmarshal([]byte(*fans), &fanDevices); err != nil {
+	maxQueuedMeasurementsDefault, err := utils.GetIntEnvOrDefault("MAX_QUEUED_MEASUREMENTS", 1000)
+	if err != nil {
 		panic(err)
 	}
+	maxQueuedMeasurements := flag.Int("max-queued-measurements", maxQueuedMeasurementsDefault, "Maximum amount of measurements to queue while disconnected from the gateway after which the oldest ones are dropped (0 for no limit)")
 
-	// Open connections for each fan device and store them in a map
-	fanBindings := map[string]utils.IoTee{}
-	for roomID, dev := range fanDevices {
-		it := iotee.NewIoTee(dev, *baud)
+	// Mock for development and testing purposes
+	mockDefault, err := utils.GetFloatEnvOrDefault("MOCK", 0)
+	if err != nil {
+		panic(err)
+	}
+	mock := flag.Float64("mock", mockDefault, "If set to >1, mock temperature and moisture using buttons, sending the default value +- the value of this flag")
 
-		if err := it.Open(); err != nil {
-			panic(err)
-		}
-		defer it.Close()
+	// Parse command line flags
+	flag.Parse()
+
+	// Set up structured logging
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		panic(err)
+	}
 
-		fanBindings[roomID] = utils.NewIoTeeAdapter(it)
+	if *verbose {
+		level = slog.LevelDebug
 	}
 
-	// Similarly for temperature sensors, sprinklers and moisture sensors
-	temperatureSensorDevices := map[string]string{}
-	if err := json.Unmarshal([]byte(*temperatureSensors), &temperatureSensorDevices); err != nil {
+	recordFormat, err := logging.ParseFormat(*logFormat)
+	if err != nil {
 		panic(err)
 	}
 
-	temperatureSensorBindings := map[string]utils.IoTee{}
-	for roomID, dev := range temperatureSensorDevices {
-		it := iotee.NewIoTee(dev, *baud)
+	logger := logging.NewLogger(os.Stderr, recordFormat, level)
 
-		if err := it.Open(); err != nil {
-			panic(err)
-		}
-		defer it.Close()
+	// Also write records of libraries which use the standard logger in the configured format
+	slog.SetDefault(logger)
 
-		temperatureSensorBindings[roomID] = utils.NewIoTeeAdapter(it)
-	}
+	rpcLogger := logging.WithSubsystem(logger, logging.SubsystemRPC).With(logging.KeyAddress, *raddr)
+	configLogger := logging.WithSubsystem(logger, logging.SubsystemConfig).With(logging.KeyPath, *configFile)
 
-	sprinklerDevices := map[string]string{}
-	if err := json.Unmarshal([]byte(*sprinklers), &sprinklerDevices); err != nil {
+	// Validate the temperature unit
+	unit, err := services.ParseTemperatureUnit(*temperatureUnit)
+	if err != nil {
 		panic(err)
 	}
 
-	sprinklerBindings := map[string]utils.IoTee{}
-	for roomID, dev := range fanDevices {
-		it := iotee.NewIoTee(dev, *baud)
+	// Validate the namespace
+	if err := services.ValidateNamespace(*namespace); err != nil {
+		panic(err)
+	}
 
-		if err := it.Open(); err != nil {
+	// Create the TLS config for the connection to the gateway
+	var tlsConfig *tls.Config
+	if *tlsEnabled {
+		tlsConfig, err = utils.NewClientTLSConfig(*tlsCA, *tlsCert, *tlsKey, *tlsServerName, false)
+		if err != nil {
 			panic(err)
 		}
-		defer it.Close()
-
-		sprinklerBindings[roomID] = utils.NewIoTeeAdapter(it)
 	}
 
-	moistureSensorDevices := map[string]string{}
-	if err := json.Unmarshal([]byte(*moistureSensors), &moistureSensorDevices); err != nil {
+	// Cancelable context for managing long-running go routines
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Load the rooms and plants
+	hubConfig, err := config.LoadHub(*configFile, "CONFIG")
+	if err != nil {
 		panic(err)
 	}
 
-	moistureSensorBindings := map[string]utils.IoTee{}
-	for roomID, dev := range moistureSensorDevices {
-		it := iotee.NewIoTee(dev, *baud)
+	// Open devices using the driver they are configured with; devices which share a path are only opened once.
+	// The buttons of IoTees are only used to mock measurements.
+	manager := drivers.NewManager(*baud, *mock > 0, logger)
+	defer manager.Close()
 
-		if err := it.Open(); err != nil {
-			panic(err)
-		}
-		defer it.Close()
+	topology := newTopology(manager, *defaultTemperature, *defaultMoisture, *maxRuntime)
 
-		moistureSensorBindings[roomID] = utils.NewIoTeeAdapter(it)
+	rooms, plants, err := topology.open(hubConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := topology.commit(hubConfig, rooms, plants); err != nil {
+		panic(err)
 	}
 
 	// Initialization of hub, the main service that communicates with sensors/actuators
 	hub := services.NewHub(
-		*verbose,
+		logger,
 		ctx,
 
-		fanBindings,
-		temperatureSensorBindings,
-		*defaultTemperature,
+		*namespace,
+
+		rooms,
+		unit,
 
-		sprinklerBindings,
-		moistureSensorBindings,
-		*defaultMoisture,
+		plants,
 
 		*measureInterval,
 		*measureTimeout,
 
+		*maxFailures,
+		*maxRetryBackoff,
+
+		*maxQueuedMeasurements,
+
 		*mock,
 	)
 
+	// Error channel to handle errors in Go routines
+	errs := make(chan error)
+	go func() {
+		if err := services.WaitHub(hub); err != nil {
+			errs <- err
+		}
+	}()
+
+	// Expose metrics and health checks if enabled
+	if *httpLaddr != "" {
+		metrics.RegisterHub()
+
+		// The hub is ready once it is linked to a gateway and all configured devices have been opened
+		checks := services.GetHubChecks(hub)
+		checks["devices"] = topology.check
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		mux.Handle("/healthz", probes.Handler(map[string]probes.Check{}))
+		mux.Handle("/readyz", probes.Handler(checks))
+
+		go func() {
+			logging.WithSubsystem(logger, logging.SubsystemHTTP).Info("Serving metrics and health checks", logging.KeyAddress, *httpLaddr)
+
+			if err := http.ListenAndServe(*httpLaddr, mux); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	// Start measuring; measurements are queued until we are connected to the gateway
+	if err := services.OpenHub(hub, ctx); err != nil {
+		panic(err)
+	}
+
+	// Reload the rooms and plants if the config file changes or if we receive SIGHUP
+	go func() {
+		reloads := make(chan os.Signal, 1)
+		signal.Notify(reloads, syscall.SIGHUP)
+
+		var changes <-chan struct{}
+		if *configPollInterval > 0 {
+			changes = config.Watch(ctx, *configFile, *configPollInterval)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-reloads:
+			case <-changes:
+			}
+
+			configLogger.Info("Reloading config")
+
+			// Keep the current rooms and plants if the new ones can't be applied
+			nextConfig, err := config.LoadHub(*configFile, "CONFIG")
+			if err != nil {
+				configLogger.Error("Could not load config, keeping current one", logging.KeyError, err)
+
+				continue
+			}
+
+			nextRooms, nextPlants, err := topology.open(nextConfig)
+			if err != nil {
+				configLogger.Error("Could not open devices, keeping current config", logging.KeyError, err)
+
+				continue
+			}
+
+			if err := services.ReloadHub(hub, ctx, nextRooms, nextPlants); err != nil {
+				if errors.Is(err, services.ErrMockRequiresIoTee) {
+					_ = topology.discard(nextRooms, nextPlants)
+
+					configLogger.Error("Could not apply config, keeping current one", logging.KeyError, err)
+
+					continue
+				}
+
+				// The hub is already using the new rooms and plants, only registering them with the gateway failed;
+				// they are registered again once we reconnect
+				configLogger.Warn("Could not register reloaded fans and sprinklers with gateway", logging.KeyError, err)
+			}
+
+			if err := topology.commit(nextConfig, nextRooms, nextPlants); err != nil {
+				configLogger.Warn("Could not close removed devices", logging.KeyError, err)
+			}
+
+			configLogger.Info("Reloaded config")
+		}
+	}()
+
 	// Registry where every connected device is registered
-	ready := make(chan struct{})
+	ready := make(chan string)
 	registry := rpc.NewRegistry(
 		hub,
 		services.GatewayRemote{},
@@ -177,56 +330,91 @@ func main() {
 		&rpc.Options{
 			ResponseBufferLen: rpc.DefaultResponseBufferLen,
 			OnClientConnect: func(remoteID string) {
-				ready <- struct{}{}
+				ready <- remoteID
 			},
 		},
 	)
 
-	// Dial remote address
-	conn, err := net.Dial("tcp", *raddr)
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
-
-	// Link RPCs and check for errors
+	// Connect to the gateway and reconnect with exponential backoff if the connection is lost
 	go func() {
-		if err := registry.Link(conn); err != nil {
-			if !utils.IsClosedErr(err) {
-				panic(err)
+		for attempt := 0; ; attempt++ {
+			if attempt > 0 {
+				backoff := utils.GetBackoff(attempt-1, *reconnectBackoff, *reconnectMaxBackoff)
+
+				rpcLogger.Info("Reconnecting to gateway", "backoff", backoff)
+
+				time.Sleep(backoff)
 			}
-		}
-	}()
 
-	// Wait for connection
-	<-ready
+			// Dial remote address
+			var conn net.Conn
+			if tlsConfig != nil {
+				conn, err = tls.Dial("tcp", *raddr, tlsConfig)
+			} else {
+				conn, err = net.Dial("tcp", *raddr)
+			}
+			if err != nil {
+				rpcLogger.Warn("Could not connect to gateway, retrying", logging.KeyError, err)
 
-	log.Println("Connected to", conn.RemoteAddr())
+				continue
+			}
 
-	// Find the first peer
-	var peer *services.GatewayRemote
-	for _, candidate := range registry.Peers() {
-		peer = &candidate
+			// Link RPCs
+			linkErrs := make(chan error, 1)
+			go func() {
+				linkErrs <- registry.Link(conn)
+			}()
 
-		break
-	}
+			// Wait for connection
+			var remoteID string
+			select {
+			case remoteID = <-ready:
+			case err := <-linkErrs:
+				_ = conn.Close()
 
-	if peer == nil {
-		panic(errNoPeerFound)
-	}
+				rpcLogger.Warn("Could not link to gateway, retrying", logging.KeyError, err)
 
-	// Error channel to handle errors in Go routines
-	errs := make(chan error)
-	go func() {
-		if err := services.WaitHub(hub); err != nil {
-			errs <- err
+				continue
+			}
+
+			rpcLogger.Info("Connected to gateway", logging.KeyPeerID, remoteID)
+
+			// Find the peer
+			candidate, ok := registry.Peers()[remoteID]
+			if !ok {
+				_ = conn.Close()
+
+				rpcLogger.Warn("Could not link to gateway, retrying", logging.KeyError, errNoPeerFound)
+
+				continue
+			}
+			peer := &candidate
+
+			// Register fans and sprinklers with the gateway and deliver queued measurements
+			if err := services.LinkHub(hub, ctx, peer); err != nil {
+				_ = conn.Close()
+
+				rpcLogger.Warn("Could not register with gateway, retrying", logging.KeyError, err)
+
+				continue
+			}
+
+			// We successfully connected, so reset the backoff
+			attempt = 0
+
+			// Wait until the connection is lost
+			if err := <-linkErrs; err != nil && !utils.IsClosedErr(err) {
+				rpcLogger.Warn("Disconnected from gateway with error", logging.KeyError, err)
+			} else {
+				rpcLogger.Info("Disconnected from gateway")
+			}
+
+			services.UnlinkHub(hub)
+
+			_ = conn.Close()
 		}
 	}()
 
-	if err := services.OpenHub(hub, ctx, peer); err != nil {
-		panic(err)
-	}
-
 	// Handling interrupt signal for shutdown
 	go func() {
 		ch := make(chan os.Signal, 1)
@@ -234,8 +422,8 @@ func main() {
 
 		<-ch
 
-		if *verbose {
-			log.Println("Gracefully shutting down")
+		if logger.Enabled(ctx, slog.LevelDebug) {
+			logger.Debug("Gracefully shutting down")
 
 			go func() {
 				ch := make(chan os.Signal, 1)
@@ -243,13 +431,15 @@ func main() {
 
 				<-ch
 
-				log.Println("Forcefully exiting")
+				logger.Debug("Forcefully exiting")
 
 				os.Exit(1)
 			}()
 		}
 
-		_ = services.CloseHub(hub, ctx, peer)
+		_ = services.CloseHub(hub, ctx)
+
+		_ = manager.Close()
 
 		os.Exit(1)
 	}()
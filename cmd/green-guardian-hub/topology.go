@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/config"
+	"github.com/pojntfx/green-guardian-gateway/pkg/drivers"
+	"github.com/pojntfx/green-guardian-gateway/pkg/services"
+)
+
+var (
+	errDeviceNotOpened = errors.New("device has not been opened")
+)
+
+// device is an opened sensor or actuator
+type device interface {
+	Close() error
+}
+
+// topology keeps track of the devices which are opened for the configured rooms and plants
+type topology struct {
+	manager *drivers.Manager
+
+	defaultTemperature,
+	defaultMoisture float64
+	maxRuntime time.Duration
+
+	// The committed configuration and the devices the hub is using for it
+	config *config.Hub
+	rooms  map[string]services.Room
+	plants map[string]services.Plant
+
+	lock sync.Mutex
+}
+
+func newTopology(manager *drivers.Manager, defaultTemperature, defaultMoisture float64, maxRuntime time.Duration) *topology {
+	return &topology{
+		manager: manager,
+
+		defaultTemperature: defaultTemperature,
+		defaultMoisture:    defaultMoisture,
+		maxRuntime:         maxRuntime,
+
+		config: &config.Hub{},
+		rooms:  map[string]services.Room{},
+		plants: map[string]services.Plant{},
+	}
+}
+
+// open opens the devices of the next configuration, reusing the devices of the current one which haven't changed.
+// The result has to be passed to either commit or discard.
+func (t *topology) open(next *config.Hub) (map[string]services.Room, map[string]services.Plant, error) {
+	rooms := map[string]services.Room{}
+	plants := map[string]services.Plant{}
+
+	for roomID, roomConfig := range next.Rooms {
+		prevConfig := t.config.Rooms[roomID]
+		prev := t.rooms[roomID]
+
+		room := services.Room{
+			DefaultTemperature: t.defaultTemperature,
+		}
+
+		if roomConfig.DefaultTemperature != nil {
+			room.DefaultTemperature = *roomConfig.DefaultTemperature
+		}
+
+		if roomConfig.Fan != nil {
+			if prev.Fan != nil && prevConfig.Fan != nil && prevConfig.Fan.Config == roomConfig.Fan.Config {
+				room.Fan = prev.Fan
+			} else {
+				fan, err := t.manager.OpenActuator(drivers.KindFan, roomConfig.Fan.Config)
+				if err != nil {
+					return nil, nil, errors.Join(fmt.Errorf("could not open fan of room %v: %w", roomID, err), t.discard(rooms, plants))
+				}
+
+				room.Fan = fan
+			}
+
+			room.FanMaxRuntime = t.maxRuntime
+			if roomConfig.Fan.MaxRuntime != 0 {
+				room.FanMaxRuntime = roomConfig.Fan.MaxRuntime
+			}
+		}
+
+		if roomConfig.TemperatureSensor != nil {
+			if prev.TemperatureSensor != nil && prevConfig.TemperatureSensor != nil && prevConfig.TemperatureSensor.Config == roomConfig.TemperatureSensor.Config {
+				room.TemperatureSensor = prev.TemperatureSensor
+			} else {
+				sensor, err := t.manager.OpenSensor(drivers.KindTemperatureSensor, roomConfig.TemperatureSensor.Config)
+				if err != nil {
+					rooms[roomID] = room
+
+					return nil, nil, errors.Join(fmt.Errorf("could not open temperature sensor of room %v: %w", roomID, err), t.discard(rooms, plants))
+				}
+
+				room.TemperatureSensor = sensor
+			}
+
+			room.MeasureInterval = roomConfig.TemperatureSensor.Interval
+		}
+
+		rooms[roomID] = room
+	}
+
+	for plantID, plantConfig := range next.Plants {
+		prevConfig := t.config.Plants[plantID]
+		prev := t.plants[plantID]
+
+		plant := services.Plant{
+			DefaultMoisture: t.defaultMoisture,
+		}
+
+		if plantConfig.DefaultMoisture != nil {
+			plant.DefaultMoisture = *plantConfig.DefaultMoisture
+		}
+
+		if plantConfig.Sprinkler != nil {
+			if prev.Sprinkler != nil && prevConfig.Sprinkler != nil && prevConfig.Sprinkler.Config == plantConfig.Sprinkler.Config {
+				plant.Sprinkler = prev.Sprinkler
+			} else {
+				sprinkler, err := t.manager.OpenActuator(drivers.KindSprinkler, plantConfig.Sprinkler.Config)
+				if err != nil {
+					return nil, nil, errors.Join(fmt.Errorf("could not open sprinkler of plant %v: %w", plantID, err), t.discard(rooms, plants))
+				}
+
+				plant.Sprinkler = sprinkler
+			}
+
+			plant.SprinklerMaxRuntime = t.maxRuntime
+			if plantConfig.Sprinkler.MaxRuntime != 0 {
+				plant.SprinklerMaxRuntime = plantConfig.Sprinkler.MaxRuntime
+			}
+		}
+
+		if plantConfig.MoistureSensor != nil {
+			if prev.MoistureSensor != nil && prevConfig.MoistureSensor != nil && prevConfig.MoistureSensor.Config == plantConfig.MoistureSensor.Config {
+				plant.MoistureSensor = prev.MoistureSensor
+			} else {
+				sensor, err := t.manager.OpenSensor(drivers.KindMoistureSensor, plantConfig.MoistureSensor.Config)
+				if err != nil {
+					plants[plantID] = plant
+
+					return nil, nil, errors.Join(fmt.Errorf("could not open moisture sensor of plant %v: %w", plantID, err), t.discard(rooms, plants))
+				}
+
+				plant.MoistureSensor = sensor
+			}
+
+			plant.MeasureInterval = plantConfig.MoistureSensor.Interval
+		}
+
+		plants[plantID] = plant
+	}
+
+	return rooms, plants, nil
+}
+
+// commit switches to the next configuration and closes the devices which are no longer used.
+// It must only be called once the hub has stopped using the current devices.
+func (t *topology) commit(next *config.Hub, rooms map[string]services.Room, plants map[string]services.Plant) error {
+	err := closeUnused(getDevices(t.rooms, t.plants), getDevices(rooms, plants))
+
+	t.lock.Lock()
+	t.config = next
+	t.rooms = rooms
+	t.plants = plants
+	t.lock.Unlock()
+
+	return err
+}
+
+// check returns an error if a device of the committed configuration hasn't been opened.
+// Configurations which have been discarded don't matter since the hub keeps using the committed devices.
+func (t *topology) check() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for roomID, roomConfig := range t.config.Rooms {
+		room := t.rooms[roomID]
+
+		if (roomConfig.Fan != nil && room.Fan == nil) || (roomConfig.TemperatureSensor != nil && room.TemperatureSensor == nil) {
+			return fmt.Errorf("%w: room %v", errDeviceNotOpened, roomID)
+		}
+	}
+
+	for plantID, plantConfig := range t.config.Plants {
+		plant := t.plants[plantID]
+
+		if (plantConfig.Sprinkler != nil && plant.Sprinkler == nil) || (plantConfig.MoistureSensor != nil && plant.MoistureSensor == nil) {
+			return fmt.Errorf("%w: plant %v", errDeviceNotOpened, plantID)
+		}
+	}
+
+	return nil
+}
+
+// discard closes the devices which have been opened for a configuration which won't be used
+func (t *topology) discard(rooms map[string]services.Room, plants map[string]services.Plant) error {
+	return closeUnused(getDevices(rooms, plants), getDevices(t.rooms, t.plants))
+}
+
+// getDevices returns the set of devices which are used by the given rooms and plants
+func getDevices(rooms map[string]services.Room, plants map[string]services.Plant) map[device]struct{} {
+	devices := map[device]struct{}{}
+	for _, room := range rooms {
+		if room.Fan != nil {
+			devices[room.Fan] = struct{}{}
+		}
+
+		if room.TemperatureSensor != nil {
+			devices[room.TemperatureSensor] = struct{}{}
+		}
+	}
+
+	for _, plant := range plants {
+		if plant.Sprinkler != nil {
+			devices[plant.Sprinkler] = struct{}{}
+		}
+
+		if plant.MoistureSensor != nil {
+			devices[plant.MoistureSensor] = struct{}{}
+		}
+	}
+
+	return devices
+}
+
+// closeUnused closes all devices which aren't kept
+func closeUnused(devices, keep map[device]struct{}) error {
+	errs := []error{}
+	for device := range devices {
+		if _, ok := keep[device]; ok {
+			continue
+		}
+
+		if err := device.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
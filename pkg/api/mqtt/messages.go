@@ -1,14 +1,174 @@
 package mqtt
 
 type FanState struct {
-	On bool `json:"on"`
+	On            bool   `json:"on"`
+	CorrelationID string `json:"correlationId,omitempty"` // Optional ID which is sent back with the command's acknowledgement
+
+	// Optional amount of milliseconds and/or Unix time in milliseconds after which the hub turns the actuator off again;
+	// if both are set, the actuator is turned off once the earlier one is reached
+	Duration int64 `json:"duration,omitempty"`
+	Deadline int64 `json:"deadline,omitempty"`
 }
 
 type SprinklerState = FanState
 
-type TemperatureMeasurement struct {
-	Measurement  int `json:"measurement"`
-	DefaultValue int `json:"default"`
+// CommandAck acknowledges a command for a fan or sprinkler
+type CommandAck struct {
+	CorrelationID string `json:"correlationId,omitempty"`
+	On            bool   `json:"on"`      // The state the command switches the actuator to
+	Applied       bool   `json:"applied"` // Whether the actuator has been switched to the state
+	Error         string `json:"error,omitempty"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+const (
+	MeasurementVersion = 2
+
+	UnitCelsius          = "°C"
+	UnitFahrenheit       = "°F"
+	UnitRelativeHumidity = "%RH"
+)
+
+type Measurement struct {
+	Version      int     `json:"version"`
+	SensorID     string  `json:"sensorId"`
+	Value        float64 `json:"value"`
+	Unit         string  `json:"unit"`
+	DefaultValue float64 `json:"default"`
+	Timestamp    int64   `json:"timestamp"` // Unix time in milliseconds at which the measurement was taken
+}
+
+type TemperatureMeasurement = Measurement
+
+type MoistureMeasurement = Measurement
+
+// LegacyMeasurement is the payload format used before measurements were versioned
+type LegacyMeasurement struct {
+	Measurement  int   `json:"measurement"`
+	DefaultValue int   `json:"default"`
+	Timestamp    int64 `json:"timestamp"`
+}
+
+type GatewayStatus struct {
+	Online    bool  `json:"online"`
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+type HubStatus struct {
+	Online    bool     `json:"online"`
+	Identity  string   `json:"identity,omitempty"`
+	Rooms     []string `json:"rooms"`
+	Plants    []string `json:"plants"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+type ActuatorAvailability struct {
+	Available bool  `json:"available"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+type DeviceHealth struct {
+	Healthy   bool   `json:"healthy"`
+	Failures  int    `json:"failures"`
+	Error     string `json:"error,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// ActuatorShadowState is the state of a fan or sprinkler in its named AWS IoT Device Shadow
+type ActuatorShadowState struct {
+	On *bool `json:"on,omitempty"`
+}
+
+type ShadowState struct {
+	Desired  *ActuatorShadowState `json:"desired,omitempty"`
+	Reported *ActuatorShadowState `json:"reported,omitempty"`
+	Delta    *ActuatorShadowState `json:"delta,omitempty"`
 }
 
-type MoistureMeasurement = TemperatureMeasurement
+// ShadowDocument is sent to update a shadow and received in response to getting one
+type ShadowDocument struct {
+	State       ShadowState `json:"state"`
+	Version     int64       `json:"version,omitempty"`
+	Timestamp   int64       `json:"timestamp,omitempty"` // Unix time in seconds
+	ClientToken string      `json:"clientToken,omitempty"`
+}
+
+// ShadowDelta is received whenever the desired state of a shadow differs from its reported state
+type ShadowDelta struct {
+	State       ActuatorShadowState `json:"state"`
+	Version     int64               `json:"version"`
+	Timestamp   int64               `json:"timestamp"` // Unix time in seconds
+	ClientToken string              `json:"clientToken,omitempty"`
+}
+
+// Schedules are all schedules the gateway runs; every document replaces the previous one
+type Schedules struct {
+	Schedules []Schedule `json:"schedules"`
+}
+
+// Schedule turns the fan of a room or the sprinkler of a plant on for a while, either at the times of a cron expression or in an interval
+type Schedule struct {
+	ID string `json:"id"`
+
+	// Exactly one of RoomID and PlantID has to be set
+	RoomID  string `json:"roomId,omitempty"`
+	PlantID string `json:"plantId,omitempty"`
+
+	// Exactly one of Cron (i.e. "0 6 * * *" for 06:00 every day) and Interval (in milliseconds) has to be set
+	Cron     string `json:"cron,omitempty"`
+	Interval int64  `json:"interval,omitempty"`
+
+	Duration int64 `json:"duration"` // Amount of milliseconds after which the actuator is turned off again
+
+	Unless *ScheduleCondition `json:"unless,omitempty"` // Optional condition under which a run is skipped
+}
+
+// ScheduleCondition skips a run of a schedule based on the last measurement of its room or plant
+type ScheduleCondition struct {
+	Above *float64 `json:"above,omitempty"`
+	Below *float64 `json:"below,omitempty"`
+
+	// Whether Above and Below are offsets to the default value which was sent with the measurement
+	RelativeToDefault bool `json:"relativeToDefault,omitempty"`
+}
+
+// HubConfig changes how all hubs measure while they are running; unset values keep the values the hubs have been started with
+type HubConfig struct {
+	MeasureInterval    int64    `json:"measureInterval,omitempty"` // Amount of milliseconds between measurements
+	MeasureTimeout     int64    `json:"measureTimeout,omitempty"`  // Amount of milliseconds after which a measurement is assumed to have failed
+	DefaultTemperature *float64 `json:"defaultTemperature,omitempty"`
+	DefaultMoisture    *float64 `json:"defaultMoisture,omitempty"`
+}
+
+// RoomConfig changes how the temperature of a room is measured; it takes precedence over the HubConfig
+type RoomConfig struct {
+	MeasureInterval    int64    `json:"measureInterval,omitempty"` // Amount of milliseconds between measurements
+	DefaultTemperature *float64 `json:"defaultTemperature,omitempty"`
+}
+
+// PlantConfig changes how the moisture of a plant is measured; it takes precedence over the HubConfig
+type PlantConfig struct {
+	MeasureInterval int64    `json:"measureInterval,omitempty"` // Amount of milliseconds between measurements
+	DefaultMoisture *float64 `json:"defaultMoisture,omitempty"`
+}
+
+// HubConfigState is the configuration a hub uses after it has applied the configs it has received
+type HubConfigState struct {
+	MeasureInterval int64                       `json:"measureInterval"`
+	MeasureTimeout  int64                       `json:"measureTimeout"`
+	Rooms           map[string]RoomConfigState  `json:"rooms"`
+	Plants          map[string]PlantConfigState `json:"plants"`
+	Timestamp       int64                       `json:"timestamp"`
+}
+
+type RoomConfigState struct {
+	MeasureInterval    int64   `json:"measureInterval"`
+	DefaultTemperature float64 `json:"defaultTemperature"`
+	Timestamp          int64   `json:"timestamp"`
+}
+
+type PlantConfigState struct {
+	MeasureInterval int64   `json:"measureInterval"`
+	DefaultMoisture float64 `json:"defaultMoisture"`
+	Timestamp       int64   `json:"timestamp"`
+}
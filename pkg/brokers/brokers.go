@@ -0,0 +1,106 @@
+package brokers
+
+import (
+	"errors"
+	"net/url"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
+)
+
+type Profile string
+
+const (
+	// ProfileAWS connects to AWS IoT using mTLS with a client certificate, key and CA
+	ProfileAWS Profile = "aws"
+
+	// ProfileGeneric connects to any MQTT broker using the transport selected by the endpoint's scheme
+	ProfileGeneric Profile = "generic"
+)
+
+var (
+	ErrUnknownProfile     = errors.New("unknown broker profile")
+	ErrUnsupportedScheme  = errors.New("unsupported broker endpoint scheme, must be one of tcp://, mqtt://, ssl://, tls://, mqtts://, ws:// or wss://")
+	ErrInvalidCertificate = utils.ErrInvalidCertificate
+)
+
+// Options configure how to connect and authenticate to a broker
+type Options struct {
+	Endpoint string
+	ClientID string
+
+	// Username and password for brokers which use password authentication
+	Username,
+	Password string
+
+	// CA to verify the broker's certificate with; if empty, the system's CAs are used
+	CA string
+
+	// Client certificate and key for brokers which use mTLS
+	Cert,
+	Key string
+
+	// Whether to skip verifying the broker's certificate
+	Insecure bool
+}
+
+// ParseProfile parses a broker profile from a string.
+func ParseProfile(profile string) (Profile, error) {
+	switch Profile(profile) {
+	case ProfileAWS, ProfileGeneric:
+		return Profile(profile), nil
+
+	default:
+		return "", ErrUnknownProfile
+	}
+}
+
+// NewClientOptions creates MQTT client options for the given broker profile
+func NewClientOptions(profile Profile, options Options) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(options.Endpoint)
+	opts.SetClientID(options.ClientID)
+
+	switch profile {
+	case ProfileAWS:
+		// AWS IoT always requires mTLS
+		tlsConfig, err := utils.NewClientTLSConfig(options.CA, options.Cert, options.Key, "", false)
+		if err != nil {
+			return nil, err
+		}
+
+		opts.SetTLSConfig(tlsConfig)
+
+	case ProfileGeneric:
+		endpoint, err := url.Parse(options.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		switch endpoint.Scheme {
+		case "tcp", "mqtt", "ws":
+			// Plain transports don't need a TLS config
+
+		case "ssl", "tls", "mqtts", "wss":
+			tlsConfig, err := utils.NewClientTLSConfig(options.CA, options.Cert, options.Key, "", options.Insecure)
+			if err != nil {
+				return nil, err
+			}
+
+			opts.SetTLSConfig(tlsConfig)
+
+		default:
+			return nil, ErrUnsupportedScheme
+		}
+
+		if options.Username != "" {
+			opts.SetUsername(options.Username)
+			opts.SetPassword(options.Password)
+		}
+
+	default:
+		return nil, ErrUnknownProfile
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidPattern = errors.New("invalid pattern")
+)
+
+// AllowedHub lists the rooms and plants a hub may register and report on.
+// Each entry is a pattern as supported by path.Match, i.e. greenhouse-1.* for all rooms of the hub with the namespace greenhouse-1.
+type AllowedHub struct {
+	Rooms  []string `yaml:"rooms,omitempty"`
+	Plants []string `yaml:"plants,omitempty"`
+}
+
+// Allowlist maps the identities of hubs (the common names of their client certificates) to the rooms and plants they may use.
+type Allowlist struct {
+	Hubs map[string]AllowedHub `yaml:"hubs,omitempty"`
+}
+
+// LoadAllowlist reads an allowlist from a YAML or JSON file.
+func LoadAllowlist(path string) (*Allowlist, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseAllowlist(data)
+}
+
+// ParseAllowlist parses and validates an allowlist in YAML or JSON format.
+func ParseAllowlist(data []byte) (*Allowlist, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	allowlist := &Allowlist{}
+	if err := decoder.Decode(allowlist); err != nil {
+		if errors.Is(err, io.EOF) {
+			// The allowlist is empty, so no hub is allowed to use any room or plant
+			return allowlist, nil
+		}
+
+		return nil, err
+	}
+
+	if err := decoder.Decode(&yaml.Node{}); !errors.Is(err, io.EOF) {
+		return nil, ErrUnexpectedDocuments
+	}
+
+	if err := allowlist.Validate(); err != nil {
+		return nil, err
+	}
+
+	return allowlist, nil
+}
+
+// Validate checks the allowlist, returning an error for each invalid key.
+func (c *Allowlist) Validate() error {
+	errs := []error{}
+
+	for _, identity := range getSortedKeys(c.Hubs) {
+		hub := c.Hubs[identity]
+		key := "hubs." + identity
+
+		if strings.TrimSpace(identity) == "" {
+			errs = append(errs, fmt.Errorf("%v: %w", key, ErrEmptyID))
+		}
+
+		errs = append(errs, validatePatterns(key+".rooms", hub.Rooms)...)
+		errs = append(errs, validatePatterns(key+".plants", hub.Plants)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validatePatterns checks that all patterns can be matched against
+func validatePatterns(key string, patterns []string) []error {
+	errs := []error{}
+	for i, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+			errs = append(errs, fmt.Errorf("%v.%v: %w: %q", key, i, ErrInvalidPattern, pattern))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestParseAllowlist checks that the rooms and plants of each hub are parsed and that invalid patterns are rejected.
+func TestParseAllowlist(t *testing.T) {
+	allowlist, err := ParseAllowlist([]byte(`
+hubs:
+  greenhouse-1:
+    rooms:
+      - greenhouse-1.*
+    plants:
+      - greenhouse-1.1
+`))
+	if err != nil {
+		t.Fatalf("unexpected error during ParseAllowlist: %v", err)
+	}
+
+	hub := allowlist.Hubs["greenhouse-1"]
+	if len(hub.Rooms) != 1 || hub.Rooms[0] != "greenhouse-1.*" || len(hub.Plants) != 1 || hub.Plants[0] != "greenhouse-1.1" {
+		t.Fatalf("expected rooms greenhouse-1.* and plants greenhouse-1.1, got %v", hub)
+	}
+
+	if _, err := ParseAllowlist([]byte(`hubs: {greenhouse-1: {rooms: ["greenhouse-1.["]}}`)); !errors.Is(err, ErrInvalidPattern) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidPattern, err)
+	}
+
+	if _, err := ParseAllowlist([]byte(`hubs: {greenhouse-1: {fans: ["1"]}}`)); err == nil {
+		t.Fatal("expected unknown keys to be rejected")
+	}
+}
@@ -0,0 +1,284 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/drivers"
+	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrEmptyID              = errors.New("ID must not be empty")
+	ErrNoDevices            = errors.New("at least one device is required")
+	ErrMissingPath          = errors.New("path is required")
+	ErrUnsupportedDriver    = errors.New("driver does not support this kind of device")
+	ErrIntervalNotAllowed   = errors.New("interval is only supported for sensors")
+	ErrMaxRuntimeNotAllowed = errors.New("maximum runtime is only supported for actuators")
+	ErrNegativeValue        = errors.New("value must not be negative")
+	ErrInvalidProbability   = errors.New("value must be between 0 and 1")
+	ErrUnexpectedDocuments  = errors.New("config must contain exactly one document")
+)
+
+// Device describes how to access a sensor or an actuator.
+type Device struct {
+	drivers.Config `yaml:",inline"`
+
+	// Interval in which measurements are taken; if 0, the hub's measure interval is used (sensors only)
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Amount of time after which the hub turns the device off again; if 0, the hub's maximum runtime is used (actuators only)
+	MaxRuntime time.Duration `yaml:"maxRuntime,omitempty"`
+}
+
+// Room is a room whose temperature is measured and/or which has a fan.
+type Room struct {
+	Fan               *Device `yaml:"fan,omitempty"`
+	TemperatureSensor *Device `yaml:"temperatureSensor,omitempty"`
+
+	// The expected temperature; if unset, the hub's default temperature is used
+	DefaultTemperature *float64 `yaml:"defaultTemperature,omitempty"`
+}
+
+// Plant is a plant whose moisture is measured and/or which has a sprinkler.
+type Plant struct {
+	Sprinkler      *Device `yaml:"sprinkler,omitempty"`
+	MoistureSensor *Device `yaml:"moistureSensor,omitempty"`
+
+	// The expected moisture; if unset, the hub's default moisture is used
+	DefaultMoisture *float64 `yaml:"defaultMoisture,omitempty"`
+}
+
+// Hub describes the rooms and plants a hub manages.
+type Hub struct {
+	Rooms  map[string]Room  `yaml:"rooms,omitempty"`
+	Plants map[string]Plant `yaml:"plants,omitempty"`
+}
+
+// LoadHub reads a hub configuration from a YAML or JSON file.
+// See ParseHub for how environment variables override keys.
+func LoadHub(path string, envPrefix string) (*Hub, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseHub(data, envPrefix)
+}
+
+// ParseHub parses and validates a hub configuration in YAML or JSON format.
+// Every key which is set in the configuration can be overridden by an environment variable named after the key's path
+// in upper case, prefixed with envPrefix, i.e. CONFIG_ROOMS_1_FAN_PATH for the path of the fan in room 1.
+func ParseHub(data []byte, envPrefix string) (*Hub, error) {
+	// JSON is a subset of YAML, so we can parse both formats the same way.
+	// Decode strictly first to reject unknown keys with the lines they are on.
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	config := &Hub{}
+	if err := decoder.Decode(config); err != nil {
+		if errors.Is(err, io.EOF) {
+			// The configuration is empty
+			return config, nil
+		}
+
+		return nil, err
+	}
+
+	if err := decoder.Decode(&yaml.Node{}); !errors.Is(err, io.EOF) {
+		return nil, ErrUnexpectedDocuments
+	}
+
+	// Decode again with the values from the environment
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	applyEnvOverrides(&root, envPrefix)
+
+	config = &Hub{}
+	if err := root.Decode(config); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Validate checks the configuration, returning an error for each invalid key.
+func (c *Hub) Validate() error {
+	errs := []error{}
+
+	for _, roomID := range getSortedKeys(c.Rooms) {
+		room := c.Rooms[roomID]
+		key := "rooms." + roomID
+
+		if strings.TrimSpace(roomID) == "" {
+			errs = append(errs, fmt.Errorf("%v: %w", key, ErrEmptyID))
+		}
+
+		if room.Fan == nil && room.TemperatureSensor == nil {
+			errs = append(errs, fmt.Errorf("%v: %w", key, ErrNoDevices))
+		}
+
+		errs = append(errs, validateDevice(key+".fan", room.Fan, false)...)
+		errs = append(errs, validateDevice(key+".temperatureSensor", room.TemperatureSensor, true)...)
+	}
+
+	for _, plantID := range getSortedKeys(c.Plants) {
+		plant := c.Plants[plantID]
+		key := "plants." + plantID
+
+		if strings.TrimSpace(plantID) == "" {
+			errs = append(errs, fmt.Errorf("%v: %w", key, ErrEmptyID))
+		}
+
+		if plant.Sprinkler == nil && plant.MoistureSensor == nil {
+			errs = append(errs, fmt.Errorf("%v: %w", key, ErrNoDevices))
+		}
+
+		if plant.DefaultMoisture != nil && *plant.DefaultMoisture < 0 {
+			errs = append(errs, fmt.Errorf("%v.defaultMoisture: %w", key, ErrNegativeValue))
+		}
+
+		errs = append(errs, validateDevice(key+".sprinkler", plant.Sprinkler, false)...)
+		errs = append(errs, validateDevice(key+".moistureSensor", plant.MoistureSensor, true)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// getSortedKeys returns the keys of a map in a stable order so that errors are reported in the same order every time
+func getSortedKeys[T any](m map[string]T) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// validateDevice checks a device's configuration; device may be nil if it is not configured
+func validateDevice(key string, device *Device, sensor bool) []error {
+	if device == nil {
+		return nil
+	}
+
+	errs := []error{}
+
+	driver := drivers.DriverIoTee
+	if device.Driver != "" {
+		var err error
+		if driver, err = drivers.ParseDriver(string(device.Driver)); err != nil {
+			errs = append(errs, fmt.Errorf("%v.driver: %w: %q", key, err, device.Driver))
+		}
+	}
+
+	// GPIO lines can only switch relays and files can only be read from
+	if (sensor && driver == drivers.DriverGPIO) || (!sensor && driver == drivers.DriverSysfs) {
+		errs = append(errs, fmt.Errorf("%v.driver: %w: %q", key, ErrUnsupportedDriver, driver))
+	}
+
+	if strings.TrimSpace(device.Path) == "" {
+		errs = append(errs, fmt.Errorf("%v.path: %w", key, ErrMissingPath))
+	}
+
+	if device.Baud < 0 {
+		errs = append(errs, fmt.Errorf("%v.baud: %w", key, ErrNegativeValue))
+	}
+
+	if device.Line < 0 {
+		errs = append(errs, fmt.Errorf("%v.line: %w", key, ErrNegativeValue))
+	}
+
+	if device.Noise < 0 {
+		errs = append(errs, fmt.Errorf("%v.noise: %w", key, ErrNegativeValue))
+	}
+
+	if device.FailureRate < 0 || device.FailureRate > 1 {
+		errs = append(errs, fmt.Errorf("%v.failureRate: %w", key, ErrInvalidProbability))
+	}
+
+	if device.Interval < 0 {
+		errs = append(errs, fmt.Errorf("%v.interval: %w", key, ErrNegativeValue))
+	}
+
+	if !sensor && device.Interval != 0 {
+		errs = append(errs, fmt.Errorf("%v.interval: %w", key, ErrIntervalNotAllowed))
+	}
+
+	if device.MaxRuntime < 0 {
+		errs = append(errs, fmt.Errorf("%v.maxRuntime: %w", key, ErrNegativeValue))
+	}
+
+	if sensor && device.MaxRuntime != 0 {
+		errs = append(errs, fmt.Errorf("%v.maxRuntime: %w", key, ErrMaxRuntimeNotAllowed))
+	}
+
+	return errs
+}
+
+// applyEnvOverrides replaces the values of all keys in the tree for which an environment variable is set
+func applyEnvOverrides(node *yaml.Node, env string) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			applyEnvOverrides(child, env)
+		}
+
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			applyEnvOverrides(node.Content[i+1], env+"_"+getEnvName(node.Content[i].Value))
+		}
+
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			applyEnvOverrides(child, fmt.Sprintf("%v_%v", env, i))
+		}
+
+	case yaml.ScalarNode:
+		if value := utils.GetStringEnvOrDefault(env, node.Value); value != node.Value {
+			// Let the value's type be resolved again since it might differ from the one in the file
+			node.Value = value
+			node.Tag = ""
+			node.Style = 0
+		}
+	}
+}
+
+// getEnvName converts a key into the format used for environment variables, i.e. temperatureSensor into TEMPERATURE_SENSOR
+func getEnvName(key string) string {
+	name := strings.Builder{}
+	for i, r := range key {
+		switch {
+		case unicode.IsUpper(r):
+			if i > 0 {
+				name.WriteRune('_')
+			}
+
+			name.WriteRune(r)
+
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			name.WriteRune(unicode.ToUpper(r))
+
+		default:
+			name.WriteRune('_')
+		}
+	}
+
+	return name.String()
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/drivers"
+)
+
+// TestParseHub checks that rooms and plants are parsed from both YAML and JSON.
+func TestParseHub(t *testing.T) {
+	for name, data := range map[string]string{
+		"yaml": `
+rooms:
+  "1":
+    fan:
+      driver: gpio
+      path: /dev/gpiochip0
+      line: 17
+      maxRuntime: 10m
+    temperatureSensor:
+      path: /dev/ttyACM0
+      interval: 5s
+    defaultTemperature: 22.5
+plants:
+  "1":
+    moistureSensor:
+      driver: sysfs
+      path: /sys/bus/iio/devices/iio:device0/in_humidityrelative_input
+`,
+		"json": `{
+  "rooms": {
+    "1": {
+      "fan": {"driver": "gpio", "path": "/dev/gpiochip0", "line": 17, "maxRuntime": "10m"},
+      "temperatureSensor": {"path": "/dev/ttyACM0", "interval": "5s"},
+      "defaultTemperature": 22.5
+    }
+  },
+  "plants": {
+    "1": {
+      "moistureSensor": {"driver": "sysfs", "path": "/sys/bus/iio/devices/iio:device0/in_humidityrelative_input"}
+    }
+  }
+}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			config, err := ParseHub([]byte(data), "TEST_CONFIG")
+			if err != nil {
+				t.Fatalf("unexpected error during ParseHub: %v", err)
+			}
+
+			room := config.Rooms["1"]
+			if room.Fan == nil || room.Fan.Driver != drivers.DriverGPIO || room.Fan.Line != 17 || room.Fan.MaxRuntime != 10*time.Minute {
+				t.Fatalf("expected fan on GPIO line 17 with a maximum runtime of 10m, got %v", room.Fan)
+			}
+
+			if room.TemperatureSensor == nil || room.TemperatureSensor.Path != "/dev/ttyACM0" || room.TemperatureSensor.Interval != 5*time.Second {
+				t.Fatalf("expected temperature sensor at /dev/ttyACM0 with an interval of 5s, got %v", room.TemperatureSensor)
+			}
+
+			if room.DefaultTemperature == nil || *room.DefaultTemperature != 22.5 {
+				t.Fatalf("expected default temperature 22.5, got %v", room.DefaultTemperature)
+			}
+
+			if plant := config.Plants["1"]; plant.MoistureSensor == nil || plant.MoistureSensor.Driver != drivers.DriverSysfs || plant.Sprinkler != nil {
+				t.Fatalf("expected only a sysfs moisture sensor, got %v", plant)
+			}
+		})
+	}
+}
+
+// TestParseHubInvalid checks that invalid configurations are rejected with errors which point to the invalid keys.
+func TestParseHubInvalid(t *testing.T) {
+	_, err := ParseHub([]byte(`
+rooms:
+  "1":
+    temperatureSensor:
+      driver: gpio
+      maxRuntime: 1m
+  "2": {}
+plants:
+  "1":
+    sprinkler:
+      path: /dev/ttyACM0
+      interval: 1s
+`), "TEST_CONFIG")
+
+	for _, expected := range []error{ErrUnsupportedDriver, ErrMissingPath, ErrNoDevices, ErrIntervalNotAllowed, ErrMaxRuntimeNotAllowed} {
+		if !errors.Is(err, expected) {
+			t.Fatalf("expected error %v, got %v", expected, err)
+		}
+	}
+
+	if _, err := ParseHub([]byte(`rooms: {"1": {fan: {path: /dev/ttyACM0, unknown: true}}}`), "TEST_CONFIG"); err == nil {
+		t.Fatal("expected unknown keys to be rejected")
+	}
+}
+
+// TestParseHubEnvOverrides checks that environment variables override individual keys.
+func TestParseHubEnvOverrides(t *testing.T) {
+	t.Setenv("TEST_CONFIG_ROOMS_1_FAN_PATH", "/dev/ttyUSB0")
+	t.Setenv("TEST_CONFIG_ROOMS_1_TEMPERATURE_SENSOR_INTERVAL", "10s")
+
+	config, err := ParseHub([]byte(`
+rooms:
+  "1":
+    fan:
+      path: /dev/ttyACM0
+    temperatureSensor:
+      path: /dev/ttyACM0
+      interval: 1s
+`), "TEST_CONFIG")
+	if err != nil {
+		t.Fatalf("unexpected error during ParseHub: %v", err)
+	}
+
+	if path := config.Rooms["1"].Fan.Path; path != "/dev/ttyUSB0" {
+		t.Fatalf("expected fan path to be overridden with /dev/ttyUSB0, got %v", path)
+	}
+
+	if interval := config.Rooms["1"].TemperatureSensor.Interval; interval != 10*time.Second {
+		t.Fatalf("expected interval to be overridden with 10s, got %v", interval)
+	}
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watch polls a file in the given interval and notifies the returned channel whenever its size or modification time changes.
+// Polling instead of relying on file system events also detects files which are replaced, i.e. when mounted into a container.
+func Watch(ctx context.Context, path string, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		var prev os.FileInfo
+		if info, err := os.Stat(path); err == nil {
+			prev = info
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+				// A file which can't be read (i.e. while it is being replaced) is treated as unchanged
+				info, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+
+				if prev != nil && info.Size() == prev.Size() && info.ModTime().Equal(prev.ModTime()) {
+					continue
+				}
+				prev = info
+
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changes
+}
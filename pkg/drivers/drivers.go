@@ -0,0 +1,118 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrUnknownDriver      = errors.New("unknown driver")
+	ErrUnsupportedKind    = errors.New("driver does not support this kind of device")
+	ErrReadTimedOut       = errors.New("read timed out")
+	ErrInvalidMeasurement = errors.New("invalid measurement")
+)
+
+// Sensor is a device which takes measurements.
+// Temperature sensors measure in °C, moisture sensors in %RH.
+type Sensor interface {
+	// Read takes a measurement; it returns once the measurement has been taken or ctx is done.
+	Read(ctx context.Context) (float64, error)
+
+	// Close releases the device.
+	Close() error
+}
+
+// SharedDevice is implemented by sensors whose device can back several sensors and actuators, i.e. an IoTee or a serial port.
+// Reads from sensors which share a device must not overlap.
+type SharedDevice interface {
+	// DeviceKey identifies the device which backs the sensor.
+	DeviceKey() string
+}
+
+// Actuator is a device which can be turned on and off.
+type Actuator interface {
+	// Set turns the actuator on or off.
+	Set(ctx context.Context, on bool) error
+
+	// Close releases the device.
+	Close() error
+}
+
+// Driver is the way a device is accessed.
+type Driver string
+
+const (
+	// DriverIoTee accesses an IoTee board connected via a serial port
+	DriverIoTee Driver = "iotee"
+
+	// DriverGPIO switches a relay connected to a line of a Linux GPIO character device
+	DriverGPIO Driver = "gpio"
+
+	// DriverSysfs reads a value from a file, i.e. an IIO channel in sysfs
+	DriverSysfs Driver = "sysfs"
+
+	// DriverSerial talks to a device using a line-based protocol over a serial port
+	DriverSerial Driver = "serial"
+
+	// DriverSim simulates an IoTee in software, i.e. to run the hub without hardware
+	DriverSim Driver = "sim"
+)
+
+// ParseDriver parses a driver from a string.
+func ParseDriver(driver string) (Driver, error) {
+	switch Driver(driver) {
+	case DriverIoTee, DriverGPIO, DriverSysfs, DriverSerial, DriverSim:
+		return Driver(driver), nil
+
+	default:
+		return "", ErrUnknownDriver
+	}
+}
+
+// Kind is what a device is used for.
+type Kind string
+
+const (
+	KindFan               Kind = "fan"
+	KindSprinkler         Kind = "sprinkler"
+	KindTemperatureSensor Kind = "temperature-sensor"
+	KindMoistureSensor    Kind = "moisture-sensor"
+)
+
+// Config describes how to access a device.
+type Config struct {
+	// Driver to access the device with; if empty, the IoTee driver is used
+	Driver Driver `json:"driver" yaml:"driver"`
+
+	// Path of the device, i.e. /dev/ttyACM0, /dev/gpiochip0 or /sys/bus/iio/devices/iio:device0/in_temp_input
+	Path string `json:"path" yaml:"path"`
+
+	// Offset of the line on the GPIO chip and whether it is active low (gpio driver)
+	Line      int  `json:"line,omitempty" yaml:"line,omitempty"`
+	ActiveLow bool `json:"activeLow,omitempty" yaml:"activeLow,omitempty"`
+
+	// The measurement is (raw value + Offset) * Scale; a Scale of 0 is treated as 1 (sysfs driver)
+	Scale  float64 `json:"scale,omitempty" yaml:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty" yaml:"offset,omitempty"`
+
+	// Baud rate of the serial port; if 0, the manager's default is used (iotee and serial drivers)
+	Baud int `json:"baud,omitempty" yaml:"baud,omitempty"`
+
+	// Lines which are sent to request a measurement or to turn an actuator on or off (serial driver)
+	Request string `json:"request,omitempty" yaml:"request,omitempty"`
+	On      string `json:"on,omitempty" yaml:"on,omitempty"`
+	Off     string `json:"off,omitempty" yaml:"off,omitempty"`
+
+	// The value a sensor starts at (if 0, 20 °C or 50 %RH), the change per minute while the actuator is off,
+	// the standard deviation of the noise added to each measurement and the probability of a measurement failing (sim driver, sensors only)
+	Initial     float64 `json:"initial,omitempty" yaml:"initial,omitempty"`
+	Drift       float64 `json:"drift,omitempty" yaml:"drift,omitempty"`
+	Noise       float64 `json:"noise,omitempty" yaml:"noise,omitempty"`
+	FailureRate float64 `json:"failureRate,omitempty" yaml:"failureRate,omitempty"`
+
+	// The additional change per minute while the actuator is on; if 0, -2 °C for fans and 10 %RH for sprinklers (sim driver, actuators only)
+	Effect float64 `json:"effect,omitempty" yaml:"effect,omitempty"`
+
+	// Seed for the noise and failures; if 0, a random seed is used (sim driver)
+	Seed int64 `json:"seed,omitempty" yaml:"seed,omitempty"`
+}
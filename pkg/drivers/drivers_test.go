@@ -0,0 +1,176 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+)
+
+// TestParseDriver checks that only known drivers can be selected.
+func TestParseDriver(t *testing.T) {
+	if driver, err := ParseDriver("gpio"); err != nil || driver != DriverGPIO {
+		t.Fatalf("expected driver %v, got %v and error %v", DriverGPIO, driver, err)
+	}
+
+	if _, err := ParseDriver("unknown"); !errors.Is(err, ErrUnknownDriver) {
+		t.Fatalf("expected error %v, got %v", ErrUnknownDriver, err)
+	}
+}
+
+// TestSysfsSensor checks that the sysfs driver scales and offsets the value it reads.
+func TestSysfsSensor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "in_temp_raw")
+	if err := os.WriteFile(path, []byte("2350\n"), 0600); err != nil {
+		t.Fatalf("unexpected error during WriteFile: %v", err)
+	}
+
+	sensor, err := NewManager(0, false, logging.NewDiscardLogger()).OpenSensor(KindTemperatureSensor, Config{
+		Driver: DriverSysfs,
+		Path:   path,
+		Scale:  0.01,
+		Offset: 50,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error during OpenSensor: %v", err)
+	}
+	defer sensor.Close()
+
+	measurement, err := sensor.Read(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error during Read: %v", err)
+	}
+
+	if measurement != 24 {
+		t.Fatalf("expected measurement 24, got %v", measurement)
+	}
+}
+
+// TestOpenUnsupportedKind checks that drivers can't be used for devices they don't support.
+func TestOpenUnsupportedKind(t *testing.T) {
+	manager := NewManager(0, false, logging.NewDiscardLogger())
+
+	if _, err := manager.OpenSensor(KindTemperatureSensor, Config{Driver: DriverGPIO}); !errors.Is(err, ErrUnsupportedKind) {
+		t.Fatalf("expected error %v, got %v", ErrUnsupportedKind, err)
+	}
+
+	if _, err := manager.OpenActuator(KindFan, Config{Driver: DriverSysfs}); !errors.Is(err, ErrUnsupportedKind) {
+		t.Fatalf("expected error %v, got %v", ErrUnsupportedKind, err)
+	}
+}
+
+// TestSimulatedIoTee checks that the simulated temperature drifts while the fan is off and responds to the fan once it is on.
+func TestSimulatedIoTee(t *testing.T) {
+	manager := NewManager(0, false, logging.NewDiscardLogger())
+
+	sensor, err := manager.OpenSensor(KindTemperatureSensor, Config{
+		Driver:  DriverSim,
+		Path:    "room-1",
+		Initial: 25,
+		Drift:   1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error during OpenSensor: %v", err)
+	}
+	defer sensor.Close()
+
+	fan, err := manager.OpenActuator(KindFan, Config{
+		Driver: DriverSim,
+		Path:   "room-1",
+		Effect: -3,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error during OpenActuator: %v", err)
+	}
+	defer fan.Close()
+
+	// Control the simulation's clock
+	simulation := sensor.(IoTeeDevice).IoTee().(*SimulatedIoTee)
+
+	now := time.Now()
+	simulation.now = func() time.Time {
+		return now
+	}
+	simulation.temperature.updated = now
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, step := range []struct {
+		on       bool
+		expected float64
+	}{
+		{on: false, expected: 27},
+		{on: true, expected: 23},
+	} {
+		if err := fan.Set(ctx, step.on); err != nil {
+			t.Fatalf("unexpected error during Set: %v", err)
+		}
+
+		now = now.Add(2 * time.Minute)
+
+		measurement, err := sensor.Read(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error during Read: %v", err)
+		}
+
+		if measurement != step.expected {
+			t.Fatalf("expected measurement %v with fan on %v, got %v", step.expected, step.on, measurement)
+		}
+	}
+}
+
+// TestSimulatedIoTeeFailures checks that measurements of a simulated sensor which always fails time out.
+func TestSimulatedIoTeeFailures(t *testing.T) {
+	sensor, err := NewManager(0, false, logging.NewDiscardLogger()).OpenSensor(KindMoistureSensor, Config{
+		Driver:      DriverSim,
+		Path:        "plant-1",
+		FailureRate: 1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error during OpenSensor: %v", err)
+	}
+	defer sensor.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := sensor.Read(ctx); !errors.Is(err, ErrReadTimedOut) {
+		t.Fatalf("expected error %v, got %v", ErrReadTimedOut, err)
+	}
+}
+
+// TestDeviceKey checks that sensors which are backed by the same device share their device key.
+func TestDeviceKey(t *testing.T) {
+	manager := NewManager(0, false, logging.NewDiscardLogger())
+
+	keys := []string{}
+	for _, tt := range []struct {
+		kind Kind
+		path string
+	}{
+		{KindTemperatureSensor, "room-1"},
+		{KindMoistureSensor, "room-1"},
+		{KindTemperatureSensor, "room-2"},
+	} {
+		sensor, err := manager.OpenSensor(tt.kind, Config{Driver: DriverSim, Path: tt.path})
+		if err != nil {
+			t.Fatalf("unexpected error during OpenSensor: %v", err)
+		}
+		defer sensor.Close()
+
+		keys = append(keys, sensor.(SharedDevice).DeviceKey())
+	}
+
+	if keys[0] != keys[1] {
+		t.Fatalf("expected sensors of the same device to share their key, got %v and %v", keys[0], keys[1])
+	}
+
+	if keys[0] == keys[2] {
+		t.Fatalf("expected sensors of different devices to have different keys, got %v", keys[0])
+	}
+}
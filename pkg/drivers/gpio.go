@@ -0,0 +1,48 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+var (
+	ErrUnsupportedPlatform = errors.New("driver is not supported on this platform")
+)
+
+// GPIOActuator switches a relay which is connected to a line of a GPIO chip.
+type GPIOActuator struct {
+	line    gpioLine
+	release func() error
+}
+
+// Set drives the line active to turn the relay on and inactive to turn it off.
+func (a *GPIOActuator) Set(ctx context.Context, on bool) error {
+	return a.line.set(on)
+}
+
+// Close releases the line.
+func (a *GPIOActuator) Close() error {
+	return a.release()
+}
+
+func (m *Manager) openGPIOActuator(config Config) (Actuator, error) {
+	key := string(DriverGPIO) + ":" + config.Path + ":" + strconv.Itoa(config.Line)
+
+	line, err := m.acquire(key, func() (interface{}, func() error, error) {
+		line, err := requestGPIOLine(config.Path, config.Line, config.ActiveLow)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return line, line.close, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &GPIOActuator{
+		line:    line.(gpioLine),
+		release: m.releaser(key),
+	}, nil
+}
@@ -0,0 +1,109 @@
+//go:build linux
+
+package drivers
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// See linux/gpio.h for the character device's v2 uAPI
+const (
+	gpioMaxLines       = 64
+	gpioMaxNameSize    = 32
+	gpioLineNumAttrs   = 10
+	gpioLineFlagOutput = 1 << 3
+	gpioLineFlagLow    = 1 << 1
+
+	gpioGetLineIoctl       = 0xc250b407 // _IOWR(0xB4, 0x07, struct gpio_v2_line_request)
+	gpioSetLineValuesIoctl = 0xc010b40f // _IOWR(0xB4, 0x0F, struct gpio_v2_line_values)
+
+	gpioConsumer = "green-guardian-hub"
+)
+
+type gpioLineAttribute struct {
+	id      uint32
+	padding uint32
+	value   uint64
+}
+
+type gpioLineConfigAttribute struct {
+	attr gpioLineAttribute
+	mask uint64
+}
+
+type gpioLineConfig struct {
+	flags    uint64
+	numAttrs uint32
+	padding  [5]uint32
+	attrs    [gpioLineNumAttrs]gpioLineConfigAttribute
+}
+
+type gpioLineRequest struct {
+	offsets         [gpioMaxLines]uint32
+	consumer        [gpioMaxNameSize]byte
+	config          gpioLineConfig
+	numLines        uint32
+	eventBufferSize uint32
+	padding         [5]uint32
+	fd              int32
+}
+
+type gpioLineValues struct {
+	bits uint64
+	mask uint64
+}
+
+// gpioLine is a single requested output line
+type gpioLine struct {
+	fd int
+}
+
+// requestGPIOLine requests a line of a GPIO chip as an output which is initially inactive
+func requestGPIOLine(path string, offset int, activeLow bool) (gpioLine, error) {
+	chip, err := os.Open(path)
+	if err != nil {
+		return gpioLine{}, err
+	}
+	defer chip.Close()
+
+	req := gpioLineRequest{
+		numLines: 1,
+	}
+	req.offsets[0] = uint32(offset)
+	copy(req.consumer[:], gpioConsumer)
+
+	req.config.flags = gpioLineFlagOutput
+	if activeLow {
+		req.config.flags |= gpioLineFlagLow
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, chip.Fd(), gpioGetLineIoctl, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return gpioLine{}, errno
+	}
+
+	return gpioLine{
+		fd: int(req.fd),
+	}, nil
+}
+
+func (l gpioLine) set(active bool) error {
+	values := gpioLineValues{
+		mask: 1,
+	}
+	if active {
+		values.bits = 1
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(l.fd), gpioSetLineValuesIoctl, uintptr(unsafe.Pointer(&values))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func (l gpioLine) close() error {
+	return unix.Close(l.fd)
+}
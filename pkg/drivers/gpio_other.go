@@ -0,0 +1,12 @@
+//go:build !linux
+
+package drivers
+
+type gpioLine interface {
+	set(active bool) error
+	close() error
+}
+
+func requestGPIOLine(path string, offset int, activeLow bool) (gpioLine, error) {
+	return nil, ErrUnsupportedPlatform
+}
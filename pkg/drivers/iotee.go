@@ -0,0 +1,213 @@
+package drivers
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
+	"gitlab.mi.hdm-stuttgart.de/iotee/go-iotee"
+)
+
+// IoTeeDevice is implemented by drivers which are backed by an IoTee, i.e. to use its buttons.
+type IoTeeDevice interface {
+	IoTee() utils.IoTee
+}
+
+// IoTeeSensor requests measurements from an IoTee's built-in sensors.
+type IoTeeSensor struct {
+	key     string
+	device  utils.IoTee
+	request iotee.Message
+	release func() error
+}
+
+// NewIoTeeSensor creates a temperature or moisture sensor from an IoTee.
+func NewIoTeeSensor(device utils.IoTee, kind Kind) (*IoTeeSensor, error) {
+	var request iotee.Message
+	switch kind {
+	case KindTemperatureSensor:
+		request = iotee.NewMessage(iotee.MessageTypeTempReq, 0)
+
+	case KindMoistureSensor:
+		request = iotee.NewMessage(iotee.MessageTypeHumReq, 0)
+
+	default:
+		return nil, ErrUnsupportedKind
+	}
+
+	return &IoTeeSensor{
+		device:  device,
+		request: request,
+	}, nil
+}
+
+// Read requests a measurement and waits for the response until ctx is done.
+func (s *IoTeeSensor) Read(ctx context.Context) (float64, error) {
+	req := s.request
+	if err := s.device.Transmit(&req); err != nil {
+		return 0, err
+	}
+
+	var res *iotee.Message
+	if deadline, ok := ctx.Deadline(); ok {
+		res = s.device.ReceiveWithTimeout(time.Until(deadline))
+	} else {
+		res = s.device.ReceiveBlocking()
+	}
+
+	if res == nil {
+		return 0, ErrReadTimedOut
+	}
+
+	if len(res.Data) < 4 {
+		return 0, ErrInvalidMeasurement
+	}
+
+	// The IoTee sends measurements with a resolution of 0.01
+	return float64(binary.BigEndian.Uint32(res.Data[0:4])) / 100.0, nil
+}
+
+// DeviceKey identifies the IoTee which backs the sensor.
+func (s *IoTeeSensor) DeviceKey() string {
+	// Sensors which haven't been opened by a manager are identified by the IoTee they have been created from
+	if s.key == "" {
+		return fmt.Sprintf("%v:%p", DriverIoTee, s.device)
+	}
+
+	return s.key
+}
+
+// IoTee returns the IoTee which backs the sensor.
+func (s *IoTeeSensor) IoTee() utils.IoTee {
+	return s.device
+}
+
+// Close releases the IoTee.
+func (s *IoTeeSensor) Close() error {
+	if s.release == nil {
+		return nil
+	}
+
+	return s.release()
+}
+
+// IoTeeActuator shows the state of an actuator using an IoTee's RGB LED.
+// Fans are shown in red, sprinklers in green.
+type IoTeeActuator struct {
+	device  utils.IoTee
+	color   []byte
+	release func() error
+}
+
+// NewIoTeeActuator creates a fan or sprinkler from an IoTee.
+func NewIoTeeActuator(device utils.IoTee, kind Kind) (*IoTeeActuator, error) {
+	var color []byte
+	switch kind {
+	case KindFan:
+		color = []byte{255, 0, 0}
+
+	case KindSprinkler:
+		color = []byte{0, 255, 0}
+
+	default:
+		return nil, ErrUnsupportedKind
+	}
+
+	return &IoTeeActuator{
+		device: device,
+		color:  color,
+	}, nil
+}
+
+// Set turns the LED on or off.
+func (a *IoTeeActuator) Set(ctx context.Context, on bool) error {
+	req := iotee.NewMessage(iotee.MessageTypeRGBLED, 4)
+
+	intensity := byte(0)
+	if on {
+		intensity = 255
+	}
+
+	req.Data = append([]byte{intensity}, a.color...)
+
+	return a.device.Transmit(&req)
+}
+
+// IoTee returns the IoTee which backs the actuator.
+func (a *IoTeeActuator) IoTee() utils.IoTee {
+	return a.device
+}
+
+// Close releases the IoTee.
+func (a *IoTeeActuator) Close() error {
+	if a.release == nil {
+		return nil
+	}
+
+	return a.release()
+}
+
+// acquireIoTee opens an IoTee or returns it if it is already open
+func (m *Manager) acquireIoTee(config Config) (string, utils.IoTee, error) {
+	key := string(DriverIoTee) + ":" + config.Path
+
+	device, err := m.acquire(key, func() (interface{}, func() error, error) {
+		it := iotee.NewIoTee(config.Path, m.getBaud(config))
+		if err := it.Open(); err != nil {
+			return nil, nil, err
+		}
+
+		// The pump is started once per IoTee, no matter how many drivers use it, and stops once the IoTee is closed
+		if m.buttons {
+			go it.RxPump()
+		}
+
+		return utils.NewIoTeeAdapter(it), func() error {
+			it.Close()
+
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return key, device.(utils.IoTee), nil
+}
+
+func (m *Manager) openIoTeeSensor(kind Kind, config Config) (Sensor, error) {
+	key, device, err := m.acquireIoTee(config)
+	if err != nil {
+		return nil, err
+	}
+
+	sensor, err := NewIoTeeSensor(device, kind)
+	if err != nil {
+		_ = m.release(key)
+
+		return nil, err
+	}
+	sensor.key = key
+	sensor.release = m.releaser(key)
+
+	return sensor, nil
+}
+
+func (m *Manager) openIoTeeActuator(kind Kind, config Config) (Actuator, error) {
+	key, device, err := m.acquireIoTee(config)
+	if err != nil {
+		return nil, err
+	}
+
+	actuator, err := NewIoTeeActuator(device, kind)
+	if err != nil {
+		_ = m.release(key)
+
+		return nil, err
+	}
+	actuator.release = m.releaser(key)
+
+	return actuator, nil
+}
@@ -0,0 +1,216 @@
+package drivers
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+)
+
+// sharedDevice is an opened device which can be used by multiple drivers at once,
+// i.e. an IoTee which serves as both a temperature sensor and a fan.
+type sharedDevice struct {
+	device interface{}
+	close  func() error
+
+	refs int
+}
+
+// Manager opens devices using the driver they are configured with.
+// Drivers which access the same underlying device share it; it is closed once the last of them is closed.
+type Manager struct {
+	baud int
+
+	// Whether the buttons of IoTees are used, in which case their messages have to be received in the background
+	buttons bool
+
+	logger *slog.Logger
+
+	devices     map[string]*sharedDevice
+	devicesLock sync.Mutex
+}
+
+// NewManager creates a new manager.
+// baud is the default baud rate for serial devices.
+// If buttons is set, IoTees receive messages into their RxChan for as long as they are open so that button presses can be read from it.
+func NewManager(baud int, buttons bool, logger *slog.Logger) *Manager {
+	return &Manager{
+		baud: baud,
+
+		buttons: buttons,
+
+		logger: logging.WithSubsystem(logger, logging.SubsystemDevice),
+
+		devices: map[string]*sharedDevice{},
+	}
+}
+
+// OpenSensor opens a device for use as a sensor.
+func (m *Manager) OpenSensor(kind Kind, config Config) (Sensor, error) {
+	sensor, err := m.openSensor(kind, config)
+	if err != nil {
+		return nil, err
+	}
+
+	m.getLogger(kind, config).Debug("Opened sensor")
+
+	return sensor, nil
+}
+
+func (m *Manager) openSensor(kind Kind, config Config) (Sensor, error) {
+	switch config.Driver {
+	case DriverIoTee, "":
+		return m.openIoTeeSensor(kind, config)
+
+	case DriverSysfs:
+		return newSysfsSensor(config), nil
+
+	case DriverSerial:
+		return m.openSerialSensor(config)
+
+	case DriverSim:
+		return m.openSimulatedSensor(kind, config)
+
+	case DriverGPIO:
+		return nil, ErrUnsupportedKind
+
+	default:
+		return nil, ErrUnknownDriver
+	}
+}
+
+// OpenActuator opens a device for use as an actuator.
+func (m *Manager) OpenActuator(kind Kind, config Config) (Actuator, error) {
+	actuator, err := m.openActuator(kind, config)
+	if err != nil {
+		return nil, err
+	}
+
+	m.getLogger(kind, config).Debug("Opened actuator")
+
+	return actuator, nil
+}
+
+func (m *Manager) openActuator(kind Kind, config Config) (Actuator, error) {
+	switch config.Driver {
+	case DriverIoTee, "":
+		return m.openIoTeeActuator(kind, config)
+
+	case DriverGPIO:
+		return m.openGPIOActuator(config)
+
+	case DriverSerial:
+		return m.openSerialActuator(config)
+
+	case DriverSim:
+		return m.openSimulatedActuator(kind, config)
+
+	case DriverSysfs:
+		return nil, ErrUnsupportedKind
+
+	default:
+		return nil, ErrUnknownDriver
+	}
+}
+
+// Close closes all devices which are still open.
+func (m *Manager) Close() error {
+	m.devicesLock.Lock()
+	defer m.devicesLock.Unlock()
+
+	errs := []error{}
+	for key, device := range m.devices {
+		if err := device.close(); err != nil {
+			errs = append(errs, err)
+		}
+
+		delete(m.devices, key)
+	}
+
+	return errors.Join(errs...)
+}
+
+// getLogger returns a logger with the device's kind, driver and path attached
+func (m *Manager) getLogger(kind Kind, config Config) *slog.Logger {
+	driver := config.Driver
+	if driver == "" {
+		driver = DriverIoTee
+	}
+
+	return m.logger.With(logging.KeyKind, kind, logging.KeyDriver, driver, logging.KeyPath, config.Path)
+}
+
+// getBaud returns the baud rate to open a serial device with
+func (m *Manager) getBaud(config Config) int {
+	if config.Baud > 0 {
+		return config.Baud
+	}
+
+	return m.baud
+}
+
+// acquire returns the device with the given key, opening it first if it is not open yet.
+// Every call must be followed by a call to release once the device is no longer used.
+func (m *Manager) acquire(key string, open func() (interface{}, func() error, error)) (interface{}, error) {
+	m.devicesLock.Lock()
+	defer m.devicesLock.Unlock()
+
+	if device, ok := m.devices[key]; ok {
+		device.refs++
+
+		return device.device, nil
+	}
+
+	device, close, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	m.logger.Info("Opened device", logging.KeyDevice, key)
+
+	m.devices[key] = &sharedDevice{
+		device: device,
+		close:  close,
+
+		refs: 1,
+	}
+
+	return device, nil
+}
+
+// release closes the device with the given key once it is no longer used by any driver
+func (m *Manager) release(key string) error {
+	m.devicesLock.Lock()
+	defer m.devicesLock.Unlock()
+
+	device, ok := m.devices[key]
+	if !ok {
+		return nil
+	}
+
+	device.refs--
+	if device.refs > 0 {
+		return nil
+	}
+
+	delete(m.devices, key)
+
+	m.logger.Info("Closing device", logging.KeyDevice, key)
+
+	return device.close()
+}
+
+// releaser returns a function which releases the device with the given key once, no matter how often it is called
+func (m *Manager) releaser(key string) func() error {
+	var once sync.Once
+
+	return func() error {
+		var err error
+		once.Do(func() {
+			err = m.release(key)
+		})
+
+		return err
+	}
+}
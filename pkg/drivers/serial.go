@@ -0,0 +1,217 @@
+package drivers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	defaultSerialRequest = "READ"
+	defaultSerialOn      = "ON"
+	defaultSerialOff     = "OFF"
+
+	// Interval in which blocked reads from a serial port return so that cancellation can be checked
+	serialPollInterval = 100 * time.Millisecond
+)
+
+// lineDevice is a serial port which is accessed using a line-based protocol
+type lineDevice struct {
+	port    *serial.Port
+	control *serialControl
+	reader  *bufio.Reader
+
+	lock sync.Mutex
+}
+
+// writeLine sends a line to the device, discarding any input which has not been read yet. The caller must hold the lock.
+// Output which has not been sent yet, i.e. a line which switches an actuator of the same device, is kept.
+func (d *lineDevice) writeLine(line string) error {
+	if err := d.control.flushInput(); err != nil {
+		return err
+	}
+	d.reader.Reset(d.port)
+
+	_, err := d.port.Write([]byte(line + "\n"))
+
+	return err
+}
+
+// readLine reads a line from the device until ctx is done. The caller must hold the lock.
+func (d *lineDevice) readLine(ctx context.Context) (string, error) {
+	line := ""
+	for {
+		chunk, err := d.reader.ReadString('\n')
+		line += chunk
+
+		if err == nil {
+			return strings.TrimSpace(line), nil
+		}
+
+		// The port returns EOF if no data has arrived within the poll interval
+		if !errors.Is(err, io.EOF) {
+			return "", err
+		}
+
+		if ctx.Err() != nil {
+			return "", ErrReadTimedOut
+		}
+	}
+}
+
+// SerialSensor requests measurements by sending a line to a serial device and parses the line it responds with as a number.
+type SerialSensor struct {
+	key     string
+	device  *lineDevice
+	request string
+	release func() error
+}
+
+// Read sends the request line and waits for the response until ctx is done.
+func (s *SerialSensor) Read(ctx context.Context) (float64, error) {
+	s.device.lock.Lock()
+	defer s.device.lock.Unlock()
+
+	if err := s.device.writeLine(s.request); err != nil {
+		return 0, err
+	}
+
+	line, err := s.device.readLine(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := strconv.ParseFloat(line, 64)
+	if err != nil {
+		return 0, ErrInvalidMeasurement
+	}
+
+	return value, nil
+}
+
+// DeviceKey identifies the serial port which backs the sensor.
+func (s *SerialSensor) DeviceKey() string {
+	return s.key
+}
+
+// Close releases the serial port.
+func (s *SerialSensor) Close() error {
+	return s.release()
+}
+
+// SerialActuator turns an actuator on or off by sending a line to a serial device.
+type SerialActuator struct {
+	device *lineDevice
+
+	on,
+	off string
+
+	release func() error
+}
+
+// Set sends the line which turns the actuator on or off.
+func (a *SerialActuator) Set(ctx context.Context, on bool) error {
+	a.device.lock.Lock()
+	defer a.device.lock.Unlock()
+
+	if on {
+		return a.device.writeLine(a.on)
+	}
+
+	return a.device.writeLine(a.off)
+}
+
+// Close releases the serial port.
+func (a *SerialActuator) Close() error {
+	return a.release()
+}
+
+// acquireLineDevice opens a serial port or returns it if it is already open
+func (m *Manager) acquireLineDevice(config Config) (string, *lineDevice, error) {
+	key := string(DriverSerial) + ":" + config.Path
+
+	device, err := m.acquire(key, func() (interface{}, func() error, error) {
+		port, err := serial.OpenPort(&serial.Config{
+			Name:        config.Path,
+			Baud:        m.getBaud(config),
+			ReadTimeout: serialPollInterval,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		control, err := openSerialControl(config.Path)
+		if err != nil {
+			_ = port.Close()
+
+			return nil, nil, err
+		}
+
+		device := &lineDevice{
+			port:    port,
+			control: control,
+			reader:  bufio.NewReader(port),
+		}
+
+		return device, func() error {
+			return errors.Join(control.close(), port.Close())
+		}, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return key, device.(*lineDevice), nil
+}
+
+func (m *Manager) openSerialSensor(config Config) (Sensor, error) {
+	key, device, err := m.acquireLineDevice(config)
+	if err != nil {
+		return nil, err
+	}
+
+	request := config.Request
+	if request == "" {
+		request = defaultSerialRequest
+	}
+
+	return &SerialSensor{
+		key:     key,
+		device:  device,
+		request: request,
+		release: m.releaser(key),
+	}, nil
+}
+
+func (m *Manager) openSerialActuator(config Config) (Actuator, error) {
+	key, device, err := m.acquireLineDevice(config)
+	if err != nil {
+		return nil, err
+	}
+
+	on := config.On
+	if on == "" {
+		on = defaultSerialOn
+	}
+
+	off := config.Off
+	if off == "" {
+		off = defaultSerialOff
+	}
+
+	return &SerialActuator{
+		device: device,
+
+		on:  on,
+		off: off,
+
+		release: m.releaser(key),
+	}, nil
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package drivers
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// serialControl is a second descriptor of a serial port which is used to discard its input.
+// tarm/serial only flushes input and output at once, which would drop lines that have been written to a shared port but not sent yet.
+type serialControl struct {
+	fd int
+}
+
+func openSerialControl(path string) (*serialControl, error) {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &serialControl{fd}, nil
+}
+
+// flushInput discards input which has been received but not read yet
+func (c *serialControl) flushInput() error {
+	return unix.IoctlSetInt(c.fd, unix.TCFLSH, unix.TCIFLUSH)
+}
+
+func (c *serialControl) close() error {
+	return unix.Close(c.fd)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package drivers
+
+// serialControl discards the input of a serial port; on other platforms, only input which has been buffered by the reader is discarded.
+type serialControl struct{}
+
+func openSerialControl(path string) (*serialControl, error) {
+	return &serialControl{}, nil
+}
+
+func (c *serialControl) flushInput() error {
+	return nil
+}
+
+func (c *serialControl) close() error {
+	return nil
+}
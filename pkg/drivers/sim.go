@@ -0,0 +1,298 @@
+package drivers
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
+	"gitlab.mi.hdm-stuttgart.de/iotee/go-iotee"
+)
+
+const (
+	defaultSimulatedTemperature = 20 // °C
+	defaultSimulatedMoisture    = 50 // %RH
+
+	defaultFanEffect       = -2 // °C per minute
+	defaultSprinklerEffect = 10 // %RH per minute
+
+	// The IoTee protocol can't represent negative measurements
+	minSimulatedValue = 0
+	maxSimulatedValue = 100
+)
+
+// simulatedQuantity is a temperature or moisture which changes over time depending on whether its actuator is on
+type simulatedQuantity struct {
+	configured bool
+
+	value   float64
+	updated time.Time
+
+	drift  float64 // Change per minute while the actuator is off
+	effect float64 // Additional change per minute while the actuator is on
+
+	noise       float64 // Standard deviation of the noise added to each measurement
+	failureRate float64 // Probability of a measurement not being answered
+
+	on bool
+}
+
+// update advances the quantity to the given time
+func (q *simulatedQuantity) update(now time.Time) {
+	rate := q.drift
+	if q.on {
+		rate += q.effect
+	}
+
+	q.value = math.Min(maxSimulatedValue, math.Max(minSimulatedValue, q.value+rate*now.Sub(q.updated).Minutes()))
+	q.updated = now
+}
+
+// SimulatedIoTee is an IoTee which simulates the temperature of a room and the moisture of a plant in software.
+// The temperature responds to the fan (the red LED) and the moisture to the sprinkler (the green LED).
+type SimulatedIoTee struct {
+	temperature,
+	moisture simulatedQuantity
+	lock sync.Mutex
+
+	random *rand.Rand
+	now    func() time.Time
+
+	rx chan *iotee.Message
+}
+
+// NewSimulatedIoTee creates a simulated IoTee; if seed is 0, a random seed is used.
+func NewSimulatedIoTee(seed int64) *SimulatedIoTee {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &SimulatedIoTee{
+		random: rand.New(rand.NewSource(seed)),
+		now:    time.Now,
+
+		rx: make(chan *iotee.Message, 1),
+	}
+}
+
+// getQuantity returns the quantity which a kind of device measures or changes
+func (s *SimulatedIoTee) getQuantity(kind Kind) (*simulatedQuantity, error) {
+	switch kind {
+	case KindTemperatureSensor, KindFan:
+		return &s.temperature, nil
+
+	case KindMoistureSensor, KindSprinkler:
+		return &s.moisture, nil
+
+	default:
+		return nil, ErrUnsupportedKind
+	}
+}
+
+// Configure sets the simulation parameters of the quantity a device measures or changes.
+// Sensors set the initial value, the drift, the noise and the failure rate, actuators set their effect.
+func (s *SimulatedIoTee) Configure(kind Kind, config Config) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	quantity, err := s.getQuantity(kind)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	if !quantity.configured {
+		quantity.configured = true
+		quantity.updated = now
+
+		switch kind {
+		case KindTemperatureSensor, KindFan:
+			quantity.value = defaultSimulatedTemperature
+			quantity.effect = defaultFanEffect
+
+		default:
+			quantity.value = defaultSimulatedMoisture
+			quantity.effect = defaultSprinklerEffect
+		}
+	}
+
+	// Apply the changes up until now with the previous parameters
+	quantity.update(now)
+
+	switch kind {
+	case KindTemperatureSensor, KindMoistureSensor:
+		if config.Initial != 0 {
+			quantity.value = config.Initial
+		}
+
+		quantity.drift = config.Drift
+		quantity.noise = config.Noise
+		quantity.failureRate = config.FailureRate
+
+	default:
+		if config.Effect != 0 {
+			quantity.effect = config.Effect
+		}
+	}
+
+	return nil
+}
+
+// measure returns the current value of a quantity with noise applied, or false if the measurement fails
+func (s *SimulatedIoTee) measure(quantity *simulatedQuantity) (float64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	quantity.update(s.now())
+
+	if s.random.Float64() < quantity.failureRate {
+		return 0, false
+	}
+
+	return math.Min(maxSimulatedValue, math.Max(minSimulatedValue, quantity.value+s.random.NormFloat64()*quantity.noise)), true
+}
+
+// respond queues a measurement as the response to a request
+func (s *SimulatedIoTee) respond(msgType iotee.MessageType, quantity *simulatedQuantity) {
+	value, ok := s.measure(quantity)
+	if !ok {
+		// Failed measurements are never answered, just like a stuck sensor
+		return
+	}
+
+	// The IoTee sends measurements with a resolution of 0.01; the IoTee driver only looks at the data of the response
+	res := iotee.NewMessage(msgType, 4)
+	res.Data = make([]byte, 4)
+	binary.BigEndian.PutUint32(res.Data, uint32(math.Round(value*100)))
+
+	// Drop the response if the previous one hasn't been received yet
+	select {
+	case s.rx <- &res:
+	default:
+	}
+}
+
+func (s *SimulatedIoTee) Open() error {
+	return nil
+}
+
+func (s *SimulatedIoTee) Close() {}
+
+// RxPump does nothing since responses are queued as soon as requests are transmitted.
+func (s *SimulatedIoTee) RxPump() {}
+
+func (s *SimulatedIoTee) RxChan() chan *iotee.Message {
+	return s.rx
+}
+
+func (s *SimulatedIoTee) ReceiveWithTimeout(timeout time.Duration) *iotee.Message {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case msg := <-s.rx:
+		return msg
+
+	case <-t.C:
+		return nil
+	}
+}
+
+func (s *SimulatedIoTee) ReceiveBlocking() *iotee.Message {
+	return <-s.rx
+}
+
+// Transmit answers measurement requests and switches the fan and the sprinkler using the color of the LED.
+func (s *SimulatedIoTee) Transmit(msg *iotee.Message) error {
+	switch msg.MsgType {
+	case iotee.MessageTypeTempReq:
+		s.respond(msg.MsgType, &s.temperature)
+
+	case iotee.MessageTypeHumReq:
+		s.respond(msg.MsgType, &s.moisture)
+
+	case iotee.MessageTypeRGBLED:
+		if len(msg.Data) < 4 {
+			return ErrInvalidMeasurement
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		now := s.now()
+		on := msg.Data[0] > 0
+
+		// Red is the fan, green is the sprinkler
+		if msg.Data[1] > 0 {
+			s.temperature.update(now)
+			s.temperature.on = on
+		}
+
+		if msg.Data[2] > 0 {
+			s.moisture.update(now)
+			s.moisture.on = on
+		}
+	}
+
+	return nil
+}
+
+// acquireSimulatedIoTee creates a simulated IoTee or returns it if it already exists;
+// devices with the same path share the same simulated room and plant
+func (m *Manager) acquireSimulatedIoTee(kind Kind, config Config) (string, utils.IoTee, error) {
+	key := string(DriverSim) + ":" + config.Path
+
+	device, err := m.acquire(key, func() (interface{}, func() error, error) {
+		return NewSimulatedIoTee(config.Seed), func() error {
+			return nil
+		}, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := device.(*SimulatedIoTee).Configure(kind, config); err != nil {
+		_ = m.release(key)
+
+		return "", nil, err
+	}
+
+	return key, device.(utils.IoTee), nil
+}
+
+func (m *Manager) openSimulatedSensor(kind Kind, config Config) (Sensor, error) {
+	key, device, err := m.acquireSimulatedIoTee(kind, config)
+	if err != nil {
+		return nil, err
+	}
+
+	sensor, err := NewIoTeeSensor(device, kind)
+	if err != nil {
+		_ = m.release(key)
+
+		return nil, err
+	}
+	sensor.key = key
+	sensor.release = m.releaser(key)
+
+	return sensor, nil
+}
+
+func (m *Manager) openSimulatedActuator(kind Kind, config Config) (Actuator, error) {
+	key, device, err := m.acquireSimulatedIoTee(kind, config)
+	if err != nil {
+		return nil, err
+	}
+
+	actuator, err := NewIoTeeActuator(device, kind)
+	if err != nil {
+		_ = m.release(key)
+
+		return nil, err
+	}
+	actuator.release = m.releaser(key)
+
+	return actuator, nil
+}
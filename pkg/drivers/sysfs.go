@@ -0,0 +1,55 @@
+package drivers
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SysfsSensor reads measurements from a file which contains a single number,
+// i.e. a processed or raw IIO channel such as /sys/bus/iio/devices/iio:device0/in_temp_input.
+type SysfsSensor struct {
+	path string
+
+	scale,
+	offset float64
+}
+
+func newSysfsSensor(config Config) *SysfsSensor {
+	scale := config.Scale
+	if scale == 0 {
+		scale = 1
+	}
+
+	return &SysfsSensor{
+		path: config.Path,
+
+		scale:  scale,
+		offset: config.Offset,
+	}
+}
+
+// Read reads the file and converts its value into a measurement.
+func (s *SysfsSensor) Read(ctx context.Context) (float64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(raw)), 64)
+	if err != nil {
+		return 0, ErrInvalidMeasurement
+	}
+
+	return (value + s.offset) * s.scale, nil
+}
+
+// Close does nothing since the file is only opened while reading.
+func (s *SysfsSensor) Close() error {
+	return nil
+}
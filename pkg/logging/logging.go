@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown log format")
+	ErrUnknownLevel  = errors.New("unknown log level")
+)
+
+// Format is the format log records are written in.
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// Subsystems which have their own logger, set as the subsystem attribute
+const (
+	SubsystemMQTT      = "mqtt"
+	SubsystemRPC       = "rpc"
+	SubsystemRules     = "rules"
+	SubsystemHubWorker = "hub-worker"
+	SubsystemDevice    = "device"
+	SubsystemConfig    = "config"
+	SubsystemHTTP      = "http"
+	SubsystemAdmin     = "admin"
+	SubsystemScheduler = "scheduler"
+)
+
+// Keys of the attributes which are attached to log records so that they can be filtered by greenhouse and device
+const (
+	KeySubsystem     = "subsystem"
+	KeyThingName     = "thing"
+	KeyPeerID        = "peer"
+	KeyIdentity      = "identity"
+	KeyRoomID        = "room"
+	KeyPlantID       = "plant"
+	KeySensorID      = "sensor"
+	KeyDevice        = "device"
+	KeyDriver        = "driver"
+	KeyPath          = "path"
+	KeyKind          = "kind"
+	KeyTopic         = "topic"
+	KeyShadow        = "shadow"
+	KeyCorrelationID = "correlationId"
+	KeySchedule      = "schedule"
+	KeyAddress       = "addr"
+	KeyError         = "err"
+)
+
+// ParseFormat parses a log format (text or json) from a string.
+func ParseFormat(format string) (Format, error) {
+	switch Format(format) {
+	case FormatText, FormatJSON:
+		return Format(format), nil
+
+	default:
+		return "", ErrUnknownFormat
+	}
+}
+
+// ParseLevel parses a log level (debug, info, warn or error) from a string.
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+
+	case "info":
+		return slog.LevelInfo, nil
+
+	case "warn":
+		return slog.LevelWarn, nil
+
+	case "error":
+		return slog.LevelError, nil
+
+	default:
+		return 0, ErrUnknownLevel
+	}
+}
+
+// NewLogger creates a logger which writes records with at least the given level to w.
+func NewLogger(w io.Writer, format Format, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level: level,
+	}
+
+	if format == FormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// NewDiscardLogger creates a logger which drops all records, i.e. for tests.
+func NewDiscardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{
+		Level: slog.LevelError + 1,
+	}))
+}
+
+// WithSubsystem returns a logger which attaches the subsystem to all records.
+func WithSubsystem(logger *slog.Logger, subsystem string) *slog.Logger {
+	return logger.With(KeySubsystem, subsystem)
+}
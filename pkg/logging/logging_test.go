@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+// TestParseLevel checks that only known levels can be selected.
+func TestParseLevel(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != slog.LevelWarn {
+		t.Fatalf("expected level %v, got %v and error %v", slog.LevelWarn, level, err)
+	}
+
+	if _, err := ParseLevel("verbose"); !errors.Is(err, ErrUnknownLevel) {
+		t.Fatalf("expected error %v, got %v", ErrUnknownLevel, err)
+	}
+}
+
+// TestNewLogger checks that JSON records contain the subsystem and contextual attributes and that records below the level are dropped.
+func TestNewLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+
+	logger := WithSubsystem(NewLogger(out, FormatJSON, slog.LevelInfo), SubsystemHubWorker).With(KeyRoomID, "1")
+
+	logger.Debug("Dropped")
+	logger.Info("Measured")
+
+	record := map[string]any{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q: %v", out.String(), err)
+	}
+
+	for key, expected := range map[string]string{
+		"msg":        "Measured",
+		KeySubsystem: SubsystemHubWorker,
+		KeyRoomID:    "1",
+	} {
+		if actual := record[key]; actual != expected {
+			t.Fatalf("expected %v to be %v, got %v", key, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "green_guardian"
+
+	subsystemGateway = "gateway"
+	subsystemHub     = "hub"
+)
+
+var (
+	// ConnectedHubs is the amount of hubs which are currently connected to the gateway
+	ConnectedHubs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystemGateway,
+		Name:      "connected_hubs",
+		Help:      "Amount of hubs which are currently connected to the gateway.",
+	})
+
+	// PublishedMessages is the amount of messages which have been published to the broker by topic type
+	PublishedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystemGateway,
+		Name:      "mqtt_messages_published_total",
+		Help:      "Amount of messages which have been published to the broker by topic type.",
+	}, []string{"type"})
+
+	// FailedMessages is the amount of messages which could not be published to the broker by topic type
+	FailedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystemGateway,
+		Name:      "mqtt_messages_failed_total",
+		Help:      "Amount of messages which could not be published to the broker by topic type, including ones which have been buffered.",
+	}, []string{"type"})
+
+	// CommandDuration is the round-trip latency of commands sent to hubs by command and result
+	CommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystemGateway,
+		Name:      "command_duration_seconds",
+		Help:      "Round-trip latency of commands sent to hubs by command and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command", "result"})
+
+	// SensorReadDuration is the latency of reading a sensor by sensor ID
+	SensorReadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystemHub,
+		Name:      "sensor_read_duration_seconds",
+		Help:      "Latency of reading a sensor by sensor ID, including failed reads.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"sensor"})
+
+	// SensorReadTimeouts is the amount of sensor reads which have timed out by sensor ID
+	SensorReadTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystemHub,
+		Name:      "sensor_read_timeouts_total",
+		Help:      "Amount of sensor reads which have timed out by sensor ID.",
+	}, []string{"sensor"})
+
+	// SensorMissedDeadlines is the amount of measurements which have been skipped since a sensor was still busy when they were due by sensor ID
+	SensorMissedDeadlines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystemHub,
+		Name:      "sensor_missed_deadlines_total",
+		Help:      "Amount of measurements which have been skipped since a sensor was still busy when they were due by sensor ID.",
+	}, []string{"sensor"})
+
+	// ActuatorShutOffFailures is the amount of failed attempts to turn off an actuator once its runtime has elapsed by actuator ID
+	ActuatorShutOffFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystemHub,
+		Name:      "actuator_shut_off_failures_total",
+		Help:      "Amount of failed attempts to turn off an actuator once its runtime has elapsed by actuator ID.",
+	}, []string{"actuator"})
+
+	// Temperature is the latest temperature measured in a room
+	Temperature = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystemHub,
+		Name:      "temperature",
+		Help:      "Latest temperature measured in a room in the given unit.",
+	}, []string{"room", "unit"})
+
+	// Moisture is the latest moisture measured for a plant
+	Moisture = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystemHub,
+		Name:      "moisture_percent",
+		Help:      "Latest moisture measured for a plant in %RH.",
+	}, []string{"plant"})
+)
+
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+// GetResult returns the result label for an operation which returned err.
+func GetResult(err error) string {
+	if err != nil {
+		return ResultError
+	}
+
+	return ResultSuccess
+}
+
+// GetTopicType returns the type of a topic, i.e. temperature for /gateways/thing/rooms/1/temperature, so that
+// metrics don't have a label value for every room and plant.
+func GetTopicType(topic string) string {
+	return path.Base(topic)
+}
+
+// RegisterGateway registers the gateway's metrics so that they are exposed by Handler.
+func RegisterGateway() {
+	prometheus.MustRegister(
+		ConnectedHubs,
+		PublishedMessages,
+		FailedMessages,
+		CommandDuration,
+	)
+}
+
+// RegisterHub registers the hub's metrics so that they are exposed by Handler.
+func RegisterHub() {
+	prometheus.MustRegister(
+		SensorReadDuration,
+		SensorReadTimeouts,
+		SensorMissedDeadlines,
+		ActuatorShutOffFailures,
+		Temperature,
+		Moisture,
+	)
+}
+
+// Handler returns a handler which exposes all registered metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,70 @@
+package probes
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+// Check returns an error if a dependency is not available.
+type Check func() error
+
+// CheckResult is the result of a single check.
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Result is the response of a probe; its status is ok if all of its checks are ok.
+type Result struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Run runs all checks.
+func Run(checks map[string]Check) Result {
+	result := Result{
+		Status: StatusOK,
+		Checks: map[string]CheckResult{},
+	}
+
+	for name, check := range checks {
+		if err := check(); err != nil {
+			result.Status = StatusFailing
+			result.Checks[name] = CheckResult{
+				Status: StatusFailing,
+				Error:  err.Error(),
+			}
+
+			continue
+		}
+
+		result.Checks[name] = CheckResult{
+			Status: StatusOK,
+		}
+	}
+
+	return result
+}
+
+// Handler returns a handler which runs all checks on every request and responds with the result as JSON,
+// using status code 200 if all checks are ok and 503 otherwise.
+func Handler(checks map[string]Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := Run(checks)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if result.Status == StatusOK {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		_ = json.NewEncoder(w).Encode(result)
+	})
+}
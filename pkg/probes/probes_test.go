@@ -0,0 +1,77 @@
+package probes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHandler checks that the handler reports which check is failing.
+func TestHandler(t *testing.T) {
+	errDisconnected := errors.New("disconnected")
+
+	tests := []struct {
+		name           string
+		checks         map[string]Check
+		expectedCode   int
+		expectedResult Result
+	}{
+		{
+			name:           "No checks",
+			checks:         map[string]Check{},
+			expectedCode:   http.StatusOK,
+			expectedResult: Result{Status: StatusOK, Checks: map[string]CheckResult{}},
+		},
+		{
+			name: "All checks ok",
+			checks: map[string]Check{
+				"broker": func() error { return nil },
+			},
+			expectedCode: http.StatusOK,
+			expectedResult: Result{Status: StatusOK, Checks: map[string]CheckResult{
+				"broker": {Status: StatusOK},
+			}},
+		},
+		{
+			name: "One check failing",
+			checks: map[string]Check{
+				"broker":        func() error { return errDisconnected },
+				"subscriptions": func() error { return nil },
+			},
+			expectedCode: http.StatusServiceUnavailable,
+			expectedResult: Result{Status: StatusFailing, Checks: map[string]CheckResult{
+				"broker":        {Status: StatusFailing, Error: errDisconnected.Error()},
+				"subscriptions": {Status: StatusOK},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			Handler(tt.checks).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rec.Code != tt.expectedCode {
+				t.Fatalf("expected status code %v, got %v", tt.expectedCode, rec.Code)
+			}
+
+			var result Result
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Fatalf("unexpected error during Unmarshal: %v", err)
+			}
+
+			if result.Status != tt.expectedResult.Status || len(result.Checks) != len(tt.expectedResult.Checks) {
+				t.Fatalf("expected result %v, got %v", tt.expectedResult, result)
+			}
+
+			for name, expected := range tt.expectedResult.Checks {
+				if actual := result.Checks[name]; actual != expected {
+					t.Fatalf("expected check %v to be %v, got %v", name, expected, actual)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	entrySuffix   = ".json"
+	tmpSuffix     = ".tmp"
+	invalidSuffix = ".invalid"
+)
+
+var (
+	ErrQueueEmpty = errors.New("queue is empty")
+)
+
+// Entry is a single message that is waiting to be delivered.
+type Entry struct {
+	Topic     string    `json:"topic"`
+	QoS       byte      `json:"qos"`
+	Retained  bool      `json:"retained"`
+	Payload   []byte    `json:"payload"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Queue is a durable FIFO queue which stores each entry as a file in a directory.
+// It is used to buffer messages while their destination is unreachable.
+type Queue struct {
+	dir string
+
+	maxSize int
+	maxAge  time.Duration
+
+	lock sync.Mutex
+
+	sequence int64
+
+	// File names of the entries in the directory, oldest first, so that it only has to be listed when the queue is opened
+	names []string
+}
+
+// NewQueue creates a new queue in the given directory.
+// If maxSize or maxAge are >0, the oldest entries are dropped once they are exceeded.
+func NewQueue(
+	dir string,
+
+	maxSize int,
+	maxAge time.Duration,
+) *Queue {
+	return &Queue{
+		dir: dir,
+
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+}
+
+// OpenQueue creates the queue's directory and drops expired entries and partial writes left over from previous runs.
+func OpenQueue(queue *Queue) error {
+	if err := os.MkdirAll(queue.dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	names, err := queue.list()
+	if err != nil {
+		return err
+	}
+
+	queue.names = names
+
+	// Continue the sequence after the newest persisted entry so that ordering is kept across restarts
+	if len(names) > 0 {
+		if _, err := fmt.Sscanf(names[len(names)-1], "%d"+entrySuffix, &queue.sequence); err != nil {
+			return err
+		}
+	}
+
+	return queue.trim()
+}
+
+// Push appends an entry to the end of the queue.
+func (q *Queue) Push(entry Entry) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	msg, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Use a monotonic sequence number as the file name so that the directory listing is in insertion order
+	q.sequence++
+	if now := time.Now().UnixNano(); now > q.sequence {
+		q.sequence = now
+	}
+
+	name := fmt.Sprintf("%020d"+entrySuffix, q.sequence)
+	file := filepath.Join(q.dir, name)
+
+	// Write to a temporary file first so that a crash never leaves a partial entry behind
+	if err := os.WriteFile(file+tmpSuffix, msg, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file+tmpSuffix, file); err != nil {
+		return err
+	}
+
+	q.names = append(q.names, name)
+
+	return q.trim()
+}
+
+// Len returns the amount of entries in the queue.
+func (q *Queue) Len() (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.names), nil
+}
+
+// Replay calls handle for each entry in the queue, starting with the oldest one.
+// An entry is only removed after handle returned successfully; if it fails, replaying stops and the entry is kept.
+// Entries which are pushed while replaying are handled too.
+func (q *Queue) Replay(handle func(entry Entry) error) error {
+	for {
+		name, entry, err := q.peek()
+		if err != nil {
+			if errors.Is(err, ErrQueueEmpty) {
+				return nil
+			}
+
+			return err
+		}
+
+		if err := handle(*entry); err != nil {
+			return err
+		}
+
+		if err := q.remove(name); err != nil {
+			return err
+		}
+	}
+}
+
+// remove deletes a handled entry. It might have been dropped by trim in the meantime, in which case there is nothing left to do.
+func (q *Queue) remove(name string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.names) == 0 || q.names[0] != name {
+		return nil
+	}
+
+	if err := os.Remove(filepath.Join(q.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	q.names = q.names[1:]
+
+	return nil
+}
+
+// peek returns the oldest entry which can be decoded. Entries which can't be decoded are set aside
+// so that they don't keep the entries after them from being replayed.
+func (q *Queue) peek() (string, *Entry, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.trim(); err != nil {
+		return "", nil, err
+	}
+
+	for len(q.names) > 0 {
+		name := q.names[0]
+		file := filepath.Join(q.dir, name)
+
+		msg, err := os.ReadFile(file)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				q.names = q.names[1:]
+
+				continue
+			}
+
+			return "", nil, err
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(msg, &entry); err != nil {
+			// Keep the entry's file around for inspection, but stop treating it as an entry
+			if err := os.Rename(file, file+invalidSuffix); err != nil {
+				return "", nil, err
+			}
+
+			q.names = q.names[1:]
+
+			continue
+		}
+
+		return name, &entry, nil
+	}
+
+	return "", nil, ErrQueueEmpty
+}
+
+// list returns the file names of all entries, oldest first, and removes partial writes. The caller must hold the lock.
+func (q *Queue) list() ([]string, error) {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		// A temporary file is only left behind if the process stopped before it could be renamed into an entry
+		if strings.HasSuffix(file.Name(), tmpSuffix) {
+			if err := os.Remove(filepath.Join(q.dir, file.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if !strings.HasSuffix(file.Name(), entrySuffix) {
+			continue
+		}
+
+		names = append(names, file.Name())
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// trim drops the oldest entries until both the size and the age limit are satisfied. The caller must hold the lock.
+func (q *Queue) trim() error {
+	drop := 0
+	if q.maxSize > 0 && len(q.names) > q.maxSize {
+		drop = len(q.names) - q.maxSize
+	}
+
+	if q.maxAge > 0 {
+		// Entry names are based on the time they were pushed at, so we can check their age without reading them
+		cutoff := time.Now().Add(-q.maxAge).UnixNano()
+
+		for drop < len(q.names) {
+			var sequence int64
+			if _, err := fmt.Sscanf(q.names[drop], "%d"+entrySuffix, &sequence); err != nil {
+				return err
+			}
+
+			if sequence >= cutoff {
+				break
+			}
+
+			drop++
+		}
+	}
+
+	for drop > 0 {
+		if err := os.Remove(filepath.Join(q.dir, q.names[0])); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		q.names = q.names[1:]
+		drop--
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package queue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReplayOrder checks that entries are replayed in the order they were pushed in
+// and that they are removed from the queue once they have been handled.
+func TestReplayOrder(t *testing.T) {
+	queue := NewQueue(t.TempDir(), 0, 0)
+	if err := OpenQueue(queue); err != nil {
+		t.Fatalf("unexpected error during OpenQueue: %v", err)
+	}
+
+	topics := []string{"/first", "/second", "/third"}
+	for _, topic := range topics {
+		if err := queue.Push(Entry{Topic: topic, Payload: []byte(topic), Timestamp: time.Now()}); err != nil {
+			t.Fatalf("unexpected error during Push: %v", err)
+		}
+	}
+
+	replayed := []string{}
+	if err := queue.Replay(func(entry Entry) error {
+		replayed = append(replayed, entry.Topic)
+
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error during Replay: %v", err)
+	}
+
+	if len(replayed) != len(topics) {
+		t.Fatalf("expected %v replayed entries, got %v", len(topics), len(replayed))
+	}
+
+	for i, topic := range topics {
+		if replayed[i] != topic {
+			t.Fatalf("expected entry %v to be %v, got %v", i, topic, replayed[i])
+		}
+	}
+
+	if length, err := queue.Len(); err != nil || length != 0 {
+		t.Fatalf("expected queue to be empty after replay, got length %v and error %v", length, err)
+	}
+}
+
+// TestReplayKeepsFailedEntries checks that an entry which could not be handled stays in the queue.
+func TestReplayKeepsFailedEntries(t *testing.T) {
+	queue := NewQueue(t.TempDir(), 0, 0)
+	if err := OpenQueue(queue); err != nil {
+		t.Fatalf("unexpected error during OpenQueue: %v", err)
+	}
+
+	if err := queue.Push(Entry{Topic: "/first"}); err != nil {
+		t.Fatalf("unexpected error during Push: %v", err)
+	}
+
+	errDisconnected := errors.New("disconnected")
+	if err := queue.Replay(func(entry Entry) error {
+		return errDisconnected
+	}); !errors.Is(err, errDisconnected) {
+		t.Fatalf("expected error %v during Replay, got %v", errDisconnected, err)
+	}
+
+	if length, err := queue.Len(); err != nil || length != 1 {
+		t.Fatalf("expected failed entry to be kept, got length %v and error %v", length, err)
+	}
+}
+
+// TestMaxSize checks that the oldest entries are dropped once the queue is full.
+func TestMaxSize(t *testing.T) {
+	dir := t.TempDir()
+
+	queue := NewQueue(dir, 2, 0)
+	if err := OpenQueue(queue); err != nil {
+		t.Fatalf("unexpected error during OpenQueue: %v", err)
+	}
+
+	for _, topic := range []string{"/first", "/second", "/third"} {
+		if err := queue.Push(Entry{Topic: topic}); err != nil {
+			t.Fatalf("unexpected error during Push: %v", err)
+		}
+	}
+
+	// Re-open the queue to check that entries are persisted across restarts
+	queue = NewQueue(dir, 2, 0)
+	if err := OpenQueue(queue); err != nil {
+		t.Fatalf("unexpected error during OpenQueue: %v", err)
+	}
+
+	replayed := []string{}
+	if err := queue.Replay(func(entry Entry) error {
+		replayed = append(replayed, entry.Topic)
+
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error during Replay: %v", err)
+	}
+
+	if len(replayed) != 2 || replayed[0] != "/second" || replayed[1] != "/third" {
+		t.Fatalf("expected the two newest entries to be kept, got %v", replayed)
+	}
+}
+
+// TestReplaySkipsInvalidEntries checks that an entry which can't be decoded is set aside
+// instead of keeping the entries after it from being replayed.
+func TestReplaySkipsInvalidEntries(t *testing.T) {
+	dir := t.TempDir()
+
+	queue := NewQueue(dir, 0, 0)
+	if err := OpenQueue(queue); err != nil {
+		t.Fatalf("unexpected error during OpenQueue: %v", err)
+	}
+
+	for _, topic := range []string{"/first", "/second"} {
+		if err := queue.Push(Entry{Topic: topic}); err != nil {
+			t.Fatalf("unexpected error during Push: %v", err)
+		}
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+entrySuffix))
+	if err != nil {
+		t.Fatalf("unexpected error during Glob: %v", err)
+	}
+
+	if err := os.WriteFile(names[0], []byte("{"), 0600); err != nil {
+		t.Fatalf("unexpected error during WriteFile: %v", err)
+	}
+
+	// Partial writes which were left behind must not be replayed either
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001"+entrySuffix+tmpSuffix), []byte("{"), 0600); err != nil {
+		t.Fatalf("unexpected error during WriteFile: %v", err)
+	}
+
+	queue = NewQueue(dir, 0, 0)
+	if err := OpenQueue(queue); err != nil {
+		t.Fatalf("unexpected error during OpenQueue: %v", err)
+	}
+
+	replayed := []string{}
+	if err := queue.Replay(func(entry Entry) error {
+		replayed = append(replayed, entry.Topic)
+
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error during Replay: %v", err)
+	}
+
+	if len(replayed) != 1 || replayed[0] != "/second" {
+		t.Fatalf("expected only the valid entry to be replayed, got %v", replayed)
+	}
+
+	if length, err := queue.Len(); err != nil || length != 0 {
+		t.Fatalf("expected queue to be empty after replay, got length %v and error %v", length, err)
+	}
+
+	if _, err := os.Stat(names[0] + invalidSuffix); err != nil {
+		t.Fatalf("expected invalid entry to be kept for inspection, got error %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"sort"
+	"time"
+
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+)
+
+// HubInfo describes a hub which is connected to the gateway
+type HubInfo struct {
+	PeerID   string   `json:"peerId"`
+	Identity string   `json:"identity,omitempty"`
+	Rooms    []string `json:"rooms"`
+	Plants   []string `json:"plants"`
+}
+
+// RegistrationsInfo lists the IDs of the hubs which have registered the fan of each room and the sprinkler of each plant,
+// in the order they registered them in
+type RegistrationsInfo struct {
+	Fans       map[string][]string `json:"fans"`
+	Sprinklers map[string][]string `json:"sprinklers"`
+}
+
+// MeasurementsInfo lists the last measurement the gateway has received for each room and plant
+type MeasurementsInfo struct {
+	Temperatures map[string]mqttapi.TemperatureMeasurement `json:"temperatures"`
+	Moistures    map[string]mqttapi.MoistureMeasurement    `json:"moistures"`
+}
+
+type AdminRemote struct {
+	ListHubs         func(ctx context.Context) ([]HubInfo, error)
+	GetRegistrations func(ctx context.Context) (RegistrationsInfo, error)
+	GetMeasurements  func(ctx context.Context) (MeasurementsInfo, error)
+
+	SetFanOn       func(ctx context.Context, roomID string, on bool, runtime time.Duration) error
+	SetSprinklerOn func(ctx context.Context, plantID string, on bool, runtime time.Duration) error
+}
+
+// Admin lets operators inspect and control a running gateway, i.e. using green-guardian-ctl
+type Admin struct {
+	logger *slog.Logger
+
+	gateway *Gateway
+}
+
+func NewAdmin(logger *slog.Logger, gateway *Gateway) *Admin {
+	return &Admin{
+		logger: logging.WithSubsystem(logger, logging.SubsystemAdmin),
+
+		gateway: gateway,
+	}
+}
+
+// ListHubs returns the hubs which are connected to the gateway and the rooms and plants they have registered.
+func (w *Admin) ListHubs(ctx context.Context) ([]HubInfo, error) {
+	w.logger.Debug("ListHubs")
+
+	w.gateway.hubsLock.Lock()
+	identities := maps.Clone(w.gateway.hubs)
+	w.gateway.hubsLock.Unlock()
+
+	hubs := []HubInfo{}
+	for peerID, identity := range identities {
+		roomIDs, plantIDs := w.gateway.getRegistrations(peerID)
+
+		hubs = append(hubs, HubInfo{
+			PeerID:   peerID,
+			Identity: identity,
+			Rooms:    roomIDs,
+			Plants:   plantIDs,
+		})
+	}
+
+	sort.Slice(hubs, func(i, j int) bool {
+		return hubs[i].PeerID < hubs[j].PeerID
+	})
+
+	return hubs, nil
+}
+
+// GetRegistrations returns the hubs which have registered each fan and sprinkler.
+func (w *Admin) GetRegistrations(ctx context.Context) (RegistrationsInfo, error) {
+	w.logger.Debug("GetRegistrations")
+
+	return RegistrationsInfo{
+		Fans:       w.gateway.fans.getAll(),
+		Sprinklers: w.gateway.sprinklers.getAll(),
+	}, nil
+}
+
+// GetMeasurements returns the last measurement of each room and plant.
+func (w *Admin) GetMeasurements(ctx context.Context) (MeasurementsInfo, error) {
+	w.logger.Debug("GetMeasurements")
+
+	w.gateway.measurementsLock.Lock()
+	defer w.gateway.measurementsLock.Unlock()
+
+	return MeasurementsInfo{
+		Temperatures: maps.Clone(w.gateway.temperatures),
+		Moistures:    maps.Clone(w.gateway.moistures),
+	}, nil
+}
+
+// SetFanOn turns the fan of a room on or off using the hubs it is registered to, just like a command from the cloud.
+// If runtime is set, the hub turns the fan off again once it has elapsed.
+func (w *Admin) SetFanOn(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+	w.logger.Info("Switching fan on operator request", logging.KeyRoomID, roomID, "on", on, "runtime", runtime)
+
+	return w.gateway.setFanOn(ctx, roomID, on, runtime)
+}
+
+// SetSprinklerOn turns the sprinkler of a plant on or off using the hubs it is registered to, just like a command from the cloud.
+// If runtime is set, the hub turns the sprinkler off again once it has elapsed.
+func (w *Admin) SetSprinklerOn(ctx context.Context, plantID string, on bool, runtime time.Duration) error {
+	w.logger.Info("Switching sprinkler on operator request", logging.KeyPlantID, plantID, "on", on, "runtime", runtime)
+
+	return w.gateway.setSprinklerOn(ctx, plantID, on, runtime)
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+)
+
+// TestAdmin checks that operators can inspect the connected hubs, their registrations and the last measurements,
+// and that they can switch fans using the hub which registered them.
+func TestAdmin(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockClient(ctrl)
+	mockToken := NewMockToken(ctrl)
+
+	mockToken.EXPECT().Wait().Return(true).AnyTimes()
+	mockToken.EXPECT().Error().Return(nil).AnyTimes()
+
+	mockBroker.EXPECT().IsConnectionOpen().Return(true).AnyTimes()
+	mockBroker.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(mockToken).AnyTimes()
+
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: mockBroker})
+
+	commands := []bool{}
+	gateway.Peers = func() map[string]HubRemote {
+		return map[string]HubRemote{
+			"testremote": {
+				SetFanOn: func(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+					commands = append(commands, on)
+
+					return nil
+				},
+			},
+		}
+	}
+
+	admin := NewAdmin(logging.NewDiscardLogger(), gateway)
+
+	if err := ConnectHub(gateway, "testremote", "greenhouse-1"); err != nil {
+		t.Fatalf("unexpected error during ConnectHub: %v", err)
+	}
+
+	if err := gateway.RegisterFans(ctx, []string{"Room1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterFans: %v", err)
+	}
+
+	if err := gateway.ForwardTemperatureMeasurement(ctx, "Room1", mqttapi.TemperatureMeasurement{Value: 24, Timestamp: 1}); err != nil {
+		t.Fatalf("unexpected error during ForwardTemperatureMeasurement: %v", err)
+	}
+
+	hubs, err := admin.ListHubs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error during ListHubs: %v", err)
+	}
+
+	if len(hubs) != 1 || hubs[0].PeerID != "testremote" || hubs[0].Identity != "greenhouse-1" || len(hubs[0].Rooms) != 1 || hubs[0].Rooms[0] != "Room1" {
+		t.Fatalf("expected hub testremote with identity greenhouse-1 and room Room1, got %v", hubs)
+	}
+
+	registrations, err := admin.GetRegistrations(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error during GetRegistrations: %v", err)
+	}
+
+	if peers := registrations.Fans["Room1"]; len(peers) != 1 || peers[0] != "testremote" {
+		t.Fatalf("expected fan of Room1 to be registered by testremote, got %v", peers)
+	}
+
+	measurements, err := admin.GetMeasurements(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error during GetMeasurements: %v", err)
+	}
+
+	if measurement, ok := measurements.Temperatures["Room1"]; !ok || measurement.Value != 24 {
+		t.Fatalf("expected last temperature of Room1 to be 24, got %v", measurements.Temperatures)
+	}
+
+	if err := admin.SetFanOn(ctx, "Room1", true, 0); err != nil {
+		t.Fatalf("unexpected error during SetFanOn: %v", err)
+	}
+
+	if len(commands) != 1 || !commands[0] {
+		t.Fatalf("expected fan to be turned on, got commands %v", commands)
+	}
+
+	if err := admin.SetFanOn(ctx, "Room2", true, 0); err != ErrNoSuchRoom {
+		t.Fatalf("expected error %v for unknown room, got %v", ErrNoSuchRoom, err)
+	}
+}
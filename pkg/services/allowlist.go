@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+)
+
+var (
+	ErrNotAllowed = errors.New("hub is not allowed to use")
+)
+
+// AllowedIDs are patterns (see path.Match) of the IDs of the rooms and plants a hub may register and report on
+type AllowedIDs struct {
+	Rooms  []string
+	Plants []string
+}
+
+// Allowlist maps the identities of hubs to the rooms and plants they may use; if it is nil, all hubs may use all rooms and plants
+type Allowlist map[string]AllowedIDs
+
+// matchesAny returns whether an ID matches one of the patterns
+func matchesAny(patterns []string, id string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, id); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getIdentity returns the identity of a connected hub, or an empty string if it didn't authenticate
+func (w *Gateway) getIdentity(peerID string) string {
+	w.hubsLock.Lock()
+	defer w.hubsLock.Unlock()
+
+	return w.hubs[peerID]
+}
+
+// authorize checks whether the hub which called an RPC may use all of the rooms or plants
+func (w *Gateway) authorize(ctx context.Context, kind string, ids []string, getPatterns func(allowed AllowedIDs) []string) error {
+	if w.allowlist == nil {
+		return nil
+	}
+
+	identity := w.getIdentity(rpc.GetRemoteID(ctx))
+	allowed, ok := w.allowlist[identity]
+
+	denied := []string{}
+	for _, id := range ids {
+		if !ok || !matchesAny(getPatterns(allowed), id) {
+			denied = append(denied, id)
+		}
+	}
+
+	if len(denied) > 0 {
+		withPeerID(w.rpcLogger, ctx).Warn("Denied hub access", logging.KeyIdentity, identity, logging.KeyKind, kind, "ids", denied)
+
+		// The hub drops queued calls which are rejected, since they would fail again if they were retried
+		return fmt.Errorf("%w: %w %v %v", ErrRejected, ErrNotAllowed, kind, denied)
+	}
+
+	return nil
+}
+
+// authorizeRooms checks whether the hub which called an RPC may use all of the rooms
+func (w *Gateway) authorizeRooms(ctx context.Context, roomIDs ...string) error {
+	return w.authorize(ctx, "rooms", roomIDs, func(allowed AllowedIDs) []string {
+		return allowed.Rooms
+	})
+}
+
+// authorizePlants checks whether the hub which called an RPC may use all of the plants
+func (w *Gateway) authorizePlants(ctx context.Context, plantIDs ...string) error {
+	return w.authorize(ctx, "plants", plantIDs, func(allowed AllowedIDs) []string {
+		return allowed.Plants
+	})
+}
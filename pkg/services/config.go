@@ -0,0 +1,567 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"reflect"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+)
+
+var (
+	ErrInvalidConfig = errors.New("intervals, timeouts and moistures must not be negative")
+)
+
+// getConfigInterval returns the first of the given intervals in milliseconds which is set, or 0 if none is
+func getConfigInterval(intervals ...int64) time.Duration {
+	for _, interval := range intervals {
+		if interval > 0 {
+			return time.Duration(interval) * time.Millisecond
+		}
+	}
+
+	return 0
+}
+
+// getConfigValue returns the first of the given values which is set, or nil if none is
+func getConfigValue(values ...*float64) *float64 {
+	for _, value := range values {
+		if value != nil {
+			return value
+		}
+	}
+
+	return nil
+}
+
+// applyRoomConfig returns a room with the values which the gateway has set for it; the topology lock has to be held
+func (w *Hub) applyRoomConfig(roomID string, room Room) Room {
+	config := w.roomConfigs[roomID]
+
+	if interval := getConfigInterval(config.MeasureInterval, w.hubConfig.MeasureInterval); interval > 0 {
+		room.MeasureInterval = interval
+	}
+
+	if value := getConfigValue(config.DefaultTemperature, w.hubConfig.DefaultTemperature); value != nil {
+		room.DefaultTemperature = *value
+	}
+
+	return room
+}
+
+// applyPlantConfig returns a plant with the values which the gateway has set for it; the topology lock has to be held
+func (w *Hub) applyPlantConfig(plantID string, plant Plant) Plant {
+	config := w.plantConfigs[plantID]
+
+	if interval := getConfigInterval(config.MeasureInterval, w.hubConfig.MeasureInterval); interval > 0 {
+		plant.MeasureInterval = interval
+	}
+
+	if value := getConfigValue(config.DefaultMoisture, w.hubConfig.DefaultMoisture); value != nil {
+		plant.DefaultMoisture = *value
+	}
+
+	return plant
+}
+
+// resolveMeasureInterval returns the interval of sensors which don't set one; the topology lock has to be held
+func (w *Hub) resolveMeasureInterval() time.Duration {
+	if interval := getConfigInterval(w.hubConfig.MeasureInterval); interval > 0 {
+		return interval
+	}
+
+	return w.measureInterval
+}
+
+// getMeasureInterval returns the interval of sensors which don't set one
+func (w *Hub) getMeasureInterval() time.Duration {
+	w.topologyLock.RLock()
+	defer w.topologyLock.RUnlock()
+
+	return w.resolveMeasureInterval()
+}
+
+// getMeasureTimeout returns the amount of time after which a measurement is assumed to have failed
+func (w *Hub) getMeasureTimeout() time.Duration {
+	w.topologyLock.RLock()
+	defer w.topologyLock.RUnlock()
+
+	if timeout := getConfigInterval(w.hubConfig.MeasureTimeout); timeout > 0 {
+		return timeout
+	}
+
+	return w.measureTimeout
+}
+
+// getMeasureIntervals returns the intervals of all sensors by the IDs of their rooms and plants; the topology lock has to be held
+func (w *Hub) getMeasureIntervals() (map[string]time.Duration, map[string]time.Duration) {
+	roomIntervals := map[string]time.Duration{}
+	for roomID, room := range w.rooms {
+		if room.TemperatureSensor != nil {
+			roomIntervals[roomID] = w.applyRoomConfig(roomID, room).MeasureInterval
+		}
+	}
+
+	plantIntervals := map[string]time.Duration{}
+	for plantID, plant := range w.plants {
+		if plant.MoistureSensor != nil {
+			plantIntervals[plantID] = w.applyPlantConfig(plantID, plant).MeasureInterval
+		}
+	}
+
+	return roomIntervals, plantIntervals
+}
+
+// getRoomConfigState returns the configuration a room uses; the topology lock has to be held
+func (w *Hub) getRoomConfigState(roomID string) mqttapi.RoomConfigState {
+	room := w.applyRoomConfig(roomID, w.rooms[roomID])
+
+	interval := room.MeasureInterval
+	if interval <= 0 {
+		interval = w.resolveMeasureInterval()
+	}
+
+	return mqttapi.RoomConfigState{
+		MeasureInterval:    interval.Milliseconds(),
+		DefaultTemperature: room.DefaultTemperature,
+		Timestamp:          time.Now().UnixMilli(),
+	}
+}
+
+// getPlantConfigState returns the configuration a plant uses; the topology lock has to be held
+func (w *Hub) getPlantConfigState(plantID string) mqttapi.PlantConfigState {
+	plant := w.applyPlantConfig(plantID, w.plants[plantID])
+
+	interval := plant.MeasureInterval
+	if interval <= 0 {
+		interval = w.resolveMeasureInterval()
+	}
+
+	return mqttapi.PlantConfigState{
+		MeasureInterval: interval.Milliseconds(),
+		DefaultMoisture: plant.DefaultMoisture,
+		Timestamp:       time.Now().UnixMilli(),
+	}
+}
+
+// getConfigState returns the configuration the hub and all of its rooms and plants use; the topology lock has to be held
+func (w *Hub) getConfigState() mqttapi.HubConfigState {
+	timeout := w.measureTimeout
+	if configTimeout := getConfigInterval(w.hubConfig.MeasureTimeout); configTimeout > 0 {
+		timeout = configTimeout
+	}
+
+	state := mqttapi.HubConfigState{
+		MeasureInterval: w.resolveMeasureInterval().Milliseconds(),
+		MeasureTimeout:  timeout.Milliseconds(),
+		Rooms:           map[string]mqttapi.RoomConfigState{},
+		Plants:          map[string]mqttapi.PlantConfigState{},
+		Timestamp:       time.Now().UnixMilli(),
+	}
+
+	for roomID := range w.rooms {
+		state.Rooms[w.getGatewayID(roomID)] = w.getRoomConfigState(roomID)
+	}
+
+	for plantID := range w.plants {
+		state.Plants[w.getGatewayID(plantID)] = w.getPlantConfigState(plantID)
+	}
+
+	return state
+}
+
+// restartWorker restarts a worker if it is running
+func (w *Hub) restartWorker(key string, start func()) {
+	w.workersLock.Lock()
+	_, ok := w.workers[key]
+	w.workersLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	w.stopWorker(key)
+
+	start()
+}
+
+// updateConfig changes the configs which the gateway has set and restarts the workers of sensors whose interval has changed
+// so that they don't keep waiting for the previous one
+func (w *Hub) updateConfig(update func()) {
+	w.reloadLock.Lock()
+	defer w.reloadLock.Unlock()
+
+	w.topologyLock.Lock()
+	prevRoomIntervals, prevPlantIntervals := w.getMeasureIntervals()
+
+	update()
+
+	roomIntervals, plantIntervals := w.getMeasureIntervals()
+	rooms, plants := w.rooms, w.plants
+	w.topologyLock.Unlock()
+
+	// In mock mode, measurements are taken whenever a button is pressed
+	if w.mock > 0 {
+		return
+	}
+
+	for roomID, interval := range roomIntervals {
+		if interval != prevRoomIntervals[roomID] {
+			w.restartWorker(path.Join("rooms", roomID, "temperature"), func() {
+				w.startTemperatureWorker(roomID, rooms[roomID])
+			})
+		}
+	}
+
+	for plantID, interval := range plantIntervals {
+		if interval != prevPlantIntervals[plantID] {
+			w.restartWorker(path.Join("plants", plantID, "moisture"), func() {
+				w.startMoistureWorker(plantID, plants[plantID])
+			})
+		}
+	}
+}
+
+// SetHubConfig replaces the values which the gateway has set for all rooms and plants and returns the configuration the hub uses.
+func (w *Hub) SetHubConfig(ctx context.Context, config mqttapi.HubConfig) (mqttapi.HubConfigState, error) {
+	withPeerID(w.rpcLogger, ctx).Debug("SetHubConfig", "config", config)
+
+	if config.MeasureInterval < 0 || config.MeasureTimeout < 0 || (config.DefaultMoisture != nil && *config.DefaultMoisture < 0) {
+		return mqttapi.HubConfigState{}, ErrInvalidConfig
+	}
+
+	w.updateConfig(func() {
+		w.hubConfig = config
+	})
+
+	w.topologyLock.RLock()
+	defer w.topologyLock.RUnlock()
+
+	return w.getConfigState(), nil
+}
+
+// SetRoomConfig replaces the values which the gateway has set for a room and returns the configuration the room uses.
+// If the hub doesn't manage the room, nil is returned; the values are kept in case the room is added later on.
+func (w *Hub) SetRoomConfig(ctx context.Context, roomID string, config mqttapi.RoomConfig) (*mqttapi.RoomConfigState, error) {
+	withPeerID(w.rpcLogger, ctx).Debug("SetRoomConfig", logging.KeyRoomID, roomID, "config", config)
+
+	if config.MeasureInterval < 0 {
+		return nil, ErrInvalidConfig
+	}
+
+	// Rooms of other namespaces are managed by other hubs
+	localRoomID, ok := w.getLocalID(roomID)
+	if !ok {
+		return nil, nil
+	}
+
+	w.updateConfig(func() {
+		if config == (mqttapi.RoomConfig{}) {
+			delete(w.roomConfigs, localRoomID)
+		} else {
+			w.roomConfigs[localRoomID] = config
+		}
+	})
+
+	w.topologyLock.RLock()
+	defer w.topologyLock.RUnlock()
+
+	if _, ok := w.rooms[localRoomID]; !ok {
+		return nil, nil
+	}
+
+	state := w.getRoomConfigState(localRoomID)
+
+	return &state, nil
+}
+
+// SetPlantConfig replaces the values which the gateway has set for a plant and returns the configuration the plant uses.
+// If the hub doesn't manage the plant, nil is returned; the values are kept in case the plant is added later on.
+func (w *Hub) SetPlantConfig(ctx context.Context, plantID string, config mqttapi.PlantConfig) (*mqttapi.PlantConfigState, error) {
+	withPeerID(w.rpcLogger, ctx).Debug("SetPlantConfig", logging.KeyPlantID, plantID, "config", config)
+
+	if config.MeasureInterval < 0 || (config.DefaultMoisture != nil && *config.DefaultMoisture < 0) {
+		return nil, ErrInvalidConfig
+	}
+
+	// Plants of other namespaces are managed by other hubs
+	localPlantID, ok := w.getLocalID(plantID)
+	if !ok {
+		return nil, nil
+	}
+
+	w.updateConfig(func() {
+		if config == (mqttapi.PlantConfig{}) {
+			delete(w.plantConfigs, localPlantID)
+		} else {
+			w.plantConfigs[localPlantID] = config
+		}
+	})
+
+	w.topologyLock.RLock()
+	defer w.topologyLock.RUnlock()
+
+	if _, ok := w.plants[localPlantID]; !ok {
+		return nil, nil
+	}
+
+	state := w.getPlantConfigState(localPlantID)
+
+	return &state, nil
+}
+
+// publishHubConfigState publishes the configuration a hub and its rooms and plants use
+func (w *Gateway) publishHubConfigState(peerID string, state mqttapi.HubConfigState) error {
+	if err := w.publishRetained(w.getHubConfigTopic(peerID), state); err != nil {
+		return err
+	}
+
+	for roomID, roomState := range state.Rooms {
+		if err := w.publishRetained(path.Join("/gateways", w.thingName, "rooms", roomID, "config", "state"), roomState); err != nil {
+			return err
+		}
+	}
+
+	for plantID, plantState := range state.Plants {
+		if err := w.publishRetained(path.Join("/gateways", w.thingName, "plants", plantID, "config", "state"), plantState); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pushHubConfig sends the config for all rooms and plants to hubs and publishes the configuration they use
+func (w *Gateway) pushHubConfig(ctx context.Context, hubs map[string]HubRemote, config mqttapi.HubConfig) {
+	for peerID, hub := range hubs {
+		state, err := hub.SetHubConfig(ctx, config)
+		if err != nil {
+			w.rpcLogger.Warn("Could not apply config to hub, continuing", logging.KeyPeerID, peerID, logging.KeyError, err)
+
+			continue
+		}
+
+		if err := w.publishHubConfigState(peerID, state); err != nil {
+			w.mqttLogger.Warn("Could not publish config of hub, continuing", logging.KeyPeerID, peerID, logging.KeyError, err)
+		}
+	}
+}
+
+// pushRoomConfig sends the config of a room to hubs and publishes the configuration the room uses.
+// Hubs which don't manage the room keep the config in case it is added later on.
+func (w *Gateway) pushRoomConfig(ctx context.Context, hubs map[string]HubRemote, roomID string, config mqttapi.RoomConfig) {
+	for peerID, hub := range hubs {
+		state, err := hub.SetRoomConfig(ctx, roomID, config)
+		if err != nil {
+			w.rpcLogger.Warn("Could not apply config to room, continuing", logging.KeyPeerID, peerID, logging.KeyRoomID, roomID, logging.KeyError, err)
+
+			continue
+		}
+
+		if state == nil {
+			continue
+		}
+
+		if err := w.publishRetained(path.Join("/gateways", w.thingName, "rooms", roomID, "config", "state"), state); err != nil {
+			w.mqttLogger.Warn("Could not publish config of room, continuing", logging.KeyRoomID, roomID, logging.KeyError, err)
+		}
+	}
+}
+
+// pushPlantConfig sends the config of a plant to hubs and publishes the configuration the plant uses.
+// Hubs which don't manage the plant keep the config in case it is added later on.
+func (w *Gateway) pushPlantConfig(ctx context.Context, hubs map[string]HubRemote, plantID string, config mqttapi.PlantConfig) {
+	for peerID, hub := range hubs {
+		state, err := hub.SetPlantConfig(ctx, plantID, config)
+		if err != nil {
+			w.rpcLogger.Warn("Could not apply config to plant, continuing", logging.KeyPeerID, peerID, logging.KeyPlantID, plantID, logging.KeyError, err)
+
+			continue
+		}
+
+		if state == nil {
+			continue
+		}
+
+		if err := w.publishRetained(path.Join("/gateways", w.thingName, "plants", plantID, "config", "state"), state); err != nil {
+			w.mqttLogger.Warn("Could not publish config of plant, continuing", logging.KeyPlantID, plantID, logging.KeyError, err)
+		}
+	}
+}
+
+// getConnectedHubs returns all connected hubs; hubs which connect later on receive the configs once they have connected
+func (w *Gateway) getConnectedHubs() map[string]HubRemote {
+	// No hubs can connect if the gateway doesn't serve the RPCs
+	if w.Peers == nil {
+		return map[string]HubRemote{}
+	}
+
+	return w.Peers()
+}
+
+// hasConfigs returns whether any configs for hubs have been received from the broker
+func (w *Gateway) hasConfigs() bool {
+	w.configsLock.Lock()
+	defer w.configsLock.Unlock()
+
+	return w.hubConfig != nil || len(w.roomConfigs) > 0 || len(w.plantConfigs) > 0
+}
+
+// pushConfigs sends all configs which have been received from the broker to a hub, i.e. once it has connected
+func (w *Gateway) pushConfigs(ctx context.Context, peerID string) {
+	hub, ok := w.getConnectedHubs()[peerID]
+	if !ok {
+		return
+	}
+
+	hubs := map[string]HubRemote{peerID: hub}
+
+	w.configsLock.Lock()
+	hubConfig := w.hubConfig
+	roomConfigs := map[string]mqttapi.RoomConfig{}
+	for roomID, config := range w.roomConfigs {
+		roomConfigs[roomID] = config
+	}
+	plantConfigs := map[string]mqttapi.PlantConfig{}
+	for plantID, config := range w.plantConfigs {
+		plantConfigs[plantID] = config
+	}
+	w.configsLock.Unlock()
+
+	if hubConfig != nil {
+		w.pushHubConfig(ctx, hubs, *hubConfig)
+	}
+
+	for roomID, config := range roomConfigs {
+		w.pushRoomConfig(ctx, hubs, roomID, config)
+	}
+
+	for plantID, config := range plantConfigs {
+		w.pushPlantConfig(ctx, hubs, plantID, config)
+	}
+}
+
+// parseConfig parses a config from a retained message; clearing the retained message resets the config
+func parseConfig(payload []byte, config any) error {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(payload, config)
+}
+
+// subscribeConfigs subscribes to the configs for all hubs, rooms and plants and pushes them to the hubs whenever they change
+func (w *Gateway) subscribeConfigs(ctx context.Context) error {
+	// Subscribe to the config for all rooms and plants
+	if token := w.broker.Subscribe(
+		path.Join("/gateways", w.thingName, "config"),
+		1,
+		func(client mqtt.Client, msg mqtt.Message) {
+			config := mqttapi.HubConfig{}
+			if err := parseConfig(msg.Payload(), &config); err != nil {
+				w.mqttLogger.Warn("Could not parse config, continuing", logging.KeyTopic, msg.Topic(), logging.KeyError, err)
+
+				return
+			}
+
+			// The retained message is received again every time the gateway subscribes
+			w.configsLock.Lock()
+			unchanged := w.hubConfig != nil && reflect.DeepEqual(*w.hubConfig, config)
+			if len(msg.Payload()) == 0 {
+				w.hubConfig = nil
+			} else {
+				w.hubConfig = &config
+			}
+			w.configsLock.Unlock()
+
+			if unchanged {
+				return
+			}
+
+			w.queueCommand(func() {
+				w.pushHubConfig(ctx, w.getConnectedHubs(), config)
+			})
+		},
+	); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	// Subscribe to the configs of rooms
+	if token := w.broker.Subscribe(
+		path.Join("/gateways", w.thingName, "rooms", "+", "config"),
+		1,
+		func(client mqtt.Client, msg mqtt.Message) {
+			roomID := path.Base(path.Dir(msg.Topic()))
+
+			config := mqttapi.RoomConfig{}
+			if err := parseConfig(msg.Payload(), &config); err != nil {
+				w.mqttLogger.Warn("Could not parse config, continuing", logging.KeyTopic, msg.Topic(), logging.KeyError, err)
+
+				return
+			}
+
+			w.configsLock.Lock()
+			prev, ok := w.roomConfigs[roomID]
+			unchanged := ok && reflect.DeepEqual(prev, config)
+			if len(msg.Payload()) == 0 {
+				delete(w.roomConfigs, roomID)
+			} else {
+				w.roomConfigs[roomID] = config
+			}
+			w.configsLock.Unlock()
+
+			if unchanged {
+				return
+			}
+
+			w.queueCommand(func() {
+				w.pushRoomConfig(ctx, w.getConnectedHubs(), roomID, config)
+			})
+		},
+	); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	// Subscribe to the configs of plants
+	if token := w.broker.Subscribe(
+		path.Join("/gateways", w.thingName, "plants", "+", "config"),
+		1,
+		func(client mqtt.Client, msg mqtt.Message) {
+			plantID := path.Base(path.Dir(msg.Topic()))
+
+			config := mqttapi.PlantConfig{}
+			if err := parseConfig(msg.Payload(), &config); err != nil {
+				w.mqttLogger.Warn("Could not parse config, continuing", logging.KeyTopic, msg.Topic(), logging.KeyError, err)
+
+				return
+			}
+
+			w.configsLock.Lock()
+			prev, ok := w.plantConfigs[plantID]
+			unchanged := ok && reflect.DeepEqual(prev, config)
+			if len(msg.Payload()) == 0 {
+				delete(w.plantConfigs, plantID)
+			} else {
+				w.plantConfigs[plantID] = config
+			}
+			w.configsLock.Unlock()
+
+			if unchanged {
+				return
+			}
+
+			w.queueCommand(func() {
+				w.pushPlantConfig(ctx, w.getConnectedHubs(), plantID, config)
+			})
+		},
+	); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
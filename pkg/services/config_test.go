@@ -0,0 +1,112 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+)
+
+// TestConfigs checks that the gateway pushes room configs to the connected hubs whenever they change
+// and to hubs which connect later on, and that it publishes the configuration the rooms use.
+func TestConfigs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, brokerAddr := startBroker(t)
+
+	states := make(chan mqttapi.RoomConfigState, 10)
+	if err := broker.Subscribe("/gateways/TestThing/rooms/+/config/state", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		state := mqttapi.RoomConfigState{}
+		if err := json.Unmarshal(pk.Payload, &state); err != nil {
+			t.Errorf("unexpected error during Unmarshal: %v", err)
+
+			return
+		}
+
+		states <- state
+	}); err != nil {
+		t.Fatalf("unexpected error during Subscribe: %v", err)
+	}
+
+	pushes := make(chan string, 10)
+	hub := func(peerID string) HubRemote {
+		return HubRemote{
+			SetRoomConfig: func(ctx context.Context, roomID string, config mqttapi.RoomConfig) (*mqttapi.RoomConfigState, error) {
+				pushes <- peerID
+
+				return &mqttapi.RoomConfigState{MeasureInterval: config.MeasureInterval, DefaultTemperature: 20}, nil
+			},
+		}
+	}
+
+	connected := map[string]HubRemote{"testremote": hub("testremote")}
+	var connectedLock sync.Mutex
+
+	peers := func() map[string]HubRemote {
+		connectedLock.Lock()
+		defer connectedLock.Unlock()
+
+		return maps.Clone(connected)
+	}
+
+	gateway := connectGateway(t, ctx, brokerAddr, false, "", peers)
+
+	if err := ConnectHub(gateway, "testremote", ""); err != nil {
+		t.Fatalf("unexpected error during ConnectHub: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		connect  bool
+		payload  string
+		peerID   string
+		interval int64
+	}{
+		{"changed config", false, `{"measureInterval":10000}`, "testremote", 10000},
+		{"connected hub", true, "", "testremote2", 10000},
+		{"cleared config", false, "{}", "testremote2", 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.connect {
+				connectedLock.Lock()
+				connected = map[string]HubRemote{"testremote2": hub("testremote2")}
+				connectedLock.Unlock()
+
+				if err := ConnectHub(gateway, tt.peerID, ""); err != nil {
+					t.Fatalf("unexpected error during ConnectHub: %v", err)
+				}
+			} else {
+				if err := broker.Publish("/gateways/TestThing/rooms/Room1/config", []byte(tt.payload), true, 1); err != nil {
+					t.Fatalf("unexpected error during Publish: %v", err)
+				}
+			}
+
+			select {
+			case peerID := <-pushes:
+				if peerID != tt.peerID {
+					t.Fatalf("expected config to be pushed to %v, got %v", tt.peerID, peerID)
+				}
+
+			case <-time.After(integrationTimeout):
+				t.Fatal("timed out while waiting for config to be pushed")
+			}
+
+			select {
+			case state := <-states:
+				if state.MeasureInterval != tt.interval {
+					t.Fatalf("expected measure interval %v to be published, got %v", tt.interval, state.MeasureInterval)
+				}
+
+			case <-time.After(integrationTimeout):
+				t.Fatal("timed out while waiting for config state")
+			}
+		})
+	}
+}
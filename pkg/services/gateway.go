@@ -3,297 +3,1094 @@ package services
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"path"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pojntfx/dudirekta/pkg/rpc"
 	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+	"github.com/pojntfx/green-guardian-gateway/pkg/metrics"
+	"github.com/pojntfx/green-guardian-gateway/pkg/probes"
+	"github.com/pojntfx/green-guardian-gateway/pkg/queue"
+	"github.com/robfig/cron/v3"
 )
 
 type GatewayRemote struct {
 	RegisterFans                  func(ctx context.Context, roomIDs []string) error
 	UnregisterFans                func(ctx context.Context, roomIDs []string) error
-	ForwardTemperatureMeasurement func(ctx context.Context, roomID string, measurement, defaultValue int) error
+	ForwardTemperatureMeasurement func(ctx context.Context, roomID string, measurement mqttapi.TemperatureMeasurement) error
+	ReportTemperatureSensorHealth func(ctx context.Context, roomID string, health mqttapi.DeviceHealth) error
+	ReportFanState                func(ctx context.Context, roomID string, on bool) error
 
 	RegisterSprinklers         func(ctx context.Context, plantIDs []string) error
 	UnregisterSprinklers       func(ctx context.Context, plantIDs []string) error
-	ForwardMoistureMeasurement func(ctx context.Context, plantID string, measurement, defaultValue int) error
+	ForwardMoistureMeasurement func(ctx context.Context, plantID string, measurement mqttapi.MoistureMeasurement) error
+	ReportMoistureSensorHealth func(ctx context.Context, plantID string, health mqttapi.DeviceHealth) error
+	ReportSprinklerState       func(ctx context.Context, plantID string, on bool) error
+}
+
+type PayloadFormat string
+
+const (
+	// PayloadFormatV2 publishes versioned measurements with floating-point values, units, timestamps and sensor IDs
+	PayloadFormatV2 PayloadFormat = "v2"
+
+	// PayloadFormatLegacy publishes measurements in the original `{measurement, default}` format with integer values
+	PayloadFormatLegacy PayloadFormat = "legacy"
+)
+
+var (
+	ErrUnknownPayloadFormat = errors.New("unknown payload format")
+
+	ErrBrokerDisconnected = errors.New("not connected to broker")
+	ErrNotSubscribed      = errors.New("not subscribed to fan and sprinkler topics")
+
+	ErrInvalidCommand = errors.New("invalid command")
+	ErrCommandIgnored = errors.New("command ignored since local rules take priority")
+	ErrDeadlinePassed = errors.New("deadline of command has already passed")
+)
+
+// ParsePayloadFormat parses a payload format from a string.
+func ParsePayloadFormat(format string) (PayloadFormat, error) {
+	switch PayloadFormat(format) {
+	case PayloadFormatV2, PayloadFormatLegacy:
+		return PayloadFormat(format), nil
+
+	default:
+		return "", ErrUnknownPayloadFormat
+	}
 }
 
 type Gateway struct {
-	verbose bool
+	mqttLogger,
+	rpcLogger,
+	rulesLogger,
+	schedulerLogger *slog.Logger
 
 	errs chan error
 
 	broker    mqtt.Client
 	thingName string
 
-	fans     map[string]string
-	fansLock sync.Mutex
+	payloadFormat PayloadFormat
+
+	buffer     *queue.Queue
+	replayLock sync.Mutex
+	draining   atomic.Bool
+
+	registrationPolicy RegistrationPolicy
 
-	sprinklers     map[string]string
-	sprinklersLock sync.Mutex
+	fans       *registrations
+	sprinklers *registrations
 
+	// Identities of the connected hubs by their peer IDs; the identity is empty if the hub didn't authenticate
+	hubs     map[string]string
+	hubsLock sync.Mutex
+
+	// Latest presence messages by topic which couldn't be published since the broker was unreachable; nil clears a topic
+	pendingPresence     map[string]any
+	pendingPresenceLock sync.Mutex
+
+	allowlist Allowlist
+
+	rules *Rules
+
+	subscriptionsCtx  context.Context
+	subscribed        bool
+	subscriptionsLock sync.Mutex
+
+	// Commands from the broker are handled one after another outside of the MQTT client's goroutine,
+	// since message handlers must not wait for publishes to complete
+	commands     []func()
+	commandsLock sync.Mutex
+	commandsCh   chan struct{}
+
+	shadows bool
+
+	// Schedules are only run if they can be persisted
+	schedulesFile string
+	schedules     mqttapi.Schedules
+	scheduler     *cron.Cron
+	schedulesLock sync.Mutex
+
+	// Configs for hubs are kept so that they can be pushed to hubs which connect later on
+	hubConfig    *mqttapi.HubConfig
+	roomConfigs  map[string]mqttapi.RoomConfig
+	plantConfigs map[string]mqttapi.PlantConfig
+	configsLock  sync.Mutex
+
+	temperatures     map[string]mqttapi.TemperatureMeasurement
+	moistures        map[string]mqttapi.MoistureMeasurement
+	measurementsLock sync.Mutex
+
+	fanStates          map[string]*actuatorState
+	sprinklerStates    map[string]*actuatorState
+	actuatorStatesLock sync.Mutex
+
+	// Connected hubs by their peer IDs; must be set before the gateway is opened, since commands can arrive right after that
 	Peers func() map[string]HubRemote
 }
 
 func NewGateway(
-	verbose bool,
+	logger *slog.Logger,
 	ctx context.Context,
 	broker mqtt.Client,
 	thingName string,
+	payloadFormat PayloadFormat,
+	registrationPolicy RegistrationPolicy,
+	allowlist Allowlist,
+	buffer *queue.Queue,
+	rules *Rules,
+	shadows bool,
+	schedulesFile string,
 ) *Gateway {
+	// Attach the thing name to all records so that they can be filtered by greenhouse
+	logger = logger.With(logging.KeyThingName, thingName)
+
 	return &Gateway{
-		verbose: verbose,
+		mqttLogger:      logging.WithSubsystem(logger, logging.SubsystemMQTT),
+		rpcLogger:       logging.WithSubsystem(logger, logging.SubsystemRPC),
+		rulesLogger:     logging.WithSubsystem(logger, logging.SubsystemRules),
+		schedulerLogger: logging.WithSubsystem(logger, logging.SubsystemScheduler),
 
 		errs: make(chan error),
 
-		fans: map[string]string{},
+		registrationPolicy: registrationPolicy,
 
-		sprinklers: map[string]string{},
+		fans:       newRegistrations(),
+		sprinklers: newRegistrations(),
 
 		broker:    broker,
 		thingName: thingName,
+
+		payloadFormat: payloadFormat,
+
+		buffer: buffer,
+
+		hubs: map[string]string{},
+
+		pendingPresence: map[string]any{},
+
+		allowlist: allowlist,
+
+		rules: rules,
+
+		commandsCh: make(chan struct{}, 1),
+
+		shadows: shadows,
+
+		schedulesFile: schedulesFile,
+
+		roomConfigs:  map[string]mqttapi.RoomConfig{},
+		plantConfigs: map[string]mqttapi.PlantConfig{},
+
+		temperatures: map[string]mqttapi.TemperatureMeasurement{},
+		moistures:    map[string]mqttapi.MoistureMeasurement{},
+
+		fanStates:       map[string]*actuatorState{},
+		sprinklerStates: map[string]*actuatorState{},
 	}
 }
 
-// RegisterFans method registers the rooms to the fans
-func (w *Gateway) RegisterFans(ctx context.Context, roomIDs []string) error {
-	if w.verbose {
-		log.Printf("RegisterFans(roomIDs=%v)", roomIDs)
+// withPeerID attaches the ID of the peer which called an RPC to a logger, if it is known
+func withPeerID(logger *slog.Logger, ctx context.Context) *slog.Logger {
+	if peerID, ok := ctx.Value(rpc.RemoteIDContextKey).(string); ok {
+		return logger.With(logging.KeyPeerID, peerID)
 	}
 
-	// Get the ID of the peer from the context
-	peerID := rpc.GetRemoteID(ctx)
+	return logger
+}
 
-	// Lock the fans data preventing race condition
-	w.fansLock.Lock()
-	defer w.fansLock.Unlock()
+// publishToBroker publishes a message to the broker and waits until it has been sent
+func (w *Gateway) publishToBroker(topic string, qos byte, retained bool, msg []byte) error {
+	if token := w.broker.Publish(topic, qos, retained, msg); token.Wait() && token.Error() != nil {
+		metrics.FailedMessages.WithLabelValues(metrics.GetTopicType(topic)).Inc()
 
-	for _, roomID := range roomIDs {
-		// Register the fan to the room
-		w.fans[roomID] = peerID
+		return token.Error()
 	}
 
+	metrics.PublishedMessages.WithLabelValues(metrics.GetTopicType(topic)).Inc()
+
 	return nil
 }
 
-// UnregisterFans method unregisters the rooms from the fans
-func (w *Gateway) UnregisterFans(ctx context.Context, roomIDs []string) error {
-	if w.verbose {
-		log.Printf("UnregisterFans(roomIDs=%v)", roomIDs)
+// publishRetained publishes a message which the broker keeps as the topic's last known state
+func (w *Gateway) publishRetained(topic string, v any) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
 
-	// Lock the fans data preventing race condition
-	w.fansLock.Lock()
-	defer w.fansLock.Unlock()
+	return w.publishToBroker(topic, 1, true, msg)
+}
+
+// publishPresence publishes the retained status of a hub or the availability of an actuator. While the broker is unreachable,
+// publishes would block until it is reachable again, which would prevent hubs from connecting and registering; instead,
+// the latest message of each topic is kept and published once the gateway has reconnected. A nil message clears the topic.
+func (w *Gateway) publishPresence(topic string, v any) error {
+	if !w.broker.IsConnectionOpen() {
+		w.pendingPresenceLock.Lock()
+		w.pendingPresence[topic] = v
+		w.pendingPresenceLock.Unlock()
+
+		return nil
+	}
+
+	if v == nil {
+		return w.publishToBroker(topic, 1, true, []byte{})
+	}
+
+	return w.publishRetained(topic, v)
+}
+
+// publishPendingPresence publishes the presence messages which have been kept while the broker was unreachable
+func (w *Gateway) publishPendingPresence() error {
+	w.pendingPresenceLock.Lock()
+	pending := w.pendingPresence
+	w.pendingPresence = map[string]any{}
+	w.pendingPresenceLock.Unlock()
+
+	for topic, v := range pending {
+		if err := w.publishPresence(topic, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getHubStatusTopic returns the topic the status of a hub is published to
+func (w *Gateway) getHubStatusTopic(peerID string) string {
+	return path.Join("/gateways", w.thingName, "hubs", peerID, "status")
+}
+
+// getHubConfigTopic returns the topic which the configuration a hub uses is published to
+func (w *Gateway) getHubConfigTopic(peerID string) string {
+	return path.Join("/gateways", w.thingName, "hubs", peerID, "config")
+}
+
+// getRegistrations returns the IDs of the rooms and plants a hub has registered
+func (w *Gateway) getRegistrations(peerID string) ([]string, []string) {
+	return w.fans.getIDs(peerID), w.sprinklers.getIDs(peerID)
+}
+
+// publishHubStatus publishes whether a hub is online and which rooms and plants it has registered
+func (w *Gateway) publishHubStatus(peerID string, online bool) error {
+	roomIDs, plantIDs := w.getRegistrations(peerID)
+
+	return w.publishPresence(
+		w.getHubStatusTopic(peerID),
+		mqttapi.HubStatus{
+			Online:    online,
+			Identity:  w.getIdentity(peerID),
+			Rooms:     roomIDs,
+			Plants:    plantIDs,
+			Timestamp: time.Now().UnixMilli(),
+		},
+	)
+}
+
+// updateHubStatus re-publishes the status of a connected hub after its registrations have changed,
+// and whether the actuators of the changed rooms and plants can currently receive commands
+func (w *Gateway) updateHubStatus(peerID string, roomIDs, plantIDs []string, available bool) error {
+	w.hubsLock.Lock()
+	_, ok := w.hubs[peerID]
+	w.hubsLock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err := w.publishAvailability(roomIDs, plantIDs, available); err != nil {
+		return err
+	}
+
+	return w.publishHubStatus(peerID, true)
+}
+
+// publishAvailability publishes whether the fans of rooms and sprinklers of plants can currently receive commands
+func (w *Gateway) publishAvailability(roomIDs, plantIDs []string, available bool) error {
+	availability := mqttapi.ActuatorAvailability{
+		Available: available,
+		Timestamp: time.Now().UnixMilli(),
+	}
 
 	for _, roomID := range roomIDs {
-		// Unregister the fan from the room
-		delete(w.fans, roomID)
+		if err := w.publishPresence(path.Join("/gateways", w.thingName, "rooms", roomID, "fan", "availability"), availability); err != nil {
+			return err
+		}
+	}
+
+	for _, plantID := range plantIDs {
+		if err := w.publishPresence(path.Join("/gateways", w.thingName, "plants", plantID, "sprinkler", "availability"), availability); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// purgeRegistrations unregisters all rooms and plants which are still registered to a hub
+// and returns the ones which no other hub has registered
+func (w *Gateway) purgeRegistrations(peerID string) ([]string, []string) {
+	roomIDs, plantIDs := w.getRegistrations(peerID)
+
+	return w.fans.unregister(peerID, roomIDs), w.sprinklers.unregister(peerID, plantIDs)
+}
+
+// getHubs returns the hubs which commands for a room or plant are sent to according to the registration policy
+func (w *Gateway) getHubs(registrations *registrations, id string) []HubRemote {
+	peers := w.getConnectedHubs()
+
+	hubs := []HubRemote{}
+	for _, peerID := range registrations.getPeers(id, w.registrationPolicy) {
+		if hub, ok := peers[peerID]; ok {
+			hubs = append(hubs, hub)
+		}
+	}
+
+	return hubs
+}
+
+// setFanOn turns the fan of a room on or off using the hubs it is registered to; see Hub.SetFanOn for the runtime
+func (w *Gateway) setFanOn(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+	// Get Hubs for fan
+	hubs := w.getHubs(w.fans, roomID)
+	if len(hubs) == 0 {
+		return ErrNoSuchRoom
+	}
+
+	// Attempt to turn fan on or off
+	errs := []error{}
+	for _, hub := range hubs {
+		start := time.Now()
+		err := hub.SetFanOn(ctx, roomID, on, runtime)
+		metrics.CommandDuration.WithLabelValues("SetFanOn", metrics.GetResult(err)).Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	w.recordActuatorState(w.fanStates, roomID, on)
+	w.reportShadow(shadowPrefixRoom, roomID, on)
+
+	return nil
+}
+
+// setSprinklerOn turns the sprinkler of a plant on or off using the hubs it is registered to; see Hub.SetSprinklerOn for the runtime
+func (w *Gateway) setSprinklerOn(ctx context.Context, plantID string, on bool, runtime time.Duration) error {
+	// Get Hubs for sprinkler
+	hubs := w.getHubs(w.sprinklers, plantID)
+	if len(hubs) == 0 {
+		return ErrNoSuchPlant
+	}
+
+	// Attempt to turn sprinkler on or off
+	errs := []error{}
+	for _, hub := range hubs {
+		start := time.Now()
+		err := hub.SetSprinklerOn(ctx, plantID, on, runtime)
+		metrics.CommandDuration.WithLabelValues("SetSprinklerOn", metrics.GetResult(err)).Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	w.recordActuatorState(w.sprinklerStates, plantID, on)
+	w.reportShadow(shadowPrefixPlant, plantID, on)
+
+	return nil
+}
+
+// publish sends a message to the broker.
+// If a buffer is configured, messages are queued instead of being dropped while the broker is unreachable.
+func (w *Gateway) publish(topic string, qos byte, retained bool, msg []byte) error {
+	if w.buffer == nil {
+		return w.publishToBroker(topic, qos, retained, msg)
+	}
+
+	// Keep the order of messages by queueing new ones while older ones are still waiting to be replayed
+	queued, err := w.buffer.Len()
+	if err != nil {
+		return err
+	}
+
+	connected := w.broker.IsConnectionOpen()
+	if queued == 0 && connected {
+		err := w.publishToBroker(topic, qos, retained, msg)
+		if err == nil {
+			return nil
+		}
+
+		w.mqttLogger.Debug("Could not publish, buffering", logging.KeyTopic, topic, logging.KeyError, err)
+	}
+
+	if err := w.buffer.Push(queue.Entry{
+		Topic:     topic,
+		QoS:       qos,
+		Retained:  retained,
+		Payload:   msg,
+		Timestamp: time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	// Replaying only starts once the gateway reconnects, so drain the buffer if the message has been buffered while connected
+	if connected {
+		w.drainBuffer()
+	}
+
+	return nil
+}
+
+// replayBuffer publishes the buffered messages, oldest first
+func (w *Gateway) replayBuffer() error {
+	// Prevent concurrent replays from sending messages twice
+	w.replayLock.Lock()
+	defer w.replayLock.Unlock()
+
+	return w.buffer.Replay(func(entry queue.Entry) error {
+		w.mqttLogger.Debug("Replaying buffered message", logging.KeyTopic, entry.Topic, "timestamp", entry.Timestamp)
+
+		return w.publishToBroker(entry.Topic, entry.QoS, entry.Retained, entry.Payload)
+	})
+}
+
+// drainBuffer replays the buffered messages in the background unless they are already being drained
+func (w *Gateway) drainBuffer() {
+	if !w.draining.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		for {
+			err := w.replayBuffer()
+			w.draining.Store(false)
+
+			// The buffer is replayed again once the gateway has reconnected
+			if err != nil {
+				w.mqttLogger.Warn("Could not replay buffered messages, continuing", logging.KeyError, err)
+
+				return
+			}
+
+			// Messages which have been buffered after the replay finished but before the flag was cleared would otherwise be stuck
+			if queued, err := w.buffer.Len(); err != nil || queued == 0 || !w.draining.CompareAndSwap(false, true) {
+				return
+			}
+		}
+	}()
+}
+
+// RegisterFans method registers the rooms to the fans
+func (w *Gateway) RegisterFans(ctx context.Context, roomIDs []string) error {
+	withPeerID(w.rpcLogger, ctx).Debug("RegisterFans", "roomIDs", roomIDs)
+
+	// Check whether the hub may use the rooms
+	if err := w.authorizeRooms(ctx, roomIDs...); err != nil {
+		return err
+	}
+
+	// Get the ID of the peer from the context
+	peerID := rpc.GetRemoteID(ctx)
+
+	// Register the fans of the rooms, handling rooms which other hubs have already registered according to the policy
+	duplicates, err := w.fans.register(peerID, roomIDs, w.registrationPolicy)
+	if err != nil {
+		withPeerID(w.rpcLogger, ctx).Warn("Rejected duplicate registration of fans", "roomIDs", duplicates)
+
+		return fmt.Errorf("could not register fans of rooms %v: %w", duplicates, err)
+	}
+
+	if len(duplicates) > 0 {
+		withPeerID(w.rpcLogger, ctx).Warn("Rooms have been registered by multiple hubs", "roomIDs", duplicates, "policy", w.registrationPolicy)
+	}
+
+	// Apply the desired state of the fans' shadows
+	w.requestShadows(shadowPrefixRoom, roomIDs)
+
+	// Announce the hub's new rooms
+	return w.updateHubStatus(peerID, roomIDs, nil, true)
+}
+
+// UnregisterFans method unregisters the rooms from the fans
+func (w *Gateway) UnregisterFans(ctx context.Context, roomIDs []string) error {
+	withPeerID(w.rpcLogger, ctx).Debug("UnregisterFans", "roomIDs", roomIDs)
+
+	// Unregister the fans of the rooms; they are only unavailable if no other hub has registered them
+	orphanedRoomIDs := w.fans.unregister(rpc.GetRemoteID(ctx), roomIDs)
+
+	// Announce the hub's remaining rooms
+	return w.updateHubStatus(rpc.GetRemoteID(ctx), orphanedRoomIDs, nil, false)
+}
+
 // RegisterSprinklers method registers the plants to the sprinklers
 func (w *Gateway) RegisterSprinklers(ctx context.Context, plantIDs []string) error {
-	if w.verbose {
-		log.Printf("RegisterSprinklers(plantIDs=%v)", plantIDs)
+	withPeerID(w.rpcLogger, ctx).Debug("RegisterSprinklers", "plantIDs", plantIDs)
+
+	// Check whether the hub may use the plants
+	if err := w.authorizePlants(ctx, plantIDs...); err != nil {
+		return err
 	}
 
 	// Get the ID of the peer from the context
 	peerID := rpc.GetRemoteID(ctx)
 
-	// Lock the sprinklers data preventing race condition
-	w.sprinklersLock.Lock()
-	defer w.sprinklersLock.Unlock()
+	// Register the sprinklers of the plants, handling plants which other hubs have already registered according to the policy
+	duplicates, err := w.sprinklers.register(peerID, plantIDs, w.registrationPolicy)
+	if err != nil {
+		withPeerID(w.rpcLogger, ctx).Warn("Rejected duplicate registration of sprinklers", "plantIDs", duplicates)
 
-	for _, plantID := range plantIDs {
-		// Register the sprinkler to the plant
-		w.sprinklers[plantID] = peerID
+		return fmt.Errorf("could not register sprinklers of plants %v: %w", duplicates, err)
 	}
 
-	return nil
+	if len(duplicates) > 0 {
+		withPeerID(w.rpcLogger, ctx).Warn("Plants have been registered by multiple hubs", "plantIDs", duplicates, "policy", w.registrationPolicy)
+	}
+
+	// Apply the desired state of the sprinklers' shadows
+	w.requestShadows(shadowPrefixPlant, plantIDs)
+
+	// Announce the hub's new plants
+	return w.updateHubStatus(peerID, nil, plantIDs, true)
 }
 
 // UnregisterSprinklers unregisters the plants from the sprinklers
 func (w *Gateway) UnregisterSprinklers(ctx context.Context, plantIDs []string) error {
-	if w.verbose {
-		log.Printf("UnregisterSpriklers(plantIDs=%v)", plantIDs)
-	}
+	withPeerID(w.rpcLogger, ctx).Debug("UnregisterSprinklers", "plantIDs", plantIDs)
 
-	// Lock the sprinklers data preventing race condition
-	w.sprinklersLock.Lock()
-	defer w.sprinklersLock.Unlock()
+	// Unregister the sprinklers of the plants; they are only unavailable if no other hub has registered them
+	orphanedPlantIDs := w.sprinklers.unregister(rpc.GetRemoteID(ctx), plantIDs)
 
-	for _, plantID := range plantIDs {
-		// Unregister the sprinkler from the plant
-		delete(w.sprinklers, plantID)
+	// Announce the hub's remaining plants
+	return w.updateHubStatus(rpc.GetRemoteID(ctx), nil, orphanedPlantIDs, false)
+}
+
+// marshalMeasurement encodes a measurement in the configured payload format
+func (w *Gateway) marshalMeasurement(measurement mqttapi.Measurement) ([]byte, error) {
+	// Fall back to the time at which the gateway received the measurement
+	if measurement.Timestamp == 0 {
+		measurement.Timestamp = time.Now().UnixMilli()
 	}
 
-	return nil
+	if w.payloadFormat == PayloadFormatLegacy {
+		return json.Marshal(mqttapi.LegacyMeasurement{
+			Measurement:  int(measurement.Value),
+			DefaultValue: int(measurement.DefaultValue),
+			Timestamp:    measurement.Timestamp,
+		})
+	}
+
+	measurement.Version = mqttapi.MeasurementVersion
+
+	return json.Marshal(measurement)
 }
 
 // ForwardTemperatureMeasurement function is used to forward temperature measurements to the broker.
-func (w *Gateway) ForwardTemperatureMeasurement(ctx context.Context, roomID string, measurement, defaultValue int) error {
-	if w.verbose {
-		log.Printf("ForwardTemperatureMeasurement(roomIDs=%v, measurement=%v, defaultValue=%v)", roomID, measurement, defaultValue)
+func (w *Gateway) ForwardTemperatureMeasurement(ctx context.Context, roomID string, measurement mqttapi.TemperatureMeasurement) error {
+	withPeerID(w.rpcLogger, ctx).Debug("ForwardTemperatureMeasurement", logging.KeyRoomID, roomID, "measurement", measurement)
+
+	// Check whether the hub may report on the room
+	if err := w.authorizeRooms(ctx, roomID); err != nil {
+		return err
 	}
 
+	// Remember the measurement so that operators can inspect it
+	w.measurementsLock.Lock()
+	w.temperatures[roomID] = measurement
+	w.measurementsLock.Unlock()
+
 	// Marshal the measurement into a JSON format
-	msg, err := json.Marshal(mqttapi.TemperatureMeasurement{
-		Measurement:  measurement,
-		DefaultValue: defaultValue,
-	})
+	msg, err := w.marshalMeasurement(measurement)
 	if err != nil {
 		return err
 	}
 
-	// Publish the measurement to the broker
-	if token := w.broker.Publish(
-		path.Join("/gateways", w.thingName, "rooms", roomID, "temperature"),
-		0,
-		false,
-		msg,
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
-	}
+	// Let the local rules react to the measurement
+	w.evaluateTemperature(ctx, roomID, measurement.Value, measurement.DefaultValue)
 
-	return nil
+	// Publish the measurement to the broker
+	return w.publish(path.Join("/gateways", w.thingName, "rooms", roomID, "temperature"), 0, false, msg)
 }
 
 // ForwardMoistureMeasurement function is used to forward moisture measurements to the broker.
-func (w *Gateway) ForwardMoistureMeasurement(ctx context.Context, plantID string, measurement, defaultValue int) error {
-	if w.verbose {
-		log.Printf("ForwardMoistureMeasurement(plantIDs=%v, measurement=%v, defaultValue=%v)", plantID, measurement, defaultValue)
+func (w *Gateway) ForwardMoistureMeasurement(ctx context.Context, plantID string, measurement mqttapi.MoistureMeasurement) error {
+	withPeerID(w.rpcLogger, ctx).Debug("ForwardMoistureMeasurement", logging.KeyPlantID, plantID, "measurement", measurement)
+
+	// Check whether the hub may report on the plant
+	if err := w.authorizePlants(ctx, plantID); err != nil {
+		return err
 	}
 
+	// Remember the measurement so that operators can inspect it
+	w.measurementsLock.Lock()
+	w.moistures[plantID] = measurement
+	w.measurementsLock.Unlock()
+
 	// Marshal the measurement into a JSON format
-	msg, err := json.Marshal(mqttapi.MoistureMeasurement{
-		Measurement:  measurement,
-		DefaultValue: defaultValue,
-	})
+	msg, err := w.marshalMeasurement(measurement)
 	if err != nil {
 		return err
 	}
 
+	// Let the local rules react to the measurement
+	w.evaluateMoisture(ctx, plantID, measurement.Value, measurement.DefaultValue)
+
 	// Publish the measurement to the broker
-	if token := w.broker.Publish(
-		path.Join("/gateways", w.thingName, "plants", plantID, "moisture"),
-		0,
-		false,
-		msg,
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+	return w.publish(path.Join("/gateways", w.thingName, "plants", plantID, "moisture"), 0, false, msg)
+}
+
+// ReportTemperatureSensorHealth function is used to forward the health of a room's temperature sensor to the broker.
+func (w *Gateway) ReportTemperatureSensorHealth(ctx context.Context, roomID string, health mqttapi.DeviceHealth) error {
+	withPeerID(w.rpcLogger, ctx).Debug("ReportTemperatureSensorHealth", logging.KeyRoomID, roomID, "health", health)
+
+	// Check whether the hub may report on the room
+	if err := w.authorizeRooms(ctx, roomID); err != nil {
+		return err
+	}
+
+	// Marshal the health into a JSON format
+	msg, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+
+	// Publish the health to the broker as the sensor's last known state
+	return w.publish(path.Join("/gateways", w.thingName, "rooms", roomID, "temperature", "health"), 1, true, msg)
+}
+
+// ReportMoistureSensorHealth function is used to forward the health of a plant's moisture sensor to the broker.
+func (w *Gateway) ReportMoistureSensorHealth(ctx context.Context, plantID string, health mqttapi.DeviceHealth) error {
+	withPeerID(w.rpcLogger, ctx).Debug("ReportMoistureSensorHealth", logging.KeyPlantID, plantID, "health", health)
+
+	// Check whether the hub may report on the plant
+	if err := w.authorizePlants(ctx, plantID); err != nil {
+		return err
+	}
+
+	// Marshal the health into a JSON format
+	msg, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+
+	// Publish the health to the broker as the sensor's last known state
+	return w.publish(path.Join("/gateways", w.thingName, "plants", plantID, "moisture", "health"), 1, true, msg)
+}
+
+// ReportFanState function is used by hubs to report that they have switched a room's fan on their own, i.e. since its runtime has elapsed.
+func (w *Gateway) ReportFanState(ctx context.Context, roomID string, on bool) error {
+	logger := withPeerID(w.rpcLogger, ctx)
+	logger.Debug("ReportFanState", logging.KeyRoomID, roomID, "on", on)
+
+	// Check whether the hub may report on the room
+	if err := w.authorizeRooms(ctx, roomID); err != nil {
+		return err
 	}
 
+	w.recordReportedState(logger.With(logging.KeyRoomID, roomID), w.fanStates, shadowPrefixRoom, roomID, path.Join("/gateways", w.thingName, "rooms", roomID, "fan"), on)
+
 	return nil
 }
 
-// OpenGateway function initializes gateway functionality by subscribing to fan and sprinkler MQTT topics.
-func OpenGateway(gateway *Gateway, ctx context.Context) error {
-	// Subscribe to fan topic
-	if token := gateway.broker.Subscribe(
-		path.Join("/gateways", gateway.thingName, "rooms", "+", "fan"),
-		0,
-		// Function to be called when a message on the fan topic is received
-		func(client mqtt.Client, msg mqtt.Message) {
-			gateway.fansLock.Lock()         // Lock to prevent concurrent modification
-			defer gateway.fansLock.Unlock() // Unlock once finished
+// ReportSprinklerState function is used by hubs to report that they have switched a plant's sprinkler on their own, i.e. since its runtime has elapsed.
+func (w *Gateway) ReportSprinklerState(ctx context.Context, plantID string, on bool) error {
+	logger := withPeerID(w.rpcLogger, ctx)
+	logger.Debug("ReportSprinklerState", logging.KeyPlantID, plantID, "on", on)
 
-			basePath, _ := path.Split(msg.Topic())
+	// Check whether the hub may report on the plant
+	if err := w.authorizePlants(ctx, plantID); err != nil {
+		return err
+	}
 
-			roomID := path.Base(basePath)
+	w.recordReportedState(logger.With(logging.KeyPlantID, plantID), w.sprinklerStates, shadowPrefixPlant, plantID, path.Join("/gateways", w.thingName, "plants", plantID, "sprinkler"), on)
 
-			// Check if fan exists for room
-			peerID, ok := gateway.fans[roomID]
-			if !ok {
-				gateway.errs <- ErrNoSuchRoom
+	return nil
+}
 
-				return
-			}
+// recordReportedState stores the state a hub has switched an actuator to on its own so that the local rules can switch it again,
+// and publishes it to the actuator's state topic and shadow like the state of a command
+func (w *Gateway) recordReportedState(logger *slog.Logger, states map[string]*actuatorState, shadowPrefix, id, topic string, on bool) {
+	w.recordActuatorState(states, id, on)
 
-			// Get Hub for fan
-			hub, ok := gateway.Peers()[peerID]
-			if !ok {
-				gateway.errs <- ErrNoSuchRoom
+	// The desired state is reset too, since the shadow would otherwise switch the actuator back on
+	w.resetShadow(shadowPrefix, id, on)
 
-				return
-			}
+	// The acknowledgement has no correlation ID since it doesn't belong to a command
+	w.acknowledgeCommand(logger, topic, mqttapi.FanState{On: on}, nil)
+}
+
+// subscribe subscribes to the fan, sprinkler and config topics and, if schedules are enabled, to the schedules topic
+func (w *Gateway) subscribe(ctx context.Context) error {
+	err := w.subscribeActuators(ctx)
+	if err == nil {
+		err = w.subscribeConfigs(ctx)
+	}
+	if err == nil && w.schedulesFile != "" {
+		err = w.subscribeSchedules(ctx)
+	}
 
-			// Parse FanState from message
-			fanState := &mqttapi.FanState{}
-			if err := json.Unmarshal(msg.Payload(), &fanState); err != nil {
-				gateway.errs <- err
+	w.subscriptionsLock.Lock()
+	w.subscribed = err == nil
+	w.subscriptionsLock.Unlock()
 
-				return
-			}
+	return err
+}
 
-			// Attempt to turn fan on or off
-			if err := hub.SetFanOn(ctx, roomID, fanState.On); err != nil {
-				gateway.errs <- err
+// getCommandRuntime returns how long a command keeps an actuator on, or 0 if it stays on until it is turned off
+func getCommandRuntime(state mqttapi.FanState, now time.Time) (time.Duration, error) {
+	if state.Duration < 0 || state.Deadline < 0 {
+		return 0, ErrInvalidCommand
+	}
 
-				return
-			}
+	if !state.On {
+		return 0, nil
+	}
+
+	runtime := time.Duration(state.Duration) * time.Millisecond
+
+	if state.Deadline > 0 {
+		untilDeadline := time.UnixMilli(state.Deadline).Sub(now)
+		if untilDeadline <= 0 {
+			return 0, ErrDeadlinePassed
+		}
+
+		if runtime == 0 || untilDeadline < runtime {
+			runtime = untilDeadline
+		}
+	}
+
+	return runtime, nil
+}
+
+// acknowledgeCommand publishes whether a command for a fan or sprinkler has been applied to the state topic next to the command's topic
+func (w *Gateway) acknowledgeCommand(logger *slog.Logger, topic string, state mqttapi.FanState, err error) {
+	ack := mqttapi.CommandAck{
+		CorrelationID: state.CorrelationID,
+		On:            state.On,
+		Applied:       err == nil,
+		Timestamp:     time.Now().UnixMilli(),
+	}
+
+	if err != nil {
+		ack.Error = err.Error()
+	}
+
+	msg, err := json.Marshal(ack)
+	if err != nil {
+		logger.Warn("Could not encode command acknowledgement, continuing", logging.KeyError, err)
+
+		return
+	}
+
+	if err := w.publish(path.Join(topic, "state"), 1, false, msg); err != nil {
+		logger.Warn("Could not publish command acknowledgement, continuing", logging.KeyError, err)
+	}
+}
+
+// handleCommand switches a fan or sprinkler as requested by a command from the broker and acknowledges the command.
+// Failed commands are acknowledged with an error, but don't stop the gateway.
+func (w *Gateway) handleCommand(ctx context.Context, logger *slog.Logger, msg mqtt.Message, setOn func(ctx context.Context, on bool, runtime time.Duration) error) {
+	// Parse the state from the message
+	state := mqttapi.FanState{}
+	if err := json.Unmarshal(msg.Payload(), &state); err != nil {
+		logger.Warn("Could not parse command, continuing", logging.KeyError, err)
+
+		w.queueCommand(func() {
+			w.acknowledgeCommand(logger, msg.Topic(), state, fmt.Errorf("%w: %v", ErrInvalidCommand, err))
+		})
+
+		return
+	}
+
+	logger = logger.With(logging.KeyCorrelationID, state.CorrelationID)
+
+	w.queueCommand(func() {
+		// Ignore cloud commands if local rules take priority
+		if !w.cloudCommandsAllowed() {
+			logger.Debug("Ignoring command since local rules take priority")
+
+			w.acknowledgeCommand(logger, msg.Topic(), state, ErrCommandIgnored)
+
+			return
+		}
+
+		// Attempt to turn the actuator on or off; its hub might have disconnected or fail to switch it
+		runtime, err := getCommandRuntime(state, time.Now())
+		if err == nil {
+			err = setOn(ctx, state.On, runtime)
+		}
+
+		if err != nil {
+			logger.Warn("Could not turn actuator on or off, continuing", "on", state.On, logging.KeyError, err)
+		}
+
+		w.acknowledgeCommand(logger, msg.Topic(), state, err)
+	})
+}
+
+// subscribeActuators subscribes to the fan and sprinkler topics, turning fans and sprinklers on or off when a command is received
+func (w *Gateway) subscribeActuators(ctx context.Context) error {
+	// Subscribe to fan topic
+	if token := w.broker.Subscribe(
+		path.Join("/gateways", w.thingName, "rooms", "+", "fan"),
+		0,
+		// Function to be called when a message on the fan topic is received
+		func(client mqtt.Client, msg mqtt.Message) {
+			basePath, _ := path.Split(msg.Topic())
+
+			roomID := path.Base(basePath)
+
+			w.handleCommand(ctx, w.mqttLogger.With(logging.KeyRoomID, roomID), msg, func(ctx context.Context, on bool, runtime time.Duration) error {
+				return w.setFanOn(ctx, roomID, on, runtime)
+			})
 		},
 	); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 
 	// Similar to above, subscribe to sprinkler topic
-	if token := gateway.broker.Subscribe(
-		path.Join("/gateways", gateway.thingName, "plants", "+", "sprinkler"),
+	if token := w.broker.Subscribe(
+		path.Join("/gateways", w.thingName, "plants", "+", "sprinkler"),
 		0,
 		func(client mqtt.Client, msg mqtt.Message) {
-			gateway.sprinklersLock.Lock()
-			defer gateway.sprinklersLock.Unlock()
-
 			basePath, _ := path.Split(msg.Topic())
 
 			plantID := path.Base(basePath)
 
-			// Check if sprinkler exists for plant
-			peerID, ok := gateway.sprinklers[plantID]
-			if !ok {
-				gateway.errs <- ErrNoSuchPlant
+			w.handleCommand(ctx, w.mqttLogger.With(logging.KeyPlantID, plantID), msg, func(ctx context.Context, on bool, runtime time.Duration) error {
+				return w.setSprinklerOn(ctx, plantID, on, runtime)
+			})
+		},
+	); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	// Subscribe to the desired states of the fans' and sprinklers' shadows
+	if w.shadows {
+		return w.subscribeShadows(ctx)
+	}
 
-				return
-			}
+	// If everything went fine, return nil
+	return nil
+}
 
-			// Get Hub for sprinkler
-			hub, ok := gateway.Peers()[peerID]
-			if !ok {
-				gateway.errs <- ErrNoSuchPlant
+// queueCommand queues a command from the broker so that it is handled after all commands which were received before it
+func (w *Gateway) queueCommand(handle func()) {
+	w.commandsLock.Lock()
+	w.commands = append(w.commands, handle)
+	w.commandsLock.Unlock()
 
-				return
-			}
+	select {
+	case w.commandsCh <- struct{}{}:
+	default:
+	}
+}
 
-			// Parse SprinklerState from message
-			sprinklerState := &mqttapi.SprinklerState{}
-			if err := json.Unmarshal(msg.Payload(), &sprinklerState); err != nil {
-				gateway.errs <- err
+// handleCommands handles queued commands in the order they were received in until ctx is done
+func (w *Gateway) handleCommands(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
 
-				return
-			}
+		case <-w.commandsCh:
+		}
 
-			// Attempt to turn sprinkler on or off
-			if err := hub.SetSprinklerOn(ctx, plantID, sprinklerState.On); err != nil {
-				gateway.errs <- err
+		for {
+			w.commandsLock.Lock()
+			if len(w.commands) == 0 {
+				w.commandsLock.Unlock()
 
-				return
+				break
 			}
+
+			handle := w.commands[0]
+			w.commands = w.commands[1:]
+			w.commandsLock.Unlock()
+
+			handle()
+		}
+	}
+}
+
+// OpenGateway function initializes gateway functionality by subscribing to fan and sprinkler MQTT topics.
+func OpenGateway(gateway *Gateway, ctx context.Context) error {
+	gateway.subscriptionsLock.Lock()
+	gateway.subscriptionsCtx = ctx
+	gateway.subscriptionsLock.Unlock()
+
+	go gateway.handleCommands(ctx)
+
+	// Run the persisted schedules until the broker has sent the current ones
+	if gateway.schedulesFile != "" {
+		if err := gateway.openSchedules(ctx); err != nil {
+			return err
+		}
+	}
+
+	return gateway.subscribe(ctx)
+}
+
+// ResumeGateway is called once the connection to the broker has been (re-)established.
+// It announces the gateway's and hubs' presence and replays all buffered messages in the order they were received in.
+func ResumeGateway(gateway *Gateway) error {
+	// Announce that the gateway is online again
+	if err := gateway.publishRetained(
+		path.Join("/gateways", gateway.thingName, "status"),
+		mqttapi.GatewayStatus{
+			Online:    true,
+			Timestamp: time.Now().UnixMilli(),
 		},
-	); token.Wait() && token.Error() != nil {
-		return token.Error()
+	); err != nil {
+		return err
 	}
 
-	// If everything went fine, return nil
+	// Subscriptions don't survive reconnecting with a clean session, so subscribe again if the gateway has been opened
+	gateway.subscriptionsLock.Lock()
+	subscriptionsCtx := gateway.subscriptionsCtx
+	gateway.subscriptionsLock.Unlock()
+
+	if subscriptionsCtx != nil {
+		if err := gateway.subscribe(subscriptionsCtx); err != nil {
+			return err
+		}
+
+		// Deltas might have been missed while the broker was unreachable, so apply the desired state of all shadows again
+		gateway.requestAllShadows()
+	}
+
+	// Publish the availability of actuators and the status of hubs which have disconnected while the broker was unreachable
+	if err := gateway.publishPendingPresence(); err != nil {
+		return err
+	}
+
+	// Re-announce all hubs since their status might have changed while the broker was unreachable
+	gateway.hubsLock.Lock()
+	peerIDs := []string{}
+	for peerID := range gateway.hubs {
+		peerIDs = append(peerIDs, peerID)
+	}
+	gateway.hubsLock.Unlock()
+
+	for _, peerID := range peerIDs {
+		if err := gateway.publishHubStatus(peerID, true); err != nil {
+			return err
+		}
+	}
+
+	if gateway.buffer == nil {
+		return nil
+	}
+
+	return gateway.replayBuffer()
+}
+
+// SetGatewayWill configures the broker to mark the gateway as offline if it disconnects unexpectedly.
+func SetGatewayWill(opts *mqtt.ClientOptions, thingName string) error {
+	msg, err := json.Marshal(mqttapi.GatewayStatus{
+		Online: false,
+	})
+	if err != nil {
+		return err
+	}
+
+	opts.SetBinaryWill(path.Join("/gateways", thingName, "status"), msg, 1, true)
+
 	return nil
 }
 
+// ConnectHub announces that a hub has connected to the gateway.
+// The identity is taken from the hub's client certificate; it is empty if the hub didn't authenticate.
+func ConnectHub(gateway *Gateway, peerID string, identity string) error {
+	gateway.hubsLock.Lock()
+	gateway.hubs[peerID] = identity
+	gateway.hubsLock.Unlock()
+
+	// Let the hub use the configs which have been received from the broker
+	if gateway.hasConfigs() {
+		gateway.subscriptionsLock.Lock()
+		subscriptionsCtx := gateway.subscriptionsCtx
+		gateway.subscriptionsLock.Unlock()
+
+		if subscriptionsCtx != nil {
+			gateway.queueCommand(func() {
+				gateway.pushConfigs(subscriptionsCtx, peerID)
+			})
+		}
+	}
+
+	return gateway.publishHubStatus(peerID, true)
+}
+
+// DisconnectHub unregisters all rooms and plants of a hub which has disconnected from the gateway
+// and announces that it and its actuators are unavailable.
+func DisconnectHub(gateway *Gateway, peerID string) error {
+	gateway.hubsLock.Lock()
+	delete(gateway.hubs, peerID)
+	gateway.hubsLock.Unlock()
+
+	// Announce the hub's registrations before purging them so that the cloud knows which rooms and plants went offline
+	if err := gateway.publishHubStatus(peerID, false); err != nil {
+		return err
+	}
+
+	// Peer IDs are unique to each connection, so clear the hub's retained status and config to prevent them from piling up on the broker
+	if err := gateway.publishPresence(gateway.getHubStatusTopic(peerID), nil); err != nil {
+		return err
+	}
+
+	if err := gateway.publishPresence(gateway.getHubConfigTopic(peerID), nil); err != nil {
+		return err
+	}
+
+	roomIDs, plantIDs := gateway.purgeRegistrations(peerID)
+
+	gateway.rpcLogger.Debug("Unregistered rooms and plants of disconnected hub which no other hub has registered", logging.KeyPeerID, peerID, "roomIDs", roomIDs, "plantIDs", plantIDs)
+
+	return gateway.publishAvailability(roomIDs, plantIDs, false)
+}
+
+// GetGatewayChecks returns the checks which have to pass for the gateway to be ready:
+// It has to be connected to the broker and subscribed to the fan and sprinkler topics.
+func GetGatewayChecks(gateway *Gateway) map[string]probes.Check {
+	return map[string]probes.Check{
+		"broker": func() error {
+			if !gateway.broker.IsConnectionOpen() {
+				return ErrBrokerDisconnected
+			}
+
+			return nil
+		},
+		"subscriptions": func() error {
+			gateway.subscriptionsLock.Lock()
+			defer gateway.subscriptionsLock.Unlock()
+
+			if !gateway.subscribed {
+				return ErrNotSubscribed
+			}
+
+			return nil
+		},
+	}
+}
+
 // WaitGateway is a helper function to handle errors from the gateway.
 func WaitGateway(gateway *Gateway) error {
 	for err := range gateway.errs {
@@ -305,8 +1102,26 @@ func WaitGateway(gateway *Gateway) error {
 	return nil
 }
 
-// CloseGateway function stops the gateway operation by unsubscribing from the MQTT topics and closing the error channel.
+// CloseGateway function stops the gateway operation by announcing that it is offline, unsubscribing from the MQTT topics and closing the error channel.
 func CloseGateway(gateway *Gateway) error {
+	// Announce that the gateway is going offline
+	if err := gateway.publishRetained(
+		path.Join("/gateways", gateway.thingName, "status"),
+		mqttapi.GatewayStatus{
+			Online:    false,
+			Timestamp: time.Now().UnixMilli(),
+		},
+	); err != nil {
+		return err
+	}
+
+	gateway.subscriptionsLock.Lock()
+	gateway.subscribed = false
+	gateway.subscriptionsCtx = nil
+	gateway.subscriptionsLock.Unlock()
+
+	gateway.stopSchedules()
+
 	// Unsubscribe from fan topic
 	if token := gateway.broker.Unsubscribe(
 		path.Join("/gateways", gateway.thingName, "rooms", "+", "fan"),
@@ -316,11 +1131,39 @@ func CloseGateway(gateway *Gateway) error {
 
 	// Unsubscribe from sprinkler topic
 	if token := gateway.broker.Unsubscribe(
-		path.Join("/gateways", gateway.thingName, "rooms", "+", "sprinkler"),
+		path.Join("/gateways", gateway.thingName, "plants", "+", "sprinkler"),
 	); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 
+	// Unsubscribe from shadow topics
+	if gateway.shadows {
+		if token := gateway.broker.Unsubscribe(
+			gateway.getShadowTopic("+", "update", "delta"),
+			gateway.getShadowTopic("+", "get", "accepted"),
+		); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+	}
+
+	// Unsubscribe from config topics
+	for _, topic := range []string{
+		path.Join("/gateways", gateway.thingName, "config"),
+		path.Join("/gateways", gateway.thingName, "rooms", "+", "config"),
+		path.Join("/gateways", gateway.thingName, "plants", "+", "config"),
+	} {
+		if token := gateway.broker.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+	}
+
+	// Unsubscribe from schedules topic
+	if gateway.schedulesFile != "" {
+		if token := gateway.broker.Unsubscribe(gateway.getSchedulesTopic()); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+	}
+
 	// Close error channel
 	close(gateway.errs)
 
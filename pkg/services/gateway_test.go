@@ -4,20 +4,71 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"path"
 	"testing"
+	"time"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	gomock "github.com/golang/mock/gomock"
 	"github.com/pojntfx/dudirekta/pkg/rpc"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+	"github.com/pojntfx/green-guardian-gateway/pkg/queue"
 )
 
+// testGatewayOptions are the arguments of NewGateway which differ between tests
+type testGatewayOptions struct {
+	broker             mqtt.Client
+	payloadFormat      PayloadFormat
+	registrationPolicy RegistrationPolicy
+	allowlist          Allowlist
+	buffer             *queue.Queue
+	rules              *Rules
+	shadows            bool
+	schedulesFile      string
+
+	// Set before the gateway is opened, just like green-guardian-gateway does
+	peers func() map[string]HubRemote
+}
+
+// newTestGateway creates a gateway for the thing TestThing. Unless they are set in the options,
+// it uses the v2 payload format and the last-wins registration policy.
+func newTestGateway(ctx context.Context, options testGatewayOptions) *Gateway {
+	if options.payloadFormat == "" {
+		options.payloadFormat = PayloadFormatV2
+	}
+
+	if options.registrationPolicy == "" {
+		options.registrationPolicy = RegistrationPolicyLastWins
+	}
+
+	gateway := NewGateway(
+		logging.NewDiscardLogger(),
+		ctx,
+		options.broker,
+		"TestThing",
+		options.payloadFormat,
+		options.registrationPolicy,
+		options.allowlist,
+		options.buffer,
+		options.rules,
+		options.shadows,
+		options.schedulesFile,
+	)
+	gateway.Peers = options.peers
+
+	return gateway
+}
+
 // TestRegisterFans is a testing function that checks if the fans associated
 // with given IDs are registered properly.
 // Registration errors and issues with assigned IDs are reported as test failures.
 func TestRegisterFans(t *testing.T) {
 	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
 
-	gateway := NewGateway(false, ctx, nil, "TestThing")
+	gateway := newTestGateway(ctx, testGatewayOptions{})
 	roomIDs := []string{"Room1", "Room2", "Room3"}
 
 	if err := gateway.RegisterFans(ctx, roomIDs); err != nil {
@@ -25,7 +76,7 @@ func TestRegisterFans(t *testing.T) {
 	}
 
 	for _, id := range roomIDs {
-		if _, ok := gateway.fans[id]; !ok {
+		if _, ok := gateway.fans.peers[id]; !ok {
 			t.Fatalf("fan with id %s was not registered", id)
 		}
 	}
@@ -37,7 +88,7 @@ func TestRegisterFans(t *testing.T) {
 func TestUnregisterFans(t *testing.T) {
 	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
 
-	gateway := NewGateway(false, ctx, nil, "TestThing")
+	gateway := newTestGateway(ctx, testGatewayOptions{})
 	roomIDs := []string{"Room1", "Room2", "Room3"}
 
 	if err := gateway.RegisterFans(ctx, roomIDs); err != nil {
@@ -49,7 +100,7 @@ func TestUnregisterFans(t *testing.T) {
 	}
 
 	for _, id := range roomIDs {
-		if _, ok := gateway.fans[id]; ok {
+		if _, ok := gateway.fans.peers[id]; ok {
 			t.Fatalf("fan with id %s was not unregistered", id)
 		}
 	}
@@ -61,7 +112,7 @@ func TestUnregisterFans(t *testing.T) {
 // result in a test failure.
 func TestRegisterSprinklers(t *testing.T) {
 	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
-	gateway := NewGateway(false, ctx, nil, "TestThing")
+	gateway := newTestGateway(ctx, testGatewayOptions{})
 	plantIDs := []string{"Plant1", "Plant2", "Plant3"}
 
 	if err := gateway.RegisterSprinklers(ctx, plantIDs); err != nil {
@@ -69,7 +120,7 @@ func TestRegisterSprinklers(t *testing.T) {
 	}
 
 	for _, id := range plantIDs {
-		if _, ok := gateway.sprinklers[id]; !ok {
+		if _, ok := gateway.sprinklers.peers[id]; !ok {
 			t.Fatalf("sprinkler with id %s was not registered", id)
 		}
 	}
@@ -80,7 +131,7 @@ func TestRegisterSprinklers(t *testing.T) {
 // Fails the test if any sprinkler ID wasn't unregistered properly.
 func TestUnregisterSprinklers(t *testing.T) {
 	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
-	gateway := NewGateway(false, ctx, nil, "TestThing")
+	gateway := newTestGateway(ctx, testGatewayOptions{})
 	plantIDs := []string{"Plant1", "Plant2", "Plant3"}
 
 	if err := gateway.RegisterSprinklers(ctx, plantIDs); err != nil {
@@ -92,7 +143,7 @@ func TestUnregisterSprinklers(t *testing.T) {
 	}
 
 	for _, id := range plantIDs {
-		if _, ok := gateway.sprinklers[id]; ok {
+		if _, ok := gateway.sprinklers.peers[id]; ok {
 			t.Fatalf("sprinkler with id %s was not unregistered", id)
 		}
 	}
@@ -114,10 +165,14 @@ func TestForwardTemperatureMeasurement(t *testing.T) {
 	mockToken.EXPECT().Wait().Return(true)
 	mockToken.EXPECT().Error().Return(nil)
 
-	gateway := NewGateway(false, ctx, mockBroker, "TestThing")
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: mockBroker})
 	roomID := "Room1"
-	measurement := 25
-	defaultValue := 20
+	measurement := mqttapi.TemperatureMeasurement{
+		SensorID:     "rooms/Room1/temperature",
+		Value:        25.5,
+		Unit:         mqttapi.UnitCelsius,
+		DefaultValue: 20,
+	}
 
 	mockBroker.EXPECT().Publish(
 		path.Join("/gateways", gateway.thingName, "rooms", roomID, "temperature"),
@@ -126,7 +181,7 @@ func TestForwardTemperatureMeasurement(t *testing.T) {
 		gomock.Any(),
 	).Return(mockToken).Times(1)
 
-	if err := gateway.ForwardTemperatureMeasurement(ctx, roomID, measurement, defaultValue); err != nil {
+	if err := gateway.ForwardTemperatureMeasurement(ctx, roomID, measurement); err != nil {
 		t.Fatalf("unexpected error during ForwardTemperatureMeasurement: %v", err)
 	}
 }
@@ -147,10 +202,14 @@ func TestForwardMoistureMeasurement(t *testing.T) {
 	mockToken.EXPECT().Wait().Return(true)
 	mockToken.EXPECT().Error().Return(nil)
 
-	gateway := NewGateway(false, ctx, mockBroker, "TestThing")
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: mockBroker})
 	plantID := "Plant1"
-	measurement := 35
-	defaultValue := 30
+	measurement := mqttapi.MoistureMeasurement{
+		SensorID:     "plants/Plant1/moisture",
+		Value:        35.5,
+		Unit:         mqttapi.UnitRelativeHumidity,
+		DefaultValue: 30,
+	}
 
 	mockBroker.EXPECT().Publish(
 		path.Join("/gateways", gateway.thingName, "plants", plantID, "moisture"),
@@ -159,7 +218,429 @@ func TestForwardMoistureMeasurement(t *testing.T) {
 		gomock.Any(),
 	).Return(mockToken).Times(1)
 
-	if err := gateway.ForwardMoistureMeasurement(ctx, plantID, measurement, defaultValue); err != nil {
+	if err := gateway.ForwardMoistureMeasurement(ctx, plantID, measurement); err != nil {
 		t.Fatalf("unexpected error during ForwardMoistureMeasurement: %v", err)
 	}
 }
+
+// TestForwardTemperatureMeasurementLegacy checks that measurements are sent
+// in the integer-only format which existing cloud backends expect if the legacy payload format is selected.
+func TestForwardTemperatureMeasurementLegacy(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockClient(ctrl)
+	mockToken := NewMockToken(ctrl)
+
+	mockToken.EXPECT().Wait().Return(true)
+	mockToken.EXPECT().Error().Return(nil)
+
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: mockBroker, payloadFormat: PayloadFormatLegacy})
+
+	var payload []byte
+	mockBroker.EXPECT().Publish(gomock.Any(), byte(0), false, gomock.Any()).DoAndReturn(
+		func(topic string, qos byte, retained bool, msg interface{}) *MockToken {
+			payload = msg.([]byte)
+
+			return mockToken
+		},
+	).Times(1)
+
+	if err := gateway.ForwardTemperatureMeasurement(ctx, "Room1", mqttapi.TemperatureMeasurement{
+		Value:        25.7,
+		Unit:         mqttapi.UnitCelsius,
+		DefaultValue: 20,
+		Timestamp:    1000,
+	}); err != nil {
+		t.Fatalf("unexpected error during ForwardTemperatureMeasurement: %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatalf("unexpected error during Unmarshal: %v", err)
+	}
+
+	if len(fields) != 3 || fields["measurement"] != float64(25) || fields["default"] != float64(20) || fields["timestamp"] != float64(1000) {
+		t.Fatalf("expected legacy payload, got %s", payload)
+	}
+}
+
+// TestForwardTemperatureMeasurementBuffered checks that measurements are buffered
+// instead of being published while the broker is unreachable.
+func TestForwardTemperatureMeasurementBuffered(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockClient(ctrl)
+
+	mockBroker.EXPECT().IsConnectionOpen().Return(false).Times(1)
+	mockBroker.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	buffer := queue.NewQueue(t.TempDir(), 0, 0)
+	if err := queue.OpenQueue(buffer); err != nil {
+		t.Fatalf("unexpected error during OpenQueue: %v", err)
+	}
+
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: mockBroker, buffer: buffer})
+
+	if err := gateway.ForwardTemperatureMeasurement(ctx, "Room1", mqttapi.TemperatureMeasurement{Value: 25, DefaultValue: 20}); err != nil {
+		t.Fatalf("unexpected error during ForwardTemperatureMeasurement: %v", err)
+	}
+
+	if length, err := buffer.Len(); err != nil || length != 1 {
+		t.Fatalf("expected measurement to be buffered, got length %v and error %v", length, err)
+	}
+}
+
+// TestForwardTemperatureMeasurementDrained checks that measurements which are buffered while the broker is reachable,
+// i.e. since older ones are still waiting to be replayed, are published without waiting for a reconnect.
+func TestForwardTemperatureMeasurementDrained(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockClient(ctrl)
+	mockToken := NewMockToken(ctrl)
+
+	mockToken.EXPECT().Wait().Return(true).AnyTimes()
+	mockToken.EXPECT().Error().Return(nil).AnyTimes()
+
+	published := make(chan string, 2)
+	mockBroker.EXPECT().IsConnectionOpen().Return(true).AnyTimes()
+	mockBroker.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+		published <- topic
+
+		return mockToken
+	}).Times(2)
+
+	buffer := queue.NewQueue(t.TempDir(), 0, 0)
+	if err := queue.OpenQueue(buffer); err != nil {
+		t.Fatalf("unexpected error during OpenQueue: %v", err)
+	}
+
+	if err := buffer.Push(queue.Entry{Topic: "/gateways/TestThing/rooms/Room1/temperature", QoS: 1}); err != nil {
+		t.Fatalf("unexpected error during Push: %v", err)
+	}
+
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: mockBroker, buffer: buffer})
+
+	if err := gateway.ForwardTemperatureMeasurement(ctx, "Room2", mqttapi.TemperatureMeasurement{Value: 25, DefaultValue: 20}); err != nil {
+		t.Fatalf("unexpected error during ForwardTemperatureMeasurement: %v", err)
+	}
+
+	for _, expected := range []string{"/gateways/TestThing/rooms/Room1/temperature", "/gateways/TestThing/rooms/Room2/temperature"} {
+		select {
+		case topic := <-published:
+			if topic != expected {
+				t.Fatalf("expected %v to be published, got %v", expected, topic)
+			}
+
+		case <-time.After(time.Second):
+			t.Fatalf("timed out while waiting for %v to be published", expected)
+		}
+	}
+}
+
+// TestPresenceWhileDisconnected checks that hubs can connect, register and disconnect while the broker is unreachable,
+// and that the latest presence of each topic is published once it is reachable again.
+func TestPresenceWhileDisconnected(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockClient(ctrl)
+	mockToken := NewMockToken(ctrl)
+
+	mockToken.EXPECT().Wait().Return(true).AnyTimes()
+	mockToken.EXPECT().Error().Return(nil).AnyTimes()
+
+	connected := false
+	mockBroker.EXPECT().IsConnectionOpen().DoAndReturn(func() bool {
+		return connected
+	}).AnyTimes()
+
+	published := map[string][]byte{}
+	mockBroker.EXPECT().Publish(gomock.Any(), byte(1), true, gomock.Any()).DoAndReturn(func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+		published[topic] = payload.([]byte)
+
+		return mockToken
+	}).AnyTimes()
+
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: mockBroker})
+
+	if err := ConnectHub(gateway, "testremote", ""); err != nil {
+		t.Fatalf("unexpected error during ConnectHub: %v", err)
+	}
+
+	if err := gateway.RegisterFans(ctx, []string{"Room1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterFans: %v", err)
+	}
+
+	if err := DisconnectHub(gateway, "testremote"); err != nil {
+		t.Fatalf("unexpected error during DisconnectHub: %v", err)
+	}
+
+	if len(published) != 0 {
+		t.Fatalf("expected nothing to be published while disconnected, got %v", published)
+	}
+
+	connected = true
+	if err := gateway.publishPendingPresence(); err != nil {
+		t.Fatalf("unexpected error during publishPendingPresence: %v", err)
+	}
+
+	if status, ok := published["/gateways/TestThing/hubs/testremote/status"]; !ok || len(status) != 0 {
+		t.Fatalf("expected retained status of disconnected hub to be cleared, got %s", status)
+	}
+
+	availability := mqttapi.ActuatorAvailability{}
+	if err := json.Unmarshal(published["/gateways/TestThing/rooms/Room1/fan/availability"], &availability); err != nil || availability.Available {
+		t.Fatalf("expected fan to be unavailable, got %v and error %v", availability, err)
+	}
+}
+
+// TestDisconnectHub checks that the rooms and plants of a hub are unregistered once it disconnects,
+// while registrations of other hubs are kept.
+func TestDisconnectHub(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+	otherCtx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "otherremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockClient(ctrl)
+	mockToken := NewMockToken(ctrl)
+
+	mockToken.EXPECT().Wait().Return(true).AnyTimes()
+	mockToken.EXPECT().Error().Return(nil).AnyTimes()
+
+	mockBroker.EXPECT().IsConnectionOpen().Return(true).AnyTimes()
+
+	// The hub's retained status and config have to be cleared
+	mockBroker.EXPECT().Publish("/gateways/TestThing/hubs/testremote/status", byte(1), true, []byte{}).Return(mockToken).Times(1)
+	mockBroker.EXPECT().Publish("/gateways/TestThing/hubs/testremote/config", byte(1), true, []byte{}).Return(mockToken).Times(1)
+	mockBroker.EXPECT().Publish(gomock.Any(), byte(1), true, gomock.Any()).Return(mockToken).AnyTimes()
+
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: mockBroker})
+
+	if err := ConnectHub(gateway, "testremote", ""); err != nil {
+		t.Fatalf("unexpected error during ConnectHub: %v", err)
+	}
+
+	if err := gateway.RegisterFans(ctx, []string{"Room1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterFans: %v", err)
+	}
+
+	if err := gateway.RegisterSprinklers(ctx, []string{"Plant1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterSprinklers: %v", err)
+	}
+
+	if err := gateway.RegisterFans(otherCtx, []string{"Room2"}); err != nil {
+		t.Fatalf("unexpected error during RegisterFans: %v", err)
+	}
+
+	if err := DisconnectHub(gateway, "testremote"); err != nil {
+		t.Fatalf("unexpected error during DisconnectHub: %v", err)
+	}
+
+	if _, ok := gateway.fans.peers["Room1"]; ok {
+		t.Fatalf("fan with id Room1 was not unregistered")
+	}
+
+	if _, ok := gateway.sprinklers.peers["Plant1"]; ok {
+		t.Fatalf("sprinkler with id Plant1 was not unregistered")
+	}
+
+	if _, ok := gateway.fans.peers["Room2"]; !ok {
+		t.Fatalf("fan with id Room2 of another hub was unregistered")
+	}
+}
+
+// TestRegisterFansDuplicate checks that a room which two hubs register is handled according to the registration policy.
+func TestRegisterFansDuplicate(t *testing.T) {
+	tests := []struct {
+		policy            RegistrationPolicy
+		expectedErr       error
+		expectedCommanded []string
+	}{
+		{
+			policy:            RegistrationPolicyReject,
+			expectedErr:       ErrDuplicateRegistration,
+			expectedCommanded: []string{"hub1"},
+		},
+		{
+			policy:            RegistrationPolicyLastWins,
+			expectedCommanded: []string{"hub2"},
+		},
+		{
+			policy:            RegistrationPolicyFanOut,
+			expectedCommanded: []string{"hub1", "hub2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			hub1Ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "hub1")
+			hub2Ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "hub2")
+
+			gateway := newTestGateway(context.Background(), testGatewayOptions{registrationPolicy: tt.policy})
+
+			commanded := []string{}
+			gateway.Peers = func() map[string]HubRemote {
+				peers := map[string]HubRemote{}
+				for _, peerID := range []string{"hub1", "hub2"} {
+					peerID := peerID
+
+					peers[peerID] = HubRemote{
+						SetFanOn: func(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+							commanded = append(commanded, peerID)
+
+							return nil
+						},
+					}
+				}
+
+				return peers
+			}
+
+			if err := gateway.RegisterFans(hub1Ctx, []string{"Room1"}); err != nil {
+				t.Fatalf("unexpected error during RegisterFans: %v", err)
+			}
+
+			if err := gateway.RegisterFans(hub2Ctx, []string{"Room1"}); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected error %v during RegisterFans, got %v", tt.expectedErr, err)
+			}
+
+			if err := gateway.setFanOn(context.Background(), "Room1", true, 0); err != nil {
+				t.Fatalf("unexpected error during setFanOn: %v", err)
+			}
+
+			if len(commanded) != len(tt.expectedCommanded) {
+				t.Fatalf("expected hubs %v to be commanded, got %v", tt.expectedCommanded, commanded)
+			}
+
+			for i, peerID := range tt.expectedCommanded {
+				if commanded[i] != peerID {
+					t.Fatalf("expected hubs %v to be commanded, got %v", tt.expectedCommanded, commanded)
+				}
+			}
+		})
+	}
+}
+
+// TestUnregisterFansFallsBack checks that a room stays registered as long as one of the hubs which registered it has not unregistered it.
+func TestUnregisterFansFallsBack(t *testing.T) {
+	hub1Ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "hub1")
+	hub2Ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "hub2")
+
+	gateway := newTestGateway(context.Background(), testGatewayOptions{})
+
+	for _, ctx := range []context.Context{hub1Ctx, hub2Ctx} {
+		if err := gateway.RegisterFans(ctx, []string{"Room1"}); err != nil {
+			t.Fatalf("unexpected error during RegisterFans: %v", err)
+		}
+	}
+
+	if err := gateway.UnregisterFans(hub2Ctx, []string{"Room1"}); err != nil {
+		t.Fatalf("unexpected error during UnregisterFans: %v", err)
+	}
+
+	if peers := gateway.fans.getPeers("Room1", RegistrationPolicyLastWins); len(peers) != 1 || peers[0] != "hub1" {
+		t.Fatalf("expected Room1 to fall back to hub1, got %v", peers)
+	}
+}
+
+// TestAllowlist checks that hubs can only register and report on the rooms and plants their identity is allowed to use.
+func TestAllowlist(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+	anonymousCtx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "anonymousremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockClient(ctrl)
+	mockToken := NewMockToken(ctrl)
+
+	mockToken.EXPECT().Wait().Return(true).AnyTimes()
+	mockToken.EXPECT().Error().Return(nil).AnyTimes()
+
+	mockBroker.EXPECT().IsConnectionOpen().Return(true).AnyTimes()
+	mockBroker.EXPECT().Publish(gomock.Any(), byte(1), true, gomock.Any()).Return(mockToken).AnyTimes()
+
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: mockBroker, allowlist: Allowlist{
+		"greenhouse-1": {
+			Rooms: []string{"greenhouse-1.*"},
+		},
+	}})
+
+	if err := ConnectHub(gateway, "testremote", "greenhouse-1"); err != nil {
+		t.Fatalf("unexpected error during ConnectHub: %v", err)
+	}
+
+	if err := ConnectHub(gateway, "anonymousremote", ""); err != nil {
+		t.Fatalf("unexpected error during ConnectHub: %v", err)
+	}
+
+	if err := gateway.RegisterFans(ctx, []string{"greenhouse-1.Room1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterFans: %v", err)
+	}
+
+	if err := gateway.RegisterFans(ctx, []string{"greenhouse-1.Room2", "greenhouse-2.Room1"}); !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("expected error %v for room of another hub, got %v", ErrNotAllowed, err)
+	}
+
+	if _, ok := gateway.fans.peers["greenhouse-1.Room2"]; ok {
+		t.Fatalf("fan with id greenhouse-1.Room2 was registered even though the registration was denied")
+	}
+
+	if err := gateway.RegisterSprinklers(ctx, []string{"greenhouse-1.Plant1"}); !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("expected error %v for plant, got %v", ErrNotAllowed, err)
+	}
+
+	// The hub has to recognise the rejection as permanent so that it doesn't retry the measurement forever
+	if err := gateway.ForwardTemperatureMeasurement(ctx, "greenhouse-2.Room1", mqttapi.TemperatureMeasurement{}); !errors.Is(err, ErrNotAllowed) || !isRejected(errors.New(err.Error())) {
+		t.Fatalf("expected error %v for measurement of room of another hub, got %v", ErrNotAllowed, err)
+	}
+
+	if err := gateway.RegisterFans(anonymousCtx, []string{"greenhouse-1.Room1"}); !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("expected error %v for hub without identity, got %v", ErrNotAllowed, err)
+	}
+}
+
+// TestGetCommandRuntime checks that the runtime of a command is derived from its duration and deadline.
+func TestGetCommandRuntime(t *testing.T) {
+	now := time.UnixMilli(1690000000000)
+
+	for _, tt := range []struct {
+		name    string
+		state   mqttapi.FanState
+		runtime time.Duration
+		err     error
+	}{
+		{"without duration or deadline", mqttapi.FanState{On: true}, 0, nil},
+		{"with duration", mqttapi.FanState{On: true, Duration: 120000}, 2 * time.Minute, nil},
+		{"with deadline", mqttapi.FanState{On: true, Deadline: 1690000060000}, time.Minute, nil},
+		{"with earlier deadline", mqttapi.FanState{On: true, Duration: 120000, Deadline: 1690000060000}, time.Minute, nil},
+		{"with earlier duration", mqttapi.FanState{On: true, Duration: 30000, Deadline: 1690000060000}, 30 * time.Second, nil},
+		{"with passed deadline", mqttapi.FanState{On: true, Deadline: 1690000000000}, 0, ErrDeadlinePassed},
+		{"with negative duration", mqttapi.FanState{On: true, Duration: -1}, 0, ErrInvalidCommand},
+		{"turning off", mqttapi.FanState{On: false, Duration: 120000}, 0, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			runtime, err := getCommandRuntime(tt.state, now)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if runtime != tt.runtime {
+				t.Fatalf("expected runtime %v, got %v", tt.runtime, runtime)
+			}
+		})
+	}
+}
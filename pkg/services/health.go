@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+)
+
+type deviceHealth struct {
+	failures int
+
+	reported,
+	healthy bool
+}
+
+// updateHealth records the result of accessing a device and returns its amount of consecutive failures.
+// A device is degraded once it failed maxFailures times in a row; changes of its health are reported to the gateway.
+func (w *Hub) updateHealth(
+	logger *slog.Logger,
+	device string,
+	err error,
+	report func(ctx context.Context, gateway *GatewayRemote, health mqttapi.DeviceHealth) error,
+) int {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+
+	health, ok := w.health[device]
+	if !ok {
+		health = &deviceHealth{}
+
+		w.health[device] = health
+	}
+
+	if err == nil {
+		health.failures = 0
+	} else {
+		health.failures++
+
+		logger.Debug("Could not access device, retrying", "failures", health.failures, logging.KeyError, err)
+	}
+
+	// Only report a device as healthy once it has been accessed successfully
+	healthy := health.failures < w.maxFailures
+	if (health.reported && health.healthy == healthy) || (err != nil && healthy) {
+		return health.failures
+	}
+
+	if !healthy {
+		logger.Warn("Device is degraded", "failures", health.failures, logging.KeyError, err)
+	} else if health.reported {
+		logger.Info("Device has recovered")
+	}
+
+	health.reported = true
+	health.healthy = healthy
+
+	state := mqttapi.DeviceHealth{
+		Healthy:   healthy,
+		Failures:  health.failures,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if err != nil {
+		state.Error = err.Error()
+	}
+
+	w.queueDelivery(func(ctx context.Context, gateway *GatewayRemote) error {
+		return report(ctx, gateway, state)
+	})
+
+	return health.failures
+}
@@ -2,13 +2,18 @@ package services
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
-	"log"
+	"log/slog"
+	"path"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/drivers"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+	"github.com/pojntfx/green-guardian-gateway/pkg/metrics"
+	"github.com/pojntfx/green-guardian-gateway/pkg/probes"
 	"gitlab.mi.hdm-stuttgart.de/iotee/go-iotee"
 )
 
@@ -18,331 +23,841 @@ var (
 
 	ErrTemperatureReadTimedOut = errors.New("temperature read timed out")
 	ErrMoistureReadTimedOut    = errors.New("moisture read timed out")
+
+	ErrMockRequiresIoTee = errors.New("mock mode requires temperature sensors to use the IoTee or sim driver")
+
+	ErrUnknownTemperatureUnit = errors.New("unknown temperature unit")
+
+	ErrNotLinked = errors.New("not linked to a gateway")
+
+	// ErrRejected marks errors of calls to the gateway which fail again if they are retried, i.e. since the hub isn't allowed to use a room
+	ErrRejected = errors.New("rejected")
+
+	ErrInvalidNamespace = errors.New("namespace must not contain /, +, # or " + NamespaceSeparator)
 )
 
+const (
+	// NamespaceSeparator separates a hub's namespace from the IDs of its rooms and plants, i.e. greenhouse-1.1 for room 1
+	NamespaceSeparator = "."
+)
+
+// ValidateNamespace checks whether a namespace can be used in topics.
+func ValidateNamespace(namespace string) error {
+	if strings.ContainsAny(namespace, "/+#"+NamespaceSeparator) {
+		return ErrInvalidNamespace
+	}
+
+	return nil
+}
+
+// ParseTemperatureUnit parses a temperature unit (celsius or fahrenheit) into the unit sent with measurements.
+func ParseTemperatureUnit(unit string) (string, error) {
+	switch unit {
+	case "celsius":
+		return mqttapi.UnitCelsius, nil
+
+	case "fahrenheit":
+		return mqttapi.UnitFahrenheit, nil
+
+	default:
+		return "", ErrUnknownTemperatureUnit
+	}
+}
+
+// Room is a room whose temperature is measured and/or which has a fan.
+type Room struct {
+	Fan               drivers.Actuator
+	TemperatureSensor drivers.Sensor
+
+	// The expected temperature which is sent with each measurement
+	DefaultTemperature float64
+
+	// Maximum amount of time the fan stays on after it has been turned on; if 0, it stays on until it is turned off
+	FanMaxRuntime time.Duration
+
+	// Interval in which the temperature is measured; if 0, the hub's measure interval is used
+	MeasureInterval time.Duration
+}
+
+// Plant is a plant whose moisture is measured and/or which has a sprinkler.
+type Plant struct {
+	Sprinkler      drivers.Actuator
+	MoistureSensor drivers.Sensor
+
+	// The expected moisture which is sent with each measurement
+	DefaultMoisture float64
+
+	// Maximum amount of time the sprinkler stays on after it has been turned on; if 0, it stays on until it is turned off
+	SprinklerMaxRuntime time.Duration
+
+	// Interval in which the moisture is measured; if 0, the hub's measure interval is used
+	MeasureInterval time.Duration
+}
+
 type HubRemote struct {
-	SetFanOn       func(ctx context.Context, roomID string, on bool) error
-	SetSprinklerOn func(ctx context.Context, plantID string, on bool) error
+	SetFanOn       func(ctx context.Context, roomID string, on bool, runtime time.Duration) error
+	SetSprinklerOn func(ctx context.Context, plantID string, on bool, runtime time.Duration) error
+
+	SetHubConfig   func(ctx context.Context, config mqttapi.HubConfig) (mqttapi.HubConfigState, error)
+	SetRoomConfig  func(ctx context.Context, roomID string, config mqttapi.RoomConfig) (*mqttapi.RoomConfigState, error)
+	SetPlantConfig func(ctx context.Context, plantID string, config mqttapi.PlantConfig) (*mqttapi.PlantConfigState, error)
+}
+
+// delivery is a call to the gateway which is queued until it has succeeded
+type delivery struct {
+	id      uint64
+	deliver func(ctx context.Context, gateway *GatewayRemote) error
+}
+
+// worker is a goroutine which can be stopped individually, i.e. because its sensor has been removed
+type worker struct {
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 type Hub struct {
-	verbose bool
+	rpcLogger,
+	workerLogger *slog.Logger
+
+	namespace string
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
 	errs chan error
 
-	fans               map[string]utils.IoTee
-	temperatureSensors map[string]utils.IoTee
+	gateway    *GatewayRemote
+	gatewayCtx context.Context
+	unlink     context.CancelFunc
+
+	deliveries     []delivery
+	deliveryID     uint64
+	maxDeliveries  int
+	deliveriesLock sync.Mutex
+	deliveriesCh   chan struct{}
+
+	rooms           map[string]Room
+	temperatureUnit string
 
-	defaultTemperature int
+	plants map[string]Plant
 
-	sprinklers      map[string]utils.IoTee
-	moistureSensors map[string]utils.IoTee
+	// Configs which the gateway has set while the hub is running; they take precedence over the rooms' and plants' own values
+	hubConfig    mqttapi.HubConfig
+	roomConfigs  map[string]mqttapi.RoomConfig
+	plantConfigs map[string]mqttapi.PlantConfig
 
-	defaultMoisture int
+	topologyLock sync.RWMutex
+
+	// Prevents workers from being restarted concurrently
+	reloadLock sync.Mutex
 
 	measureInterval,
 	measureTimeout time.Duration
 
-	measureLock sync.Mutex
+	// Locks by device key, so that sensors which share a device aren't read at the same time
+	measureLocks     map[string]*sync.Mutex
+	measureLocksLock sync.Mutex
+
+	maxFailures     int
+	maxRetryBackoff time.Duration
+
+	health     map[string]*deviceHealth
+	healthLock sync.Mutex
+
+	workers     map[string]*worker
+	workersLock sync.Mutex
+	workerWg    sync.WaitGroup
+
+	// Timers which turn actuators off once their runtime has elapsed by the actuators' keys
+	shutOffs     map[string]*shutOff
+	shutOffsLock sync.Mutex
 
-	workerWg sync.WaitGroup
+	// Locks by the actuators' keys, so that commands for the same actuator are applied one after another
+	// while actuators of slow devices don't hold up the others
+	actuatorLocks map[string]*sync.Mutex
 
-	mock int
+	mock float64
 }
 
 func NewHub(
-	verbose bool,
+	logger *slog.Logger,
 	ctx context.Context,
 
-	fans map[string]utils.IoTee,
-	temperatureSensors map[string]utils.IoTee,
-	defaultTemperature int,
+	namespace string,
 
-	sprinklers map[string]utils.IoTee,
-	moistureSensors map[string]utils.IoTee,
-	defaultMoisture int,
+	rooms map[string]Room,
+	temperatureUnit string,
+
+	plants map[string]Plant,
 
 	measureInterval,
 	measureTimeout time.Duration,
 
-	mock int,
+	maxFailures int,
+	maxRetryBackoff time.Duration,
+
+	maxDeliveries int,
+
+	mock float64,
 ) *Hub {
 	cancellableCtx, cancel := context.WithCancel(ctx)
 
 	return &Hub{
-		verbose: verbose,
+		rpcLogger:    logging.WithSubsystem(logger, logging.SubsystemRPC),
+		workerLogger: logging.WithSubsystem(logger, logging.SubsystemHubWorker),
+
+		namespace: namespace,
 
 		ctx:    cancellableCtx,
 		cancel: cancel,
 
 		errs: make(chan error),
 
-		fans:               fans,
-		temperatureSensors: temperatureSensors,
+		maxDeliveries: maxDeliveries,
+		deliveriesCh:  make(chan struct{}, 1),
 
-		defaultTemperature: defaultTemperature,
+		rooms:           rooms,
+		temperatureUnit: temperatureUnit,
 
-		sprinklers:      sprinklers,
-		moistureSensors: moistureSensors,
+		plants: plants,
 
-		defaultMoisture: defaultMoisture,
+		roomConfigs:  map[string]mqttapi.RoomConfig{},
+		plantConfigs: map[string]mqttapi.PlantConfig{},
 
 		measureInterval: measureInterval,
 		measureTimeout:  measureTimeout,
 
+		maxFailures:     maxFailures,
+		maxRetryBackoff: maxRetryBackoff,
+
+		measureLocks: map[string]*sync.Mutex{},
+
+		health: map[string]*deviceHealth{},
+
+		workers: map[string]*worker{},
+
+		shutOffs: map[string]*shutOff{},
+
+		actuatorLocks: map[string]*sync.Mutex{},
+
 		mock: mock,
 	}
 }
 
-// SetFanOn turns the specified fan on or off.
-func (w *Hub) SetFanOn(ctx context.Context, roomID string, on bool) error {
-	if w.verbose {
-		// Log the function call if verbose logging is enabled.
-		log.Printf("SetFanOn(roomID=%v, on=%v)", roomID, on)
+// getRoom returns the room with the given ID, using the values which the gateway has set for it
+func (w *Hub) getRoom(roomID string) Room {
+	w.topologyLock.RLock()
+	defer w.topologyLock.RUnlock()
+
+	return w.applyRoomConfig(roomID, w.rooms[roomID])
+}
+
+// getPlant returns the plant with the given ID, using the values which the gateway has set for it
+func (w *Hub) getPlant(plantID string) (Plant, bool) {
+	w.topologyLock.RLock()
+	defer w.topologyLock.RUnlock()
+
+	plant, ok := w.plants[plantID]
+
+	return w.applyPlantConfig(plantID, plant), ok
+}
+
+// getGatewayID returns the ID under which a room or plant is known to the gateway
+func (w *Hub) getGatewayID(id string) string {
+	if w.namespace == "" {
+		return id
 	}
 
-	// Find the fan in the map using the roomID.
-	fan, ok := w.fans[roomID]
-	if !ok {
-		// If the fan doesn't exist, return an error.
-		return ErrNoSuchRoom
+	return w.namespace + NamespaceSeparator + id
+}
+
+// getLocalID returns the ID of the room or plant which the gateway knows under the given ID
+func (w *Hub) getLocalID(gatewayID string) (string, bool) {
+	if w.namespace == "" {
+		return gatewayID, true
+	}
+
+	return strings.CutPrefix(gatewayID, w.namespace+NamespaceSeparator)
+}
+
+// getRoomIDs returns the gateway IDs of all rooms with a fan
+func (w *Hub) getRoomIDs() []string {
+	w.topologyLock.RLock()
+	defer w.topologyLock.RUnlock()
+
+	roomIDs := []string{}
+	for roomID, room := range w.rooms {
+		if room.Fan != nil {
+			roomIDs = append(roomIDs, w.getGatewayID(roomID))
+		}
 	}
 
-	// Create a new IoT message.
-	req := iotee.NewMessage(iotee.MessageTypeRGBLED, 4)
+	return roomIDs
+}
+
+// getPlantIDs returns the gateway IDs of all plants with a sprinkler
+func (w *Hub) getPlantIDs() []string {
+	w.topologyLock.RLock()
+	defer w.topologyLock.RUnlock()
+
+	plantIDs := []string{}
+	for plantID, plant := range w.plants {
+		if plant.Sprinkler != nil {
+			plantIDs = append(plantIDs, w.getGatewayID(plantID))
+		}
+	}
+
+	return plantIDs
+}
+
+// SetFanOn turns the specified fan on or off.
+// If runtime is set, the fan is turned off again after it has elapsed; it is never kept on for longer than its maximum runtime.
+func (w *Hub) SetFanOn(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+	withPeerID(w.rpcLogger, ctx).Debug("SetFanOn", logging.KeyRoomID, roomID, "on", on, "runtime", runtime)
 
-	// Set the intensity depending on the 'on' variable.
-	intensity := byte(0)
-	if on {
-		intensity = 255
+	// Find the room's fan in the map using the roomID without the hub's namespace.
+	localRoomID, ok := w.getLocalID(roomID)
+	if !ok {
+		return ErrNoSuchRoom
 	}
 
-	// Set the data of the message.
-	req.Data = []byte{intensity, 255, 0, 0}
+	room := w.getRoom(localRoomID)
+	if room.Fan == nil {
+		// If the fan doesn't exist, return an error.
+		return ErrNoSuchRoom
+	}
 
-	// Transmit the message using the fan.
-	return fan.Transmit(&req)
+	// Switch the fan using its driver and turn it off again once its runtime has elapsed.
+	return w.switchActuator(ctx, w.workerLogger.With(logging.KeyRoomID, localRoomID), path.Join("rooms", localRoomID, "fan"), room.Fan, on, getRuntime(runtime, room.FanMaxRuntime), func(ctx context.Context, gateway *GatewayRemote) error {
+		return gateway.ReportFanState(ctx, w.getGatewayID(localRoomID), false)
+	})
 }
 
 // SetSprinklerOn turns the specified sprinkler on or off.
-func (w *Hub) SetSprinklerOn(ctx context.Context, roomID string, on bool) error {
-	if w.verbose {
-		// Log the function call if verbose logging is enabled.
-		log.Printf("SetSprinklerOn(roomID=%v, on=%v)", roomID, on)
-	}
+// If runtime is set, the sprinkler is turned off again after it has elapsed; it is never kept on for longer than its maximum runtime.
+func (w *Hub) SetSprinklerOn(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+	withPeerID(w.rpcLogger, ctx).Debug("SetSprinklerOn", logging.KeyPlantID, roomID, "on", on, "runtime", runtime)
 
-	// Find the sprinkler in the map using the roomID.
-	sprinkler, ok := w.sprinklers[roomID]
+	// Find the plant's sprinkler in the map using the roomID without the hub's namespace.
+	localPlantID, ok := w.getLocalID(roomID)
 	if !ok {
+		return ErrNoSuchRoom
+	}
+
+	plant, _ := w.getPlant(localPlantID)
+	if plant.Sprinkler == nil {
 		// If the sprinkler doesn't exist, return an error.
 		return ErrNoSuchRoom
 	}
 
-	// Create a new IoT message.
-	req := iotee.NewMessage(iotee.MessageTypeRGBLED, 4)
+	// Switch the sprinkler using its driver and turn it off again once its runtime has elapsed.
+	return w.switchActuator(ctx, w.workerLogger.With(logging.KeyPlantID, localPlantID), path.Join("plants", localPlantID, "sprinkler"), plant.Sprinkler, on, getRuntime(runtime, plant.SprinklerMaxRuntime), func(ctx context.Context, gateway *GatewayRemote) error {
+		return gateway.ReportSprinklerState(ctx, w.getGatewayID(localPlantID), false)
+	})
+}
+
+// queueDelivery queues a call to the gateway, dropping the oldest queued call if the queue is full.
+func (w *Hub) queueDelivery(deliver func(ctx context.Context, gateway *GatewayRemote) error) {
+	w.deliveriesLock.Lock()
+	w.deliveryID++
+	w.deliveries = append(w.deliveries, delivery{
+		id:      w.deliveryID,
+		deliver: deliver,
+	})
+
+	if w.maxDeliveries > 0 && len(w.deliveries) > w.maxDeliveries {
+		w.rpcLogger.Warn("Delivery queue is full, dropping oldest queued measurements", "dropped", len(w.deliveries)-w.maxDeliveries)
 
-	// Set the intensity depending on the 'on' variable.
-	intensity := byte(0)
-	if on {
-		intensity = 255
+		w.deliveries = w.deliveries[len(w.deliveries)-w.maxDeliveries:]
 	}
+	w.deliveriesLock.Unlock()
 
-	// Set the data of the message.
-	req.Data = []byte{intensity, 0, 255, 0}
+	w.notifyDeliveries()
+}
 
-	// Transmit the message using the sprinkler.
-	return sprinkler.Transmit(&req)
+// isRejected returns whether the gateway has rejected a call permanently.
+// Errors of calls to the gateway arrive as plain strings, so they can only be recognised by their message.
+func isRejected(err error) bool {
+	return errors.Is(err, ErrRejected) || strings.HasPrefix(err.Error(), ErrRejected.Error()+":")
 }
 
-// OpenHub fires up the hub by registering fans and sprinklers with the gateway, and setting up temperature and moisture sensor handling.
-func OpenHub(hub *Hub, ctx context.Context, gateway *GatewayRemote) error {
-	// Prepare the list of room IDs
-	roomIDs := []string{}
-	for roomID := range hub.fans {
-		roomIDs = append(roomIDs, roomID)
+// notifyDeliveries wakes up the delivery worker
+func (w *Hub) notifyDeliveries() {
+	select {
+	case w.deliveriesCh <- struct{}{}:
+	default:
 	}
+}
 
-	// Register fans if any.
-	if len(hub.fans) > 0 {
-		if err := gateway.RegisterFans(ctx, roomIDs); err != nil {
-			return err
+// deliverQueued sends queued calls to the gateway in order while the hub is linked to it.
+func (w *Hub) deliverQueued() {
+	defer w.workerWg.Done()
+
+	for {
+		w.deliveriesLock.Lock()
+		gateway := w.gateway
+		gatewayCtx := w.gatewayCtx
+
+		var next *delivery
+		if gateway != nil && len(w.deliveries) > 0 {
+			next = &w.deliveries[0]
 		}
+		w.deliveriesLock.Unlock()
+
+		// Wait until there is something to deliver and a gateway to deliver it to
+		if next == nil {
+			select {
+			case <-w.ctx.Done():
+				return
+
+			case <-w.deliveriesCh:
+				continue
+			}
+		}
+
+		// Calls on a broken link might never return, so stop waiting for them once the link is gone
+		res := make(chan error, 1)
+		go func(next delivery) {
+			res <- next.deliver(gatewayCtx, gateway)
+		}(*next)
+
+		select {
+		case <-w.ctx.Done():
+			return
+
+		case <-gatewayCtx.Done():
+			continue
+
+		case err := <-res:
+			// Retrying a call which the gateway has rejected would block all of the calls which have been queued after it
+			if err != nil && isRejected(err) {
+				w.rpcLogger.Warn("Gateway rejected measurement, dropping it", logging.KeyError, err)
+			} else if err != nil {
+				w.rpcLogger.Debug("Could not deliver measurement to gateway, retrying", logging.KeyError, err)
+
+				select {
+				case <-w.ctx.Done():
+					return
+
+				case <-gatewayCtx.Done():
+				case <-time.After(w.getMeasureInterval()):
+				}
+
+				continue
+			}
+		}
+
+		// Remove the delivered call unless it has been dropped from the full queue in the meantime
+		w.deliveriesLock.Lock()
+		if len(w.deliveries) > 0 && w.deliveries[0].id == next.id {
+			w.deliveries = w.deliveries[1:]
+		}
+		w.deliveriesLock.Unlock()
 	}
+}
 
-	// Register sprinklers if any.
-	if len(hub.sprinklers) > 0 {
-		if err := gateway.RegisterSprinklers(ctx, roomIDs); err != nil {
-			return err
+// measure takes a measurement from the sensor with the given key, giving up after the measure timeout or once ctx is done
+func (w *Hub) measure(ctx context.Context, key string, sensor drivers.Sensor, errTimedOut error) (float64, error) {
+	// Sensors of other devices are read concurrently
+	lock := w.getMeasureLock(key, sensor)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, w.getMeasureTimeout())
+	defer cancel()
+
+	start := time.Now()
+	measurement, err := sensor.Read(ctx)
+	metrics.SensorReadDuration.WithLabelValues(key).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		if errors.Is(err, drivers.ErrReadTimedOut) || errors.Is(err, context.DeadlineExceeded) {
+			metrics.SensorReadTimeouts.WithLabelValues(key).Inc()
+
+			return 0, errTimedOut
 		}
+
+		return 0, err
 	}
 
-	// If mock mode is on, setup data handlers accordingly.
-	if hub.mock > 0 {
-		// When mocking, we treat all temperatures as the same
-		for roomID, temperatureSensor := range hub.temperatureSensors {
-			hub.workerWg.Add(1)
+	return measurement, nil
+}
 
-			go temperatureSensor.RxPump()
+// forwardTemperature queues a temperature measurement of a room for delivery to the gateway
+func (w *Hub) forwardTemperature(roomID string, value float64) {
+	gatewayRoomID := w.getGatewayID(roomID)
 
-			go func(roomID string, temperatureSensor utils.IoTee) {
-				defer hub.workerWg.Done()
+	measurement := mqttapi.TemperatureMeasurement{
+		SensorID:     path.Join("rooms", gatewayRoomID, "temperature"),
+		Value:        value,
+		Unit:         w.temperatureUnit,
+		DefaultValue: w.getRoom(roomID).DefaultTemperature,
+		Timestamp:    time.Now().UnixMilli(),
+	}
 
-				for {
-					select {
-					case <-hub.ctx.Done():
-						return
+	metrics.Temperature.WithLabelValues(roomID, w.temperatureUnit).Set(value)
 
-					case msg := <-temperatureSensor.RxChan():
-						if msg.MsgType == iotee.MessageTypeButton {
-							switch msg.Data[0] {
-							// Top left
-							case 'B':
-								if err := gateway.ForwardTemperatureMeasurement(ctx, roomID, hub.defaultTemperature+hub.mock, hub.defaultTemperature); err != nil {
-									hub.errs <- err
+	w.queueDelivery(func(ctx context.Context, gateway *GatewayRemote) error {
+		return gateway.ForwardTemperatureMeasurement(ctx, gatewayRoomID, measurement)
+	})
+}
 
-									return
-								}
+// forwardMoisture queues a moisture measurement of a plant for delivery to the gateway
+func (w *Hub) forwardMoisture(plantID string, value float64) {
+	plant, _ := w.getPlant(plantID)
+	gatewayPlantID := w.getGatewayID(plantID)
+
+	measurement := mqttapi.MoistureMeasurement{
+		SensorID:     path.Join("plants", gatewayPlantID, "moisture"),
+		Value:        value,
+		Unit:         mqttapi.UnitRelativeHumidity,
+		DefaultValue: plant.DefaultMoisture,
+		Timestamp:    time.Now().UnixMilli(),
+	}
 
-							// Bottom left
-							case 'Y':
-								if err := gateway.ForwardTemperatureMeasurement(ctx, roomID, hub.defaultTemperature-hub.mock, hub.defaultTemperature); err != nil {
-									hub.errs <- err
+	metrics.Moisture.WithLabelValues(plantID).Set(value)
 
-									return
-								}
+	w.queueDelivery(func(ctx context.Context, gateway *GatewayRemote) error {
+		return gateway.ForwardMoistureMeasurement(ctx, gatewayPlantID, measurement)
+	})
+}
+
+// startWorker runs a worker in the background until it is stopped using stopWorker or the hub is closed
+func (w *Hub) startWorker(key string, run func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(w.ctx)
 
-							// Top right
-							case 'A':
-								if err := gateway.ForwardMoistureMeasurement(ctx, roomID, hub.defaultMoisture-hub.mock, hub.defaultMoisture); err != nil {
-									hub.errs <- err
+	wk := &worker{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
 
-									return
-								}
+	w.workersLock.Lock()
+	w.workers[key] = wk
+	w.workersLock.Unlock()
+
+	w.workerWg.Add(1) // increment the WaitGroup counter by one
+
+	go func() {
+		defer w.workerWg.Done() // called at the end to notify that this goroutine is done
+		defer close(wk.done)
+
+		run(ctx)
+	}()
+}
+
+// stopWorker stops a worker and waits for it to return
+func (w *Hub) stopWorker(key string) {
+	w.workersLock.Lock()
+	wk, ok := w.workers[key]
+	delete(w.workers, key)
+	w.workersLock.Unlock()
+
+	if !ok {
+		return
+	}
 
-							// Bottom right
-							case 'X':
-								if err := gateway.ForwardMoistureMeasurement(ctx, roomID, hub.defaultMoisture+hub.mock, hub.defaultMoisture); err != nil {
-									hub.errs <- err
+	wk.cancel()
+	<-wk.done
 
-									return
-								}
+	// A sensor which is added again starts out with a clean health
+	w.healthLock.Lock()
+	delete(w.health, key)
+	w.healthLock.Unlock()
+}
+
+// startTemperatureWorker starts measuring the temperature of a room, or listening for button presses in mock mode
+func (w *Hub) startTemperatureWorker(roomID string, room Room) {
+	key := path.Join("rooms", roomID, "temperature")
+	logger := w.workerLogger.With(logging.KeyRoomID, roomID, logging.KeySensorID, key)
+
+	if w.mock > 0 {
+		// When mocking, we treat all temperatures as the same.
+		// The IoTee's messages are received into its RxChan since it has been opened, so workers which are restarted don't start another pump.
+		temperatureSensor := room.TemperatureSensor.(drivers.IoTeeDevice).IoTee()
+
+		w.startWorker(key, func(ctx context.Context) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+
+				case msg := <-temperatureSensor.RxChan():
+					if msg.MsgType == iotee.MessageTypeButton {
+						switch msg.Data[0] {
+						// Top left
+						case 'B':
+							w.forwardTemperature(roomID, w.getRoom(roomID).DefaultTemperature+w.mock)
+
+						// Bottom left
+						case 'Y':
+							w.forwardTemperature(roomID, w.getRoom(roomID).DefaultTemperature-w.mock)
+
+						// Top right
+						case 'A':
+							if plant, ok := w.getPlant(roomID); ok {
+								w.forwardMoisture(roomID, plant.DefaultMoisture-w.mock)
+							}
+
+						// Bottom right
+						case 'X':
+							if plant, ok := w.getPlant(roomID); ok {
+								w.forwardMoisture(roomID, plant.DefaultMoisture+w.mock)
 							}
 						}
 					}
 				}
-			}(roomID, temperatureSensor)
-		}
+			}
+		})
+
+		return
+	}
+
+	getInterval := func() time.Duration {
+		return w.getRoom(roomID).MeasureInterval
+	}
+
+	w.startWorker(key, func(ctx context.Context) {
+		w.poll(ctx, logger, key, getInterval, func(ctx context.Context) int {
+			// take a measurement; failures don't stop the worker but are tracked in the sensor's health
+			measurement, err := w.measure(ctx, key, room.TemperatureSensor, ErrTemperatureReadTimedOut)
+			if ctx.Err() != nil {
+				return 0
+			}
+
+			failures := w.updateHealth(logger, key, err, func(ctx context.Context, gateway *GatewayRemote, health mqttapi.DeviceHealth) error {
+				return gateway.ReportTemperatureSensorHealth(ctx, w.getGatewayID(roomID), health)
+			})
+
+			if err == nil {
+				// queue the result for forwarding to the gateway; sensors measure in °C
+				if w.temperatureUnit == mqttapi.UnitFahrenheit {
+					measurement = measurement*9/5 + 32
+				}
+
+				w.forwardTemperature(roomID, measurement)
+			}
+
+			return failures
+		})
+	})
+}
+
+// startMoistureWorker starts measuring the moisture of a plant
+func (w *Hub) startMoistureWorker(plantID string, plant Plant) {
+	// In mock mode, moisture is mocked using the buttons of the temperature sensors
+	if w.mock > 0 {
+		return
+	}
+
+	key := path.Join("plants", plantID, "moisture")
+	logger := w.workerLogger.With(logging.KeyPlantID, plantID, logging.KeySensorID, key)
+
+	getInterval := func() time.Duration {
+		current, _ := w.getPlant(plantID)
+
+		return current.MeasureInterval
+	}
+
+	w.startWorker(key, func(ctx context.Context) {
+		w.poll(ctx, logger, key, getInterval, func(ctx context.Context) int {
+			// take a measurement; failures don't stop the worker but are tracked in the sensor's health
+			measurement, err := w.measure(ctx, key, plant.MoistureSensor, ErrMoistureReadTimedOut)
+			if ctx.Err() != nil {
+				return 0
+			}
+
+			failures := w.updateHealth(logger, key, err, func(ctx context.Context, gateway *GatewayRemote, health mqttapi.DeviceHealth) error {
+				return gateway.ReportMoistureSensorHealth(ctx, w.getGatewayID(plantID), health)
+			})
+
+			if err == nil {
+				// queue the result for forwarding to the gateway
+				w.forwardMoisture(plantID, measurement)
+			}
 
+			return failures
+		})
+	})
+}
+
+// checkMock checks whether all temperature sensors can be used for mocking if mock mode is on
+func (w *Hub) checkMock(rooms map[string]Room) error {
+	if w.mock <= 0 {
 		return nil
 	}
 
-	// Loop over all temperature sensors present in hub
-	for roomID, temperatureSensor := range hub.temperatureSensors {
-		hub.workerWg.Add(1) // increment the WaitGroup counter by one
+	for _, room := range rooms {
+		if room.TemperatureSensor == nil {
+			continue
+		}
 
-		// Spin off a goroutine for each temperature sensor
-		go func(roomID string, temperatureSensor utils.IoTee) {
-			defer hub.workerWg.Done() // called at the end to notify that this goroutine is done
+		// Mocking uses the buttons of the IoTee which backs the temperature sensor
+		if _, ok := room.TemperatureSensor.(drivers.IoTeeDevice); !ok {
+			return ErrMockRequiresIoTee
+		}
+	}
 
-			for {
-				select {
-				// end the goroutine if the context signals done
-				case <-hub.ctx.Done():
-					return
-				default:
-					hub.measureLock.Lock() // use a lock to ensure safe concurrent access
+	return nil
+}
 
-					// create a new temperature request message
-					req := iotee.NewMessage(iotee.MessageTypeTempReq, 0)
+// OpenHub fires up the hub by setting up temperature and moisture sensor handling.
+// Measurements are queued until the hub is linked to a gateway using LinkHub.
+func OpenHub(hub *Hub, ctx context.Context) error {
+	if err := hub.checkMock(hub.rooms); err != nil {
+		return err
+	}
 
-					// send a temperature request to the sensor
-					if err := temperatureSensor.Transmit(&req); err != nil {
-						hub.errs <- err // if there's an error, send it to the errors channel
+	hub.workerWg.Add(1)
+	go hub.deliverQueued()
 
-						hub.measureLock.Unlock() // release the lock
+	// Spin off a worker for each temperature sensor present in hub
+	for roomID, room := range hub.rooms {
+		if room.TemperatureSensor != nil {
+			hub.startTemperatureWorker(roomID, room)
+		}
+	}
 
-						return
-					}
+	// Spin off a worker for each moisture sensor present in hub
+	for plantID, plant := range hub.plants {
+		if plant.MoistureSensor != nil {
+			hub.startMoistureWorker(plantID, plant)
+		}
+	}
 
-					// receive the response from the temperature sensor with a timeout
-					res := temperatureSensor.ReceiveWithTimeout(hub.measureTimeout)
-					if res == nil {
-						hub.errs <- ErrTemperatureReadTimedOut // if there's a timeout, send an error to the errors channel
+	return nil
+}
 
-						hub.measureLock.Unlock() // release the lock
+// ReloadHub switches the hub to a new set of rooms and plants while it is running.
+// Only the workers of sensors which have changed are restarted, and only fans and sprinklers which have been added or removed are
+// (un-)registered with the linked gateway. Devices which are no longer used may be closed once ReloadHub has returned.
+func ReloadHub(hub *Hub, ctx context.Context, rooms map[string]Room, plants map[string]Plant) error {
+	if err := hub.checkMock(rooms); err != nil {
+		return err
+	}
 
-						return
-					}
+	hub.reloadLock.Lock()
+	defer hub.reloadLock.Unlock()
 
-					hub.measureLock.Unlock() // release the lock
+	hub.topologyLock.Lock()
+	prevRooms := hub.rooms
+	prevPlants := hub.plants
 
-					// forward the result to the gateway
-					if err := gateway.ForwardTemperatureMeasurement(ctx, roomID, int(float32(binary.BigEndian.Uint32(res.Data[0:4]))/100.0), hub.defaultTemperature); err != nil {
-						hub.errs <- err // if there's an error, send it to the errors channel
+	hub.rooms = rooms
+	hub.plants = plants
+	hub.topologyLock.Unlock()
 
-						return
-					}
+	// Turn off timed fans and sprinklers which have been removed or replaced so that they don't keep running once they are closed
+	for roomID, prev := range prevRooms {
+		if next, ok := rooms[roomID]; prev.Fan != nil && (!ok || next.Fan != prev.Fan) {
+			hub.shutOffNow(ctx, path.Join("rooms", roomID, "fan"))
+		}
+	}
 
-					time.Sleep(hub.measureInterval) // sleep for the duration of the measurement interval
-				}
-			}
-		}(roomID, temperatureSensor)
+	for plantID, prev := range prevPlants {
+		if next, ok := plants[plantID]; prev.Sprinkler != nil && (!ok || next.Sprinkler != prev.Sprinkler) {
+			hub.shutOffNow(ctx, path.Join("plants", plantID, "sprinkler"))
+		}
 	}
 
-	// Loop over all moisture sensors present in hub
-	for plantID, moistureSensor := range hub.moistureSensors {
-		hub.workerWg.Add(1) // increment the WaitGroup counter by one
+	// Restart the workers of sensors which have been removed, added or changed
+	for roomID, prev := range prevRooms {
+		key := path.Join("rooms", roomID, "temperature")
 
-		// Spin off a goroutine for each moisture sensor
-		go func(plantID string, moistureSensor utils.IoTee) {
-			defer hub.workerWg.Done() // called at the end to notify that this goroutine is done
+		next, ok := rooms[roomID]
+		if !ok || next.TemperatureSensor != prev.TemperatureSensor || next.MeasureInterval != prev.MeasureInterval {
+			hub.stopWorker(key)
+		}
 
-			for {
-				select {
-				// end the goroutine if the context signals done
-				case <-hub.ctx.Done():
-					return
-				default:
-					hub.measureLock.Lock() // use a lock to ensure safe concurrent access
+		// Don't keep exposing the metrics of removed sensors
+		if !ok || next.TemperatureSensor == nil {
+			metrics.SensorReadDuration.DeleteLabelValues(key)
+			metrics.SensorReadTimeouts.DeleteLabelValues(key)
+			metrics.Temperature.DeleteLabelValues(roomID, hub.temperatureUnit)
+		}
+	}
 
-					// create a new moisture request message
-					req := iotee.NewMessage(iotee.MessageTypeHumReq, 0)
+	for plantID, prev := range prevPlants {
+		key := path.Join("plants", plantID, "moisture")
 
-					// send a humidity request to the sensor
-					if err := moistureSensor.Transmit(&req); err != nil {
-						hub.errs <- err // if there's an error, send it to the errors channel
+		next, ok := plants[plantID]
+		if !ok || next.MoistureSensor != prev.MoistureSensor || next.MeasureInterval != prev.MeasureInterval {
+			hub.stopWorker(key)
+		}
 
-						hub.measureLock.Unlock() // release the lock
+		if !ok || next.MoistureSensor == nil {
+			metrics.SensorReadDuration.DeleteLabelValues(key)
+			metrics.SensorReadTimeouts.DeleteLabelValues(key)
+			metrics.Moisture.DeleteLabelValues(plantID)
+		}
+	}
 
-						return
-					}
+	for roomID, next := range rooms {
+		if prev, ok := prevRooms[roomID]; next.TemperatureSensor != nil && (!ok || next.TemperatureSensor != prev.TemperatureSensor || next.MeasureInterval != prev.MeasureInterval) {
+			hub.startTemperatureWorker(roomID, next)
+		}
+	}
 
-					// receive the response from the moisture sensor with a timeout
-					res := moistureSensor.ReceiveWithTimeout(hub.measureTimeout)
-					if res == nil {
-						hub.errs <- ErrMoistureReadTimedOut // if there's a timeout, send an error to the errors channel
+	for plantID, next := range plants {
+		if prev, ok := prevPlants[plantID]; next.MoistureSensor != nil && (!ok || next.MoistureSensor != prev.MoistureSensor || next.MeasureInterval != prev.MeasureInterval) {
+			hub.startMoistureWorker(plantID, next)
+		}
+	}
 
-						hub.measureLock.Unlock() // release the lock
+	hub.deliveriesLock.Lock()
+	gateway := hub.gateway
+	hub.deliveriesLock.Unlock()
 
-						return
-					}
+	// If we are not linked, all fans and sprinklers are registered once we are
+	if gateway == nil {
+		return nil
+	}
 
-					hub.measureLock.Unlock() // release the lock
+	addedRoomIDs, removedRoomIDs := []string{}, []string{}
+	for roomID, next := range rooms {
+		if prev, ok := prevRooms[roomID]; next.Fan != nil && (!ok || prev.Fan == nil) {
+			addedRoomIDs = append(addedRoomIDs, hub.getGatewayID(roomID))
+		}
+	}
+	for roomID, prev := range prevRooms {
+		if next, ok := rooms[roomID]; prev.Fan != nil && (!ok || next.Fan == nil) {
+			removedRoomIDs = append(removedRoomIDs, hub.getGatewayID(roomID))
+		}
+	}
 
-					// forward the result to the gateway
-					if err := gateway.ForwardMoistureMeasurement(ctx, plantID, int(float32(binary.BigEndian.Uint32(res.Data[0:4]))/100.0), hub.defaultMoisture); err != nil {
-						hub.errs <- err // if there's an error, send it to the errors channel
+	addedPlantIDs, removedPlantIDs := []string{}, []string{}
+	for plantID, next := range plants {
+		if prev, ok := prevPlants[plantID]; next.Sprinkler != nil && (!ok || prev.Sprinkler == nil) {
+			addedPlantIDs = append(addedPlantIDs, hub.getGatewayID(plantID))
+		}
+	}
+	for plantID, prev := range prevPlants {
+		if next, ok := plants[plantID]; prev.Sprinkler != nil && (!ok || next.Sprinkler == nil) {
+			removedPlantIDs = append(removedPlantIDs, hub.getGatewayID(plantID))
+		}
+	}
 
-						return
-					}
+	if len(removedRoomIDs) > 0 {
+		if err := gateway.UnregisterFans(ctx, removedRoomIDs); err != nil {
+			return err
+		}
+	}
 
-					time.Sleep(hub.measureInterval) // sleep for the duration of the measurement interval
-				}
-			}
-		}(plantID, moistureSensor)
+	if len(removedPlantIDs) > 0 {
+		if err := gateway.UnregisterSprinklers(ctx, removedPlantIDs); err != nil {
+			return err
+		}
+	}
+
+	if len(addedRoomIDs) > 0 {
+		if err := gateway.RegisterFans(ctx, addedRoomIDs); err != nil {
+			return err
+		}
+	}
+
+	if len(addedPlantIDs) > 0 {
+		if err := gateway.RegisterSprinklers(ctx, addedPlantIDs); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -363,24 +878,100 @@ func WaitHub(hub *Hub) error {
 	return nil
 }
 
-// CloseHub performs cleanup operations on the hub such as unregistering fans and sprinklers and closing channels.
-func CloseHub(hub *Hub, ctx context.Context, gateway *GatewayRemote) error {
-	// Prepare the list of room IDs.
-	roomIDs := []string{}
-	for roomID := range hub.fans {
-		roomIDs = append(roomIDs, roomID)
+// LinkHub registers the hub's fans and sprinklers with a gateway and starts delivering queued measurements to it.
+// It has to be called again with the new gateway every time the hub reconnects.
+func LinkHub(hub *Hub, ctx context.Context, gateway *GatewayRemote) error {
+	// Register fans if any.
+	if roomIDs := hub.getRoomIDs(); len(roomIDs) > 0 {
+		if err := gateway.RegisterFans(ctx, roomIDs); err != nil {
+			return err
+		}
 	}
 
-	// Unregister fans from the gateway.
-	if err := gateway.UnregisterFans(ctx, roomIDs); err != nil {
-		return err
+	// Register sprinklers if any.
+	if plantIDs := hub.getPlantIDs(); len(plantIDs) > 0 {
+		if err := gateway.RegisterSprinklers(ctx, plantIDs); err != nil {
+			return err
+		}
 	}
 
-	// Unregister sprinklers from the gateway.
-	if err := gateway.UnregisterSprinklers(ctx, roomIDs); err != nil {
-		return err
+	gatewayCtx, unlink := context.WithCancel(hub.ctx)
+
+	hub.deliveriesLock.Lock()
+	if hub.unlink != nil {
+		hub.unlink()
+	}
+
+	hub.gateway = gateway
+	hub.gatewayCtx = gatewayCtx
+	hub.unlink = unlink
+	hub.deliveriesLock.Unlock()
+
+	hub.notifyDeliveries()
+
+	return nil
+}
+
+// UnlinkHub stops delivering measurements to the gateway, i.e. because the connection to it was lost.
+// Measurements are queued until the hub is linked again.
+func UnlinkHub(hub *Hub) {
+	hub.deliveriesLock.Lock()
+	defer hub.deliveriesLock.Unlock()
+
+	if hub.unlink != nil {
+		hub.unlink()
 	}
 
+	hub.gateway = nil
+	hub.gatewayCtx = nil
+	hub.unlink = nil
+}
+
+// GetHubChecks returns the checks which have to pass for the hub to be ready: It has to be linked to a gateway
+// and all actuators whose runtime has elapsed have to be turned off.
+func GetHubChecks(hub *Hub) map[string]probes.Check {
+	return map[string]probes.Check{
+		"actuators": hub.checkShutOffs,
+		"gateway": func() error {
+			hub.deliveriesLock.Lock()
+			defer hub.deliveriesLock.Unlock()
+
+			if hub.gateway == nil {
+				return ErrNotLinked
+			}
+
+			return nil
+		},
+	}
+}
+
+// CloseHub performs cleanup operations on the hub such as unregistering fans and sprinklers from the linked gateway and closing channels.
+func CloseHub(hub *Hub, ctx context.Context) error {
+	// Turn off timed fans and sprinklers since nothing would turn them off once the hub has been closed
+	hub.shutOffNow(ctx, hub.getPendingShutOffs()...)
+
+	hub.deliveriesLock.Lock()
+	gateway := hub.gateway
+	hub.deliveriesLock.Unlock()
+
+	if gateway != nil {
+		// Unregister fans from the gateway if any.
+		if roomIDs := hub.getRoomIDs(); len(roomIDs) > 0 {
+			if err := gateway.UnregisterFans(ctx, roomIDs); err != nil {
+				return err
+			}
+		}
+
+		// Unregister sprinklers from the gateway if any.
+		if plantIDs := hub.getPlantIDs(); len(plantIDs) > 0 {
+			if err := gateway.UnregisterSprinklers(ctx, plantIDs); err != nil {
+				return err
+			}
+		}
+	}
+
+	UnlinkHub(hub)
+
 	// Cancel the hub context.
 	hub.cancel()
 
@@ -2,11 +2,17 @@ package services
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
 	"github.com/pojntfx/dudirekta/pkg/rpc"
-	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/drivers"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+	"github.com/pojntfx/green-guardian-gateway/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"gitlab.mi.hdm-stuttgart.de/iotee/go-iotee"
 )
 
@@ -24,7 +30,12 @@ func TestSetFanOn(t *testing.T) {
 
 	mockFan := NewMockIoTee(ctrl)
 
-	hub := NewHub(false, ctx, map[string]utils.IoTee{"Room1": mockFan}, nil, 0, nil, nil, 0, 0, 0, 0)
+	fan, err := drivers.NewIoTeeActuator(mockFan, drivers.KindFan)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeActuator: %v", err)
+	}
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "", map[string]Room{"Room1": {Fan: fan}}, mqttapi.UnitCelsius, nil, 0, 0, 0, 0, 0, 0)
 
 	roomID := "Room1"
 	on := true
@@ -36,9 +47,56 @@ func TestSetFanOn(t *testing.T) {
 		Data:    expectedData,
 	}).Return(nil).Times(1)
 
-	if err := hub.SetFanOn(ctx, roomID, on); err != nil {
+	if err := hub.SetFanOn(ctx, roomID, on, 0); err != nil {
+		t.Fatalf("unexpected error during SetFanOn: %v", err)
+	}
+}
+
+// TestNamespacedHub checks that a hub with a namespace registers its rooms under namespaced IDs and only accepts commands for them.
+func TestNamespacedHub(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockFan := NewMockIoTee(ctrl)
+
+	fan, err := drivers.NewIoTeeActuator(mockFan, drivers.KindFan)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeActuator: %v", err)
+	}
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "greenhouse-1", map[string]Room{"Room1": {Fan: fan}}, mqttapi.UnitCelsius, nil, 0, 0, 0, 0, 0, 0)
+
+	registered := []string{}
+	if err := LinkHub(hub, ctx, &GatewayRemote{
+		RegisterFans: func(ctx context.Context, roomIDs []string) error {
+			registered = append(registered, roomIDs...)
+
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error during LinkHub: %v", err)
+	}
+
+	if len(registered) != 1 || registered[0] != "greenhouse-1.Room1" {
+		t.Fatalf("expected greenhouse-1.Room1 to be registered, got %v", registered)
+	}
+
+	mockFan.EXPECT().Transmit(gomock.Any()).Return(nil).Times(1)
+
+	if err := hub.SetFanOn(ctx, "greenhouse-1.Room1", true, 0); err != nil {
 		t.Fatalf("unexpected error during SetFanOn: %v", err)
 	}
+
+	if err := hub.SetFanOn(ctx, "Room1", true, 0); err != ErrNoSuchRoom {
+		t.Fatalf("expected error %v for room without namespace, got %v", ErrNoSuchRoom, err)
+	}
+
+	if err := hub.SetFanOn(ctx, "greenhouse-2.Room1", true, 0); err != ErrNoSuchRoom {
+		t.Fatalf("expected error %v for room of another namespace, got %v", ErrNoSuchRoom, err)
+	}
+	UnlinkHub(hub)
 }
 
 // TestSetSprinklerOn is a testing function for the SetSprinklerOn method of the NewHub struct.
@@ -53,7 +111,12 @@ func TestSetSprinklerOn(t *testing.T) {
 
 	mockSprinkler := NewMockIoTee(ctrl)
 
-	hub := NewHub(false, ctx, nil, nil, 0, map[string]utils.IoTee{"Plant1": mockSprinkler}, nil, 0, 0, 0, 0)
+	sprinkler, err := drivers.NewIoTeeActuator(mockSprinkler, drivers.KindSprinkler)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeActuator: %v", err)
+	}
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "", nil, mqttapi.UnitCelsius, map[string]Plant{"Plant1": {Sprinkler: sprinkler}}, 0, 0, 0, 0, 0, 0)
 
 	roomID := "Plant1"
 	on := true
@@ -65,7 +128,455 @@ func TestSetSprinklerOn(t *testing.T) {
 		Data:    expectedData,
 	}).Return(nil).Times(1)
 
-	if err := hub.SetSprinklerOn(ctx, roomID, on); err != nil {
+	if err := hub.SetSprinklerOn(ctx, roomID, on, 0); err != nil {
+		t.Fatalf("unexpected error during SetSprinklerOn: %v", err)
+	}
+}
+
+// TestSprinklerRuntime checks that the hub turns a sprinkler off again once its requested runtime has elapsed,
+// capping the requested runtime at the sprinkler's maximum runtime.
+func TestSprinklerRuntime(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSprinkler := NewMockIoTee(ctrl)
+
+	sprinkler, err := drivers.NewIoTeeActuator(mockSprinkler, drivers.KindSprinkler)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeActuator: %v", err)
+	}
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "", nil, mqttapi.UnitCelsius, map[string]Plant{"Plant1": {Sprinkler: sprinkler, SprinklerMaxRuntime: 50 * time.Millisecond}}, 0, 0, 0, 0, 0, 0)
+
+	off := make(chan struct{})
+	gomock.InOrder(
+		mockSprinkler.EXPECT().Transmit(&iotee.Message{
+			MsgType: iotee.MessageTypeRGBLED,
+			DataLen: 4,
+			Data:    []byte{255, 0, 255, 0},
+		}).Return(nil).Times(1),
+		mockSprinkler.EXPECT().Transmit(&iotee.Message{
+			MsgType: iotee.MessageTypeRGBLED,
+			DataLen: 4,
+			Data:    []byte{0, 0, 255, 0},
+		}).DoAndReturn(func(msg *iotee.Message) error {
+			close(off)
+
+			return nil
+		}).Times(1),
+	)
+
+	if err := hub.SetSprinklerOn(ctx, "Plant1", true, time.Hour); err != nil {
+		t.Fatalf("unexpected error during SetSprinklerOn: %v", err)
+	}
+
+	select {
+	case <-off:
+	case <-time.After(time.Second):
+		t.Fatal("timed out while waiting for sprinkler to be turned off")
+	}
+}
+
+// TestSprinklerRuntimeKeptOnFailure checks that a sprinkler which is still on is turned off
+// once its runtime has elapsed, even if switching it again failed in the meantime.
+func TestSprinklerRuntimeKeptOnFailure(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSprinkler := NewMockIoTee(ctrl)
+
+	sprinkler, err := drivers.NewIoTeeActuator(mockSprinkler, drivers.KindSprinkler)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeActuator: %v", err)
+	}
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "", nil, mqttapi.UnitCelsius, map[string]Plant{"Plant1": {Sprinkler: sprinkler, SprinklerMaxRuntime: 50 * time.Millisecond}}, 0, 0, 0, 0, 0, 0)
+
+	errTransmit := errors.New("transmit failed")
+
+	off := make(chan struct{})
+	gomock.InOrder(
+		mockSprinkler.EXPECT().Transmit(&iotee.Message{
+			MsgType: iotee.MessageTypeRGBLED,
+			DataLen: 4,
+			Data:    []byte{255, 0, 255, 0},
+		}).Return(nil).Times(1),
+		mockSprinkler.EXPECT().Transmit(&iotee.Message{
+			MsgType: iotee.MessageTypeRGBLED,
+			DataLen: 4,
+			Data:    []byte{255, 0, 255, 0},
+		}).Return(errTransmit).Times(1),
+		mockSprinkler.EXPECT().Transmit(&iotee.Message{
+			MsgType: iotee.MessageTypeRGBLED,
+			DataLen: 4,
+			Data:    []byte{0, 0, 255, 0},
+		}).DoAndReturn(func(msg *iotee.Message) error {
+			close(off)
+
+			return nil
+		}).Times(1),
+	)
+
+	if err := hub.SetSprinklerOn(ctx, "Plant1", true, time.Hour); err != nil {
 		t.Fatalf("unexpected error during SetSprinklerOn: %v", err)
 	}
+
+	if err := hub.SetSprinklerOn(ctx, "Plant1", true, time.Hour); !errors.Is(err, errTransmit) {
+		t.Fatalf("expected error %v during SetSprinklerOn, got %v", errTransmit, err)
+	}
+
+	select {
+	case <-off:
+	case <-time.After(time.Second):
+		t.Fatal("timed out while waiting for sprinkler to be turned off")
+	}
+}
+
+// TestSprinklerShutOffRetried checks that turning off a sprinkler once its runtime has elapsed is retried if it fails,
+// that the hub isn't ready in the meantime and that the gateway is told once the sprinkler is off.
+func TestSprinklerShutOffRetried(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSprinkler := NewMockIoTee(ctrl)
+
+	sprinkler, err := drivers.NewIoTeeActuator(mockSprinkler, drivers.KindSprinkler)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeActuator: %v", err)
+	}
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "", nil, mqttapi.UnitCelsius, map[string]Plant{"Plant1": {Sprinkler: sprinkler, SprinklerMaxRuntime: 50 * time.Millisecond}}, 0, 0, 0, 0, 0, 0)
+
+	failed := make(chan struct{})
+	gomock.InOrder(
+		mockSprinkler.EXPECT().Transmit(&iotee.Message{
+			MsgType: iotee.MessageTypeRGBLED,
+			DataLen: 4,
+			Data:    []byte{255, 0, 255, 0},
+		}).Return(nil).Times(1),
+		mockSprinkler.EXPECT().Transmit(&iotee.Message{
+			MsgType: iotee.MessageTypeRGBLED,
+			DataLen: 4,
+			Data:    []byte{0, 0, 255, 0},
+		}).DoAndReturn(func(msg *iotee.Message) error {
+			close(failed)
+
+			return errors.New("transmit failed")
+		}).Times(1),
+		mockSprinkler.EXPECT().Transmit(&iotee.Message{
+			MsgType: iotee.MessageTypeRGBLED,
+			DataLen: 4,
+			Data:    []byte{0, 0, 255, 0},
+		}).Return(nil).Times(1),
+	)
+
+	if err := OpenHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during OpenHub: %v", err)
+	}
+
+	reported := make(chan bool, 1)
+	if err := LinkHub(hub, ctx, &GatewayRemote{
+		RegisterSprinklers: func(ctx context.Context, plantIDs []string) error {
+			return nil
+		},
+		ReportSprinklerState: func(ctx context.Context, plantID string, on bool) error {
+			reported <- on
+
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error during LinkHub: %v", err)
+	}
+
+	if err := hub.SetSprinklerOn(ctx, "Plant1", true, time.Hour); err != nil {
+		t.Fatalf("unexpected error during SetSprinklerOn: %v", err)
+	}
+
+	select {
+	case <-failed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out while waiting for sprinkler to be turned off")
+	}
+
+	// The failure is recorded right after the attempt has returned
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for hub.checkShutOffs() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected hub not to be ready while the sprinkler couldn't be turned off")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case on := <-reported:
+		if on {
+			t.Fatal("expected sprinkler to be reported as off")
+		}
+
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out while waiting for sprinkler state to be reported")
+	}
+
+	if err := hub.checkShutOffs(); err != nil {
+		t.Fatalf("expected hub to be ready once the sprinkler has been turned off, got %v", err)
+	}
+
+	UnlinkHub(hub)
+
+	if err := CloseHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during CloseHub: %v", err)
+	}
+}
+
+// TestLinkHubDeliversQueuedMeasurements checks that measurements which were taken
+// while the hub was not linked to a gateway are delivered in order once it is linked.
+func TestLinkHubDeliversQueuedMeasurements(t *testing.T) {
+	ctx := context.Background()
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "", nil, mqttapi.UnitCelsius, nil, 0, 0, 0, 0, 0, 0)
+
+	if err := OpenHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during OpenHub: %v", err)
+	}
+
+	for _, measurement := range []float64{20, 21, 22} {
+		hub.forwardTemperature("Room1", measurement)
+	}
+
+	delivered := make(chan float64)
+	if err := LinkHub(hub, ctx, &GatewayRemote{
+		ForwardTemperatureMeasurement: func(ctx context.Context, roomID string, measurement mqttapi.TemperatureMeasurement) error {
+			delivered <- measurement.Value
+
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error during LinkHub: %v", err)
+	}
+
+	for _, expected := range []float64{20, 21, 22} {
+		if measurement := <-delivered; measurement != expected {
+			t.Fatalf("expected measurement %v to be delivered, got %v", expected, measurement)
+		}
+	}
+
+	UnlinkHub(hub)
+
+	if err := CloseHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during CloseHub: %v", err)
+	}
+}
+
+// TestLinkHubDropsRejectedMeasurements checks that measurements which the gateway rejects are dropped
+// instead of blocking the ones which have been queued after them.
+func TestLinkHubDropsRejectedMeasurements(t *testing.T) {
+	ctx := context.Background()
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "", nil, mqttapi.UnitCelsius, nil, time.Hour, 0, 0, 0, 0, 0)
+
+	if err := OpenHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during OpenHub: %v", err)
+	}
+
+	hub.forwardTemperature("Room1", 20)
+	hub.forwardTemperature("Room2", 21)
+
+	delivered := make(chan string)
+	if err := LinkHub(hub, ctx, &GatewayRemote{
+		ForwardTemperatureMeasurement: func(ctx context.Context, roomID string, measurement mqttapi.TemperatureMeasurement) error {
+			// Errors of calls to the gateway arrive as plain strings
+			if roomID == "Room1" {
+				return errors.New("rejected: hub is not allowed to use rooms [Room1]")
+			}
+
+			delivered <- roomID
+
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error during LinkHub: %v", err)
+	}
+
+	select {
+	case roomID := <-delivered:
+		if roomID != "Room2" {
+			t.Fatalf("expected measurement of Room2 to be delivered, got %v", roomID)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("timed out while waiting for measurement to be delivered")
+	}
+
+	UnlinkHub(hub)
+
+	if err := CloseHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during CloseHub: %v", err)
+	}
+}
+
+// TestSensorDegraded checks that a sensor which keeps timing out does not stop the hub,
+// but is reported as degraded to the gateway once it failed too often.
+func TestSensorDegraded(t *testing.T) {
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSensor := NewMockIoTee(ctrl)
+
+	mockSensor.EXPECT().Transmit(gomock.Any()).Return(nil).MinTimes(2)
+	mockSensor.EXPECT().ReceiveWithTimeout(gomock.Any()).Return(nil).MinTimes(2)
+
+	sensor, err := drivers.NewIoTeeSensor(mockSensor, drivers.KindTemperatureSensor)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeSensor: %v", err)
+	}
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "", map[string]Room{"Room1": {TemperatureSensor: sensor}}, mqttapi.UnitCelsius, nil, time.Millisecond, 0, 2, time.Millisecond, 0, 0)
+
+	if err := OpenHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during OpenHub: %v", err)
+	}
+
+	reported := make(chan mqttapi.DeviceHealth, 1)
+	if err := LinkHub(hub, ctx, &GatewayRemote{
+		ReportTemperatureSensorHealth: func(ctx context.Context, roomID string, health mqttapi.DeviceHealth) error {
+			reported <- health
+
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error during LinkHub: %v", err)
+	}
+
+	health := <-reported
+	if health.Healthy || health.Failures != 2 || health.Error != ErrTemperatureReadTimedOut.Error() {
+		t.Fatalf("expected sensor to be reported as degraded after 2 failures, got %v", health)
+	}
+
+	if timeouts := testutil.ToFloat64(metrics.SensorReadTimeouts.WithLabelValues("rooms/Room1/temperature")); timeouts < 2 {
+		t.Fatalf("expected at least 2 timeouts to be counted, got %v", timeouts)
+	}
+
+	if err := CloseHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during CloseHub: %v", err)
+	}
+}
+
+// TestReloadHub checks that reloading the hub only registers the fans which have been added
+// and unregisters the ones which have been removed.
+func TestReloadHub(t *testing.T) {
+	ctx := context.Background()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockFan := NewMockIoTee(ctrl)
+
+	fan, err := drivers.NewIoTeeActuator(mockFan, drivers.KindFan)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeActuator: %v", err)
+	}
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "", map[string]Room{"Room1": {Fan: fan}, "Room2": {Fan: fan}}, mqttapi.UnitCelsius, nil, 0, 0, 0, 0, 0, 0)
+
+	if err := OpenHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during OpenHub: %v", err)
+	}
+
+	registered, unregistered := [][]string{}, [][]string{}
+	if err := LinkHub(hub, ctx, &GatewayRemote{
+		RegisterFans: func(ctx context.Context, roomIDs []string) error {
+			registered = append(registered, roomIDs)
+
+			return nil
+		},
+		UnregisterFans: func(ctx context.Context, roomIDs []string) error {
+			unregistered = append(unregistered, roomIDs)
+
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error during LinkHub: %v", err)
+	}
+
+	registered = [][]string{}
+
+	if err := ReloadHub(hub, ctx, map[string]Room{"Room2": {Fan: fan}, "Room3": {Fan: fan}}, nil); err != nil {
+		t.Fatalf("unexpected error during ReloadHub: %v", err)
+	}
+
+	if len(registered) != 1 || len(registered[0]) != 1 || registered[0][0] != "Room3" {
+		t.Fatalf("expected only Room3 to be registered, got %v", registered)
+	}
+
+	if len(unregistered) != 1 || len(unregistered[0]) != 1 || unregistered[0][0] != "Room1" {
+		t.Fatalf("expected only Room1 to be unregistered, got %v", unregistered)
+	}
+
+	if err := hub.SetFanOn(ctx, "Room1", true, 0); err != ErrNoSuchRoom {
+		t.Fatalf("expected error %v for removed room, got %v", ErrNoSuchRoom, err)
+	}
+
+	UnlinkHub(hub)
+
+	if err := CloseHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during CloseHub: %v", err)
+	}
+}
+
+// TestSetConfig checks that configs from the gateway override the values of rooms,
+// that room configs take precedence over the hub config and that clearing a room config restores the hub config.
+func TestSetConfig(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	hub := NewHub(logging.NewDiscardLogger(), ctx, "", map[string]Room{"Room1": {DefaultTemperature: 20}}, mqttapi.UnitCelsius, nil, time.Minute, time.Second, 0, 0, 0, 0)
+
+	hubTemperature, roomTemperature := 22.0, 25.0
+
+	hubState, err := hub.SetHubConfig(ctx, mqttapi.HubConfig{MeasureInterval: 30000, DefaultTemperature: &hubTemperature})
+	if err != nil {
+		t.Fatalf("unexpected error during SetHubConfig: %v", err)
+	}
+
+	if hubState.MeasureInterval != 30000 || hubState.MeasureTimeout != 1000 || hubState.Rooms["Room1"].DefaultTemperature != 22 {
+		t.Fatalf("expected hub config to be applied, got %v", hubState)
+	}
+
+	roomState, err := hub.SetRoomConfig(ctx, "Room1", mqttapi.RoomConfig{MeasureInterval: 10000, DefaultTemperature: &roomTemperature})
+	if err != nil {
+		t.Fatalf("unexpected error during SetRoomConfig: %v", err)
+	}
+
+	if roomState == nil || roomState.MeasureInterval != 10000 || roomState.DefaultTemperature != 25 {
+		t.Fatalf("expected room config to be applied, got %v", roomState)
+	}
+
+	if room := hub.getRoom("Room1"); room.MeasureInterval != 10*time.Second || room.DefaultTemperature != 25 {
+		t.Fatalf("expected room to use its config, got %v", room)
+	}
+
+	roomState, err = hub.SetRoomConfig(ctx, "Room1", mqttapi.RoomConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error during SetRoomConfig: %v", err)
+	}
+
+	if roomState == nil || roomState.MeasureInterval != 30000 || roomState.DefaultTemperature != 22 {
+		t.Fatalf("expected hub config to be applied after clearing room config, got %v", roomState)
+	}
+
+	if roomState, err := hub.SetRoomConfig(ctx, "Room2", mqttapi.RoomConfig{MeasureInterval: 10000}); err != nil || roomState != nil {
+		t.Fatalf("expected no state for unknown room, got %v, %v", roomState, err)
+	}
+
+	if _, err := hub.SetRoomConfig(ctx, "Room1", mqttapi.RoomConfig{MeasureInterval: -1}); err != ErrInvalidConfig {
+		t.Fatalf("expected error %v, got %v", ErrInvalidConfig, err)
+	}
 }
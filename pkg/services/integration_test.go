@@ -0,0 +1,408 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"maps"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	gomock "github.com/golang/mock/gomock"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/drivers"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+	"gitlab.mi.hdm-stuttgart.de/iotee/go-iotee"
+)
+
+const integrationTimeout = time.Second * 10
+
+// startBroker starts an MQTT broker on loopback which accepts all clients and returns it and its address
+func startBroker(t *testing.T) (*mochi.Server, string) {
+	t.Helper()
+
+	broker := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       logging.NewDiscardLogger(),
+	})
+
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatalf("unexpected error during AddHook: %v", err)
+	}
+
+	listener := listeners.NewTCP(listeners.Config{
+		ID:      "tcp",
+		Address: "127.0.0.1:0",
+	})
+	if err := broker.AddListener(listener); err != nil {
+		t.Fatalf("unexpected error during AddListener: %v", err)
+	}
+
+	if err := broker.Serve(); err != nil {
+		t.Fatalf("unexpected error during Serve: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = broker.Close()
+	})
+
+	return broker, listener.Address()
+}
+
+// connectGateway connects a gateway to the broker and subscribes to its topics. The peers are set before that,
+// since commands can arrive as soon as the gateway has subscribed.
+func connectGateway(t *testing.T, ctx context.Context, brokerAddr string, shadows bool, schedulesFile string, peers func() map[string]HubRemote) *Gateway {
+	t.Helper()
+
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + brokerAddr).SetClientID("TestThing"))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error during Connect: %v", token.Error())
+	}
+	t.Cleanup(func() {
+		client.Disconnect(0)
+	})
+
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: client, shadows: shadows, schedulesFile: schedulesFile, peers: peers})
+
+	if err := OpenGateway(gateway, ctx); err != nil {
+		t.Fatalf("unexpected error during OpenGateway: %v", err)
+	}
+
+	return gateway
+}
+
+// startGateway connects a gateway to the broker and serves the RPCs for hubs on loopback, just like green-guardian-gateway.
+// It returns the address hubs can connect to.
+func startGateway(t *testing.T, ctx context.Context, brokerAddr string) string {
+	t.Helper()
+
+	connected := map[string]HubRemote{}
+	var connectedLock sync.Mutex
+
+	peers := func() map[string]HubRemote {
+		connectedLock.Lock()
+		defer connectedLock.Unlock()
+
+		return maps.Clone(connected)
+	}
+
+	gateway := connectGateway(t, ctx, brokerAddr, false, "", peers)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error during Listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			var registry *rpc.Registry[HubRemote]
+			registry = rpc.NewRegistry(
+				gateway,
+				HubRemote{},
+
+				integrationTimeout,
+				ctx,
+				&rpc.Options{
+					ResponseBufferLen: rpc.DefaultResponseBufferLen,
+					OnClientConnect: func(remoteID string) {
+						connectedLock.Lock()
+						connected[remoteID] = registry.Peers()[remoteID]
+						connectedLock.Unlock()
+
+						_ = ConnectHub(gateway, remoteID, "")
+					},
+					OnClientDisconnect: func(remoteID string) {
+						connectedLock.Lock()
+						delete(connected, remoteID)
+						connectedLock.Unlock()
+
+						_ = DisconnectHub(gateway, remoteID)
+					},
+				},
+			)
+
+			go func() {
+				defer conn.Close()
+
+				_ = registry.Link(conn)
+			}()
+		}
+	}()
+
+	return lis.Addr().String()
+}
+
+// linkHub connects a hub to the gateway, just like green-guardian-hub
+func linkHub(t *testing.T, ctx context.Context, hub *Hub, gatewayAddr string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", gatewayAddr)
+	if err != nil {
+		t.Fatalf("unexpected error during Dial: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	ready := make(chan string)
+	registry := rpc.NewRegistry(
+		hub,
+		GatewayRemote{},
+
+		integrationTimeout,
+		ctx,
+		&rpc.Options{
+			ResponseBufferLen: rpc.DefaultResponseBufferLen,
+			OnClientConnect: func(remoteID string) {
+				ready <- remoteID
+			},
+		},
+	)
+
+	go func() {
+		_ = registry.Link(conn)
+	}()
+
+	var remoteID string
+	select {
+	case remoteID = <-ready:
+	case <-time.After(integrationTimeout):
+		t.Fatal("timed out while connecting to gateway")
+	}
+
+	gateway, ok := registry.Peers()[remoteID]
+	if !ok {
+		t.Fatalf("expected gateway %v to be a peer", remoteID)
+	}
+
+	if err := LinkHub(hub, ctx, &gateway); err != nil {
+		t.Fatalf("unexpected error during LinkHub: %v", err)
+	}
+}
+
+// TestIntegration checks the full flow between an MQTT broker, a gateway and a hub with fake IoTees:
+// Measurements of the hub's sensors are published to the room's topic, and commands which are published
+// to a room's fan topic are sent to the IoTee of that room's fan.
+func TestIntegration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	broker, brokerAddr := startBroker(t)
+
+	// Subscribe to the measurements before any hub is connected so that none are missed
+	measurements := make(chan mqttapi.TemperatureMeasurement, 1)
+	if err := broker.Subscribe("/gateways/TestThing/rooms/Room1/temperature", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		measurement := mqttapi.TemperatureMeasurement{}
+		if err := json.Unmarshal(pk.Payload, &measurement); err != nil {
+			t.Errorf("unexpected error during Unmarshal: %v", err)
+
+			return
+		}
+
+		select {
+		case measurements <- measurement:
+		default:
+		}
+	}); err != nil {
+		t.Fatalf("unexpected error during Subscribe: %v", err)
+	}
+
+	gatewayAddr := startGateway(t, ctx, brokerAddr)
+
+	// The temperature sensor of Room1 always measures 24.5 °C
+	mockSensor := NewMockIoTee(ctrl)
+
+	response := iotee.NewMessage(iotee.MessageTypeTempReq, 4)
+	response.Data = make([]byte, 4)
+	binary.BigEndian.PutUint32(response.Data, 2450)
+
+	mockSensor.EXPECT().Transmit(gomock.Any()).Return(nil).AnyTimes()
+	mockSensor.EXPECT().ReceiveWithTimeout(gomock.Any()).Return(&response).AnyTimes()
+
+	sensor, err := drivers.NewIoTeeSensor(mockSensor, drivers.KindTemperatureSensor)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeSensor: %v", err)
+	}
+
+	// Only the fan of Room1 may be switched
+	mockFan1 := NewMockIoTee(ctrl)
+	mockFan2 := NewMockIoTee(ctrl)
+
+	switched := make(chan struct{})
+	mockFan1.EXPECT().Transmit(&iotee.Message{
+		MsgType: iotee.MessageTypeRGBLED,
+		DataLen: 4,
+		Data:    []byte{255, 255, 0, 0},
+	}).DoAndReturn(func(msg *iotee.Message) error {
+		close(switched)
+
+		return nil
+	}).Times(1)
+
+	fan1, err := drivers.NewIoTeeActuator(mockFan1, drivers.KindFan)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeActuator: %v", err)
+	}
+
+	fan2, err := drivers.NewIoTeeActuator(mockFan2, drivers.KindFan)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeActuator: %v", err)
+	}
+
+	hub := NewHub(
+		logging.NewDiscardLogger(),
+		ctx,
+		"",
+		map[string]Room{
+			"Room1": {Fan: fan1, TemperatureSensor: sensor, DefaultTemperature: 25, MeasureInterval: time.Millisecond * 100},
+			"Room2": {Fan: fan2},
+		},
+		mqttapi.UnitCelsius,
+		nil,
+		time.Millisecond*100,
+		time.Second,
+		0,
+		0,
+		0,
+		0,
+	)
+
+	if err := OpenHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during OpenHub: %v", err)
+	}
+
+	linkHub(t, ctx, hub, gatewayAddr)
+
+	select {
+	case measurement := <-measurements:
+		if measurement.Value != 24.5 || measurement.DefaultValue != 25 || measurement.Unit != mqttapi.UnitCelsius || measurement.SensorID != "rooms/Room1/temperature" {
+			t.Fatalf("expected measurement of 24.5 °C from rooms/Room1/temperature with default 25, got %v", measurement)
+		}
+
+	case <-time.After(integrationTimeout):
+		t.Fatal("timed out while waiting for measurement")
+	}
+
+	// The fans have been registered by LinkHub, so the command can be published right away
+	if err := broker.Publish("/gateways/TestThing/rooms/Room1/fan", []byte(`{"on":true}`), false, 0); err != nil {
+		t.Fatalf("unexpected error during Publish: %v", err)
+	}
+
+	select {
+	case <-switched:
+	case <-time.After(integrationTimeout):
+		t.Fatal("timed out while waiting for fan to be switched")
+	}
+
+	if err := CloseHub(hub, ctx); err != nil {
+		t.Fatalf("unexpected error during CloseHub: %v", err)
+	}
+}
+
+// TestCommandAcknowledgements checks that every command is acknowledged with its correlation ID,
+// and that failed commands are acknowledged with an error instead of stopping the gateway.
+func TestCommandAcknowledgements(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, brokerAddr := startBroker(t)
+
+	acks := make(chan mqttapi.CommandAck, 10)
+	if err := broker.Subscribe("/gateways/TestThing/rooms/+/fan/state", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		ack := mqttapi.CommandAck{}
+		if err := json.Unmarshal(pk.Payload, &ack); err != nil {
+			t.Errorf("unexpected error during Unmarshal: %v", err)
+
+			return
+		}
+
+		acks <- ack
+	}); err != nil {
+		t.Fatalf("unexpected error during Subscribe: %v", err)
+	}
+
+	peers := func() map[string]HubRemote {
+		return map[string]HubRemote{
+			"testremote": {
+				SetFanOn: func(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+					return nil
+				},
+			},
+		}
+	}
+
+	gateway := connectGateway(t, ctx, brokerAddr, false, "", peers)
+
+	if err := ConnectHub(gateway, "testremote", ""); err != nil {
+		t.Fatalf("unexpected error during ConnectHub: %v", err)
+	}
+
+	if err := gateway.RegisterFans(context.WithValue(ctx, rpc.RemoteIDContextKey, "testremote"), []string{"Room1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterFans: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		topic   string
+		payload string
+		ack     mqttapi.CommandAck
+	}{
+		{
+			"invalid command",
+			"/gateways/TestThing/rooms/Room1/fan",
+			`{"on":`,
+			mqttapi.CommandAck{Applied: false},
+		},
+		{
+			"unknown room",
+			"/gateways/TestThing/rooms/Room2/fan",
+			`{"on":true,"correlationId":"command-1"}`,
+			mqttapi.CommandAck{CorrelationID: "command-1", On: true, Applied: false, Error: ErrNoSuchRoom.Error()},
+		},
+		{
+			"applied command",
+			"/gateways/TestThing/rooms/Room1/fan",
+			`{"on":true,"correlationId":"command-2"}`,
+			mqttapi.CommandAck{CorrelationID: "command-2", On: true, Applied: true},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := broker.Publish(tt.topic, []byte(tt.payload), false, 0); err != nil {
+				t.Fatalf("unexpected error during Publish: %v", err)
+			}
+
+			select {
+			case ack := <-acks:
+				if ack.CorrelationID != tt.ack.CorrelationID || ack.On != tt.ack.On || ack.Applied != tt.ack.Applied || ack.Timestamp == 0 {
+					t.Fatalf("expected acknowledgement %v, got %v", tt.ack, ack)
+				}
+
+				if (tt.ack.Error != "" && ack.Error != tt.ack.Error) || (!tt.ack.Applied && ack.Error == "") || (tt.ack.Applied && ack.Error != "") {
+					t.Fatalf("expected acknowledgement error %q, got %q", tt.ack.Error, ack.Error)
+				}
+
+			case <-time.After(integrationTimeout):
+				t.Fatal("timed out while waiting for acknowledgement")
+			}
+		})
+	}
+}
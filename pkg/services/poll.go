@@ -0,0 +1,77 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/drivers"
+	"github.com/pojntfx/green-guardian-gateway/pkg/metrics"
+	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
+)
+
+// getMeasureLock returns the lock which has to be held while reading a sensor.
+// Sensors which share a device, i.e. the temperature and moisture sensors of an IoTee, share their lock.
+func (w *Hub) getMeasureLock(key string, sensor drivers.Sensor) *sync.Mutex {
+	if device, ok := sensor.(drivers.SharedDevice); ok {
+		key = device.DeviceKey()
+	}
+
+	w.measureLocksLock.Lock()
+	defer w.measureLocksLock.Unlock()
+
+	lock, ok := w.measureLocks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+
+		w.measureLocks[key] = lock
+	}
+
+	return lock
+}
+
+// poll measures a sensor at a fixed rate until ctx is done. Each measurement is due one interval (or the hub's measure interval if it is 0)
+// after the previous one was, no matter how long it took; if the sensor is failing, it backs off from the time of the last failure instead.
+// Measurements which are already overdue once the previous one has completed are skipped and reported as missed deadlines.
+func (w *Hub) poll(ctx context.Context, logger *slog.Logger, key string, getInterval func() time.Duration, measure func(ctx context.Context) int) {
+	due := time.Now()
+	for {
+		failures := measure(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		interval := getInterval()
+		if interval <= 0 {
+			interval = w.getMeasureInterval()
+		}
+
+		now := time.Now()
+		if failures > 0 {
+			due = now.Add(utils.GetBackoff(failures-1, interval, w.maxRetryBackoff))
+		} else {
+			due = due.Add(interval)
+
+			if late := now.Sub(due); late > 0 {
+				missed := int(late/interval) + 1
+
+				metrics.SensorMissedDeadlines.WithLabelValues(key).Add(float64(missed))
+				logger.Warn("Sensor missed its measurement deadline, skipping measurements", "missed", missed, "late", late)
+
+				due = due.Add(time.Duration(missed) * interval)
+			}
+		}
+
+		// wait until the next measurement is due; end the worker if it has been stopped
+		timer := time.NewTimer(due.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return
+
+		case <-timer.C:
+		}
+	}
+}
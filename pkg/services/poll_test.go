@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/drivers"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+	"github.com/pojntfx/green-guardian-gateway/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestPoll checks that sensors are polled at a fixed rate, no matter how long measurements take,
+// and that measurements which are overdue are skipped and counted as missed deadlines.
+func TestPoll(t *testing.T) {
+	hub := NewHub(logging.NewDiscardLogger(), context.Background(), "", nil, mqttapi.UnitCelsius, nil, 0, 0, 0, 0, 0, 0)
+
+	for _, tt := range []struct {
+		name      string
+		key       string
+		durations []time.Duration
+		maxSpan   time.Duration
+		missed    float64
+	}{
+		{"fixed rate", "rooms/Room1/temperature", []time.Duration{25 * time.Millisecond, 25 * time.Millisecond, 25 * time.Millisecond, 25 * time.Millisecond}, 200 * time.Millisecond, 0},
+		{"missed deadline", "rooms/Room2/temperature", []time.Duration{120 * time.Millisecond, 0}, time.Second, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			prevMissed := testutil.ToFloat64(metrics.SensorMissedDeadlines.WithLabelValues(tt.key))
+
+			starts := []time.Time{}
+			hub.poll(ctx, logging.NewDiscardLogger(), tt.key, func() time.Duration {
+				return 50 * time.Millisecond
+			}, func(ctx context.Context) int {
+				starts = append(starts, time.Now())
+
+				time.Sleep(tt.durations[len(starts)-1])
+
+				if len(starts) == len(tt.durations) {
+					cancel()
+				}
+
+				return 0
+			})
+
+			if span := starts[len(starts)-1].Sub(starts[0]); span > tt.maxSpan {
+				t.Fatalf("expected measurements to be taken within %v, took %v", tt.maxSpan, span)
+			}
+
+			if missed := testutil.ToFloat64(metrics.SensorMissedDeadlines.WithLabelValues(tt.key)) - prevMissed; missed != tt.missed {
+				t.Fatalf("expected %v missed deadlines, got %v", tt.missed, missed)
+			}
+		})
+	}
+}
+
+// TestGetMeasureLock checks that sensors share their lock if and only if they share a device.
+func TestGetMeasureLock(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	device, otherDevice := NewMockIoTee(ctrl), NewMockIoTee(ctrl)
+
+	temperatureSensor, err := drivers.NewIoTeeSensor(device, drivers.KindTemperatureSensor)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeSensor: %v", err)
+	}
+
+	moistureSensor, err := drivers.NewIoTeeSensor(device, drivers.KindMoistureSensor)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeSensor: %v", err)
+	}
+
+	otherSensor, err := drivers.NewIoTeeSensor(otherDevice, drivers.KindTemperatureSensor)
+	if err != nil {
+		t.Fatalf("unexpected error during NewIoTeeSensor: %v", err)
+	}
+
+	hub := NewHub(logging.NewDiscardLogger(), context.Background(), "", nil, mqttapi.UnitCelsius, nil, 0, 0, 0, 0, 0, 0)
+
+	if hub.getMeasureLock("rooms/Room1/temperature", temperatureSensor) != hub.getMeasureLock("plants/Room1/moisture", moistureSensor) {
+		t.Fatal("expected sensors of the same device to share their lock")
+	}
+
+	if hub.getMeasureLock("rooms/Room1/temperature", temperatureSensor) == hub.getMeasureLock("rooms/Room2/temperature", otherSensor) {
+		t.Fatal("expected sensors of different devices not to share their lock")
+	}
+}
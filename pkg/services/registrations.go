@@ -0,0 +1,166 @@
+package services
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+type RegistrationPolicy string
+
+const (
+	// RegistrationPolicyReject rejects registering a room or plant which another hub has already registered
+	RegistrationPolicyReject RegistrationPolicy = "reject"
+
+	// RegistrationPolicyLastWins sends commands to the hub which registered a room or plant last, falling back to the previous one if it unregisters
+	RegistrationPolicyLastWins RegistrationPolicy = "last-wins"
+
+	// RegistrationPolicyFanOut sends commands to all hubs which registered a room or plant
+	RegistrationPolicyFanOut RegistrationPolicy = "fan-out"
+)
+
+var (
+	ErrUnknownRegistrationPolicy = errors.New("unknown registration policy")
+	ErrDuplicateRegistration     = errors.New("already registered by another hub")
+)
+
+// ParseRegistrationPolicy parses a registration policy from a string.
+func ParseRegistrationPolicy(policy string) (RegistrationPolicy, error) {
+	switch RegistrationPolicy(policy) {
+	case RegistrationPolicyReject, RegistrationPolicyLastWins, RegistrationPolicyFanOut:
+		return RegistrationPolicy(policy), nil
+
+	default:
+		return "", ErrUnknownRegistrationPolicy
+	}
+}
+
+// registrations keeps track of the hubs which have registered the fans of rooms or the sprinklers of plants
+type registrations struct {
+	peers map[string][]string // IDs of the hubs which registered a room or plant in the order they registered it in
+	lock  sync.Mutex
+}
+
+func newRegistrations() *registrations {
+	return &registrations{
+		peers: map[string][]string{},
+	}
+}
+
+// register registers rooms or plants for a hub and returns the IDs which other hubs have already registered.
+// If the policy rejects duplicates and there are any, nothing is registered.
+func (r *registrations) register(peerID string, ids []string, policy RegistrationPolicy) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	duplicates := []string{}
+	for _, id := range ids {
+		for _, candidate := range r.peers[id] {
+			if candidate != peerID {
+				duplicates = append(duplicates, id)
+
+				break
+			}
+		}
+	}
+
+	if len(duplicates) > 0 && policy == RegistrationPolicyReject {
+		return duplicates, ErrDuplicateRegistration
+	}
+
+	for _, id := range ids {
+		// Registering again moves the hub to the end so that it wins if the last registration wins
+		r.peers[id] = append(removePeer(r.peers[id], peerID), peerID)
+	}
+
+	return duplicates, nil
+}
+
+// unregister unregisters rooms or plants of a hub and returns the IDs which no hub has registered anymore
+func (r *registrations) unregister(peerID string, ids []string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	orphaned := []string{}
+	for _, id := range ids {
+		peers, ok := r.peers[id]
+		if !ok {
+			continue
+		}
+
+		if peers = removePeer(peers, peerID); len(peers) > 0 {
+			r.peers[id] = peers
+
+			continue
+		}
+
+		delete(r.peers, id)
+
+		orphaned = append(orphaned, id)
+	}
+
+	return orphaned
+}
+
+// getIDs returns the IDs of the rooms or plants a hub has registered
+func (r *registrations) getIDs(peerID string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ids := []string{}
+	for id, peers := range r.peers {
+		for _, candidate := range peers {
+			if candidate == peerID {
+				ids = append(ids, id)
+
+				break
+			}
+		}
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+// getPeers returns the IDs of the hubs which commands for a room or plant are sent to
+func (r *registrations) getPeers(id string, policy RegistrationPolicy) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	peers := r.peers[id]
+	if len(peers) == 0 {
+		return nil
+	}
+
+	if policy == RegistrationPolicyFanOut {
+		return append([]string{}, peers...)
+	}
+
+	return []string{peers[len(peers)-1]}
+}
+
+// getAll returns a copy of the IDs of the hubs which have registered each room or plant
+func (r *registrations) getAll() map[string][]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	all := map[string][]string{}
+	for id, peers := range r.peers {
+		all[id] = append([]string{}, peers...)
+	}
+
+	return all
+}
+
+// removePeer returns the peer IDs without the given one
+func removePeer(peers []string, peerID string) []string {
+	remaining := []string{}
+	for _, candidate := range peers {
+		if candidate != peerID {
+			remaining = append(remaining, candidate)
+		}
+	}
+
+	return remaining
+}
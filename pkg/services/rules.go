@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+)
+
+type RulesMode string
+
+const (
+	// RulesModeOff disables local rules; only the cloud controls actuators
+	RulesModeOff RulesMode = "off"
+
+	// RulesModeCloud gives cloud commands priority; local rules only control actuators while the broker is unreachable
+	RulesModeCloud RulesMode = "cloud"
+
+	// RulesModeLocal gives local rules priority; cloud commands are ignored
+	RulesModeLocal RulesMode = "local"
+)
+
+var (
+	ErrUnknownRulesMode        = errors.New("unknown rules mode")
+	ErrInvalidFanOffsets       = errors.New("--rules-fan-off-offset must be below --rules-fan-on-offset")
+	ErrInvalidSprinklerOffsets = errors.New("--rules-sprinkler-off-offset must be below --rules-sprinkler-on-offset")
+)
+
+// Rules describe how the gateway controls fans and sprinklers by itself based on the measurements it receives.
+// All thresholds are relative to the default value which the hub sends with each measurement.
+type Rules struct {
+	Mode RulesMode
+
+	// A fan is turned on once the temperature is >= default + FanOnOffset and turned off once it is <= default + FanOffOffset
+	FanOnOffset,
+	FanOffOffset float64
+
+	// A sprinkler is turned on once the moisture is <= default - SprinklerOnOffset and turned off once it is >= default - SprinklerOffOffset
+	SprinklerOnOffset,
+	SprinklerOffOffset float64
+
+	// Minimum amount of time an actuator stays on or off before the rules switch it again
+	MinOnTime,
+	MinOffTime time.Duration
+}
+
+// ParseRulesMode parses a rules mode from a string.
+func ParseRulesMode(mode string) (RulesMode, error) {
+	switch RulesMode(mode) {
+	case RulesModeOff, RulesModeCloud, RulesModeLocal:
+		return RulesMode(mode), nil
+
+	default:
+		return "", ErrUnknownRulesMode
+	}
+}
+
+// ValidateRules checks that the rules leave a band between the thresholds at which they turn actuators on and off,
+// since actuators would otherwise be switched with every measurement.
+func ValidateRules(rules *Rules) error {
+	if rules.FanOffOffset >= rules.FanOnOffset {
+		return ErrInvalidFanOffsets
+	}
+
+	// Sprinkler offsets are below the default value, so the offset at which they turn off has to be smaller
+	if rules.SprinklerOffOffset >= rules.SprinklerOnOffset {
+		return ErrInvalidSprinklerOffsets
+	}
+
+	return nil
+}
+
+type actuatorState struct {
+	on      bool
+	changed time.Time
+}
+
+// rulesActive returns whether local rules are currently in control of the actuators
+func (w *Gateway) rulesActive() bool {
+	if w.rules == nil {
+		return false
+	}
+
+	switch w.rules.Mode {
+	case RulesModeLocal:
+		return true
+
+	case RulesModeCloud:
+		return !w.broker.IsConnectionOpen()
+
+	default:
+		return false
+	}
+}
+
+// cloudCommandsAllowed returns whether commands from the cloud may control the actuators
+func (w *Gateway) cloudCommandsAllowed() bool {
+	return w.rules == nil || w.rules.Mode != RulesModeLocal
+}
+
+// recordActuatorState stores the state an actuator has been switched to
+func (w *Gateway) recordActuatorState(states map[string]*actuatorState, id string, on bool) {
+	w.actuatorStatesLock.Lock()
+	defer w.actuatorStatesLock.Unlock()
+
+	if state, ok := states[id]; ok && state.on == on {
+		return
+	}
+
+	states[id] = &actuatorState{
+		on:      on,
+		changed: time.Now(),
+	}
+}
+
+// applyRule switches an actuator if a threshold has been crossed and it has been in its current state for long enough
+func (w *Gateway) applyRule(
+	ctx context.Context,
+	states map[string]*actuatorState,
+	id string,
+	turnOn,
+	turnOff bool,
+	set func(ctx context.Context, id string, on bool, runtime time.Duration) error,
+) error {
+	w.actuatorStatesLock.Lock()
+
+	state, known := states[id]
+
+	on := false
+	switch {
+	case turnOn && (!known || !state.on):
+		on = true
+
+	case turnOff && (!known || state.on):
+		on = false
+
+	default:
+		// Within the hysteresis band or already in the desired state
+		w.actuatorStatesLock.Unlock()
+
+		return nil
+	}
+
+	if known {
+		minDuration := w.rules.MinOffTime
+		if state.on {
+			minDuration = w.rules.MinOnTime
+		}
+
+		if time.Since(state.changed) < minDuration {
+			w.actuatorStatesLock.Unlock()
+
+			return nil
+		}
+	}
+
+	w.actuatorStatesLock.Unlock()
+
+	// Rules keep actuators on until they turn them off again
+	return set(ctx, id, on, 0)
+}
+
+// evaluateTemperature applies the fan rule for a room
+func (w *Gateway) evaluateTemperature(ctx context.Context, roomID string, measurement, defaultValue float64) {
+	if !w.rulesActive() {
+		return
+	}
+
+	if err := w.applyRule(
+		ctx,
+		w.fanStates,
+		roomID,
+		measurement >= defaultValue+w.rules.FanOnOffset,
+		measurement <= defaultValue+w.rules.FanOffOffset,
+		w.setFanOn,
+	); err != nil {
+		w.rulesLogger.Debug("Could not apply fan rule, continuing", logging.KeyRoomID, roomID, logging.KeyError, err)
+	}
+}
+
+// evaluateMoisture applies the sprinkler rule for a plant
+func (w *Gateway) evaluateMoisture(ctx context.Context, plantID string, measurement, defaultValue float64) {
+	if !w.rulesActive() {
+		return
+	}
+
+	if err := w.applyRule(
+		ctx,
+		w.sprinklerStates,
+		plantID,
+		measurement <= defaultValue-w.rules.SprinklerOnOffset,
+		measurement >= defaultValue-w.rules.SprinklerOffOffset,
+		w.setSprinklerOn,
+	); err != nil {
+		w.rulesLogger.Debug("Could not apply sprinkler rule, continuing", logging.KeyPlantID, plantID, logging.KeyError, err)
+	}
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+)
+
+// newRulesTestGateway creates a gateway with local rules and a single hub
+// which records all fan commands it receives.
+func newRulesTestGateway(t *testing.T, rules *Rules) (*Gateway, context.Context, *[]bool) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	gateway := newTestGateway(ctx, testGatewayOptions{rules: rules})
+
+	commands := []bool{}
+	gateway.Peers = func() map[string]HubRemote {
+		return map[string]HubRemote{
+			"testremote": {
+				SetFanOn: func(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+					commands = append(commands, on)
+
+					return nil
+				},
+			},
+		}
+	}
+
+	if err := gateway.RegisterFans(ctx, []string{"Room1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterFans: %v", err)
+	}
+
+	return gateway, ctx, &commands
+}
+
+// TestFanRuleHysteresis checks that the fan rule only switches once a threshold has been crossed
+// and keeps the fan's state while the temperature is within the hysteresis band.
+func TestFanRuleHysteresis(t *testing.T) {
+	gateway, ctx, commands := newRulesTestGateway(t, &Rules{
+		Mode: RulesModeLocal,
+
+		FanOnOffset:  2,
+		FanOffOffset: 0,
+	})
+
+	for _, measurement := range []float64{26, 26.5, 27, 26, 25, 26} {
+		gateway.evaluateTemperature(ctx, "Room1", measurement, 25)
+	}
+
+	expected := []bool{true, false}
+	if len(*commands) != len(expected) {
+		t.Fatalf("expected fan commands %v, got %v", expected, *commands)
+	}
+
+	for i, on := range expected {
+		if (*commands)[i] != on {
+			t.Fatalf("expected fan commands %v, got %v", expected, *commands)
+		}
+	}
+}
+
+// TestFanRuleMinOnTime checks that the fan rule does not turn a fan off before its minimum on time has passed.
+func TestFanRuleMinOnTime(t *testing.T) {
+	gateway, ctx, commands := newRulesTestGateway(t, &Rules{
+		Mode: RulesModeLocal,
+
+		FanOnOffset:  2,
+		FanOffOffset: 0,
+
+		MinOnTime: time.Hour,
+	})
+
+	gateway.evaluateTemperature(ctx, "Room1", 30, 25)
+	gateway.evaluateTemperature(ctx, "Room1", 20, 25)
+
+	if len(*commands) != 1 || !(*commands)[0] {
+		t.Fatalf("expected fan to only be turned on, got %v", *commands)
+	}
+}
+
+// TestRulesModeOff checks that no commands are sent if local rules are disabled.
+func TestRulesModeOff(t *testing.T) {
+	gateway, ctx, commands := newRulesTestGateway(t, &Rules{
+		Mode: RulesModeOff,
+	})
+
+	gateway.evaluateTemperature(ctx, "Room1", 30, 25)
+
+	if len(*commands) != 0 {
+		t.Fatalf("expected no fan commands, got %v", *commands)
+	}
+}
+
+// TestValidateRules checks that rules without a band between their on and off thresholds are rejected.
+func TestValidateRules(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		rules Rules
+		err   error
+	}{
+		{"with bands", Rules{FanOnOffset: 2, SprinklerOnOffset: 5}, nil},
+		{"without fan band", Rules{FanOnOffset: 2, FanOffOffset: 2, SprinklerOnOffset: 5}, ErrInvalidFanOffsets},
+		{"without sprinkler band", Rules{FanOnOffset: 2, SprinklerOnOffset: 5, SprinklerOffOffset: 6}, ErrInvalidSprinklerOffsets},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateRules(&tt.rules); !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// TestFanRuleAfterReportedState checks that the fan rule turns a fan on again
+// once its hub has reported that it turned the fan off on its own.
+func TestFanRuleAfterReportedState(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockClient(ctrl)
+	mockToken := NewMockToken(ctrl)
+
+	mockToken.EXPECT().Wait().Return(true).AnyTimes()
+	mockToken.EXPECT().Error().Return(nil).AnyTimes()
+
+	mockBroker.EXPECT().IsConnectionOpen().Return(true).AnyTimes()
+
+	// The state has to be published to the fan's state topic
+	mockBroker.EXPECT().Publish("/gateways/TestThing/rooms/Room1/fan/state", byte(1), false, gomock.Any()).Return(mockToken).Times(1)
+	mockBroker.EXPECT().Publish(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(mockToken).AnyTimes()
+
+	gateway := newTestGateway(ctx, testGatewayOptions{broker: mockBroker, rules: &Rules{
+		Mode: RulesModeLocal,
+
+		FanOnOffset:  2,
+		FanOffOffset: 0,
+	}})
+
+	commands := []bool{}
+	gateway.Peers = func() map[string]HubRemote {
+		return map[string]HubRemote{
+			"testremote": {
+				SetFanOn: func(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+					commands = append(commands, on)
+
+					return nil
+				},
+			},
+		}
+	}
+
+	if err := gateway.RegisterFans(ctx, []string{"Room1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterFans: %v", err)
+	}
+
+	gateway.evaluateTemperature(ctx, "Room1", 30, 25)
+
+	if err := gateway.ReportFanState(ctx, "Room1", false); err != nil {
+		t.Fatalf("unexpected error during ReportFanState: %v", err)
+	}
+
+	gateway.evaluateTemperature(ctx, "Room1", 30, 25)
+
+	if len(commands) != 2 || !commands[0] || !commands[1] {
+		t.Fatalf("expected fan to be turned on twice, got %v", commands)
+	}
+}
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/green-guardian-gateway/pkg/drivers"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+	"github.com/pojntfx/green-guardian-gateway/pkg/metrics"
+	"github.com/pojntfx/green-guardian-gateway/pkg/utils"
+)
+
+const (
+	// Interval after which turning off an actuator is retried first; it doubles with every failed attempt up to the hub's maximum retry backoff
+	shutOffRetryInterval = time.Second
+)
+
+var (
+	ErrShutOffFailed = errors.New("could not turn actuators off")
+)
+
+// shutOff turns an actuator off once its runtime has elapsed
+type shutOff struct {
+	key      string
+	timer    *time.Timer
+	actuator drivers.Actuator
+	logger   *slog.Logger
+
+	// Tells the gateway that the actuator has been turned off, since it would otherwise assume that it is still on
+	report func(ctx context.Context, gateway *GatewayRemote) error
+
+	// Error of the latest attempt to turn the actuator off if it failed
+	err error
+}
+
+// getRuntime returns how long an actuator stays on after it has been turned on: The requested runtime, capped at the
+// actuator's maximum runtime. If it is 0, the actuator stays on until it is turned off.
+func getRuntime(runtime, maxRuntime time.Duration) time.Duration {
+	if runtime < 0 {
+		runtime = 0
+	}
+
+	if maxRuntime > 0 && (runtime == 0 || runtime > maxRuntime) {
+		return maxRuntime
+	}
+
+	return runtime
+}
+
+// getActuatorLock returns the lock which has to be held while switching an actuator
+func (w *Hub) getActuatorLock(key string) *sync.Mutex {
+	w.shutOffsLock.Lock()
+	defer w.shutOffsLock.Unlock()
+
+	lock, ok := w.actuatorLocks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+
+		w.actuatorLocks[key] = lock
+	}
+
+	return lock
+}
+
+// takeShutOff removes the pending shut-off of an actuator and returns it, or nil if there is none
+func (w *Hub) takeShutOff(key string) *shutOff {
+	w.shutOffsLock.Lock()
+	defer w.shutOffsLock.Unlock()
+
+	pending, ok := w.shutOffs[key]
+	if !ok {
+		return nil
+	}
+
+	pending.timer.Stop()
+
+	delete(w.shutOffs, key)
+
+	return pending
+}
+
+// switchActuator turns an actuator on or off. If runtime is set, the actuator is turned off again once it has elapsed,
+// even if the hub is no longer linked to a gateway by then; report is used to tell the gateway about it.
+func (w *Hub) switchActuator(
+	ctx context.Context,
+	logger *slog.Logger,
+	key string,
+	actuator drivers.Actuator,
+	on bool,
+	runtime time.Duration,
+	report func(ctx context.Context, gateway *GatewayRemote) error,
+) error {
+	lock := w.getActuatorLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// If the actuator couldn't be switched, it might still be on, so its pending shut-off is kept
+	if err := actuator.Set(ctx, on); err != nil {
+		return err
+	}
+
+	// Every command which has been applied replaces the pending shut-off
+	w.takeShutOff(key)
+
+	if !on || runtime <= 0 {
+		return nil
+	}
+
+	s := &shutOff{
+		key:      key,
+		actuator: actuator,
+		logger:   logger,
+		report:   report,
+	}
+
+	// The actuator lock is held until the timer has been stored, so it can't turn the actuator off before that
+	s.timer = time.AfterFunc(runtime, func() {
+		logger.Info("Turning actuator off since its runtime has elapsed", "runtime", runtime)
+
+		w.retryShutOff(lock, s)
+	})
+
+	w.shutOffsLock.Lock()
+	w.shutOffs[key] = s
+	w.shutOffsLock.Unlock()
+
+	return nil
+}
+
+// isPendingShutOff returns whether a shut-off is still pending, i.e. since the actuator hasn't been switched again in the meantime.
+// The caller must hold the shut-offs lock.
+func (w *Hub) isPendingShutOff(s *shutOff) bool {
+	return w.shutOffs[s.key] == s
+}
+
+// retryShutOff turns an actuator off, retrying with a backoff until it has succeeded, the actuator has been switched again or the hub is closed.
+// Failures are counted and fail the hub's readiness, since the actuator might keep running.
+func (w *Hub) retryShutOff(lock *sync.Mutex, s *shutOff) {
+	maxBackoff := w.maxRetryBackoff
+	if maxBackoff < shutOffRetryInterval {
+		maxBackoff = shutOffRetryInterval
+	}
+
+	for attempt := 0; ; attempt++ {
+		lock.Lock()
+
+		w.shutOffsLock.Lock()
+		pending := w.isPendingShutOff(s)
+		w.shutOffsLock.Unlock()
+
+		if !pending {
+			lock.Unlock()
+
+			return
+		}
+
+		err := s.actuator.Set(w.ctx, false)
+
+		w.shutOffsLock.Lock()
+		if err == nil {
+			delete(w.shutOffs, s.key)
+		} else {
+			s.err = err
+		}
+		w.shutOffsLock.Unlock()
+
+		lock.Unlock()
+
+		if err == nil {
+			w.reportShutOff(s)
+
+			return
+		}
+
+		metrics.ActuatorShutOffFailures.WithLabelValues(s.key).Inc()
+
+		backoff := utils.GetBackoff(attempt, shutOffRetryInterval, maxBackoff)
+
+		// The actuator might keep running, so this needs attention
+		s.logger.Error("Could not turn actuator off, retrying", "attempts", attempt+1, "backoff", backoff, logging.KeyError, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-w.ctx.Done():
+			timer.Stop()
+
+			return
+
+		case <-timer.C:
+		}
+	}
+}
+
+// turnOff turns the actuator off right away
+func (w *Hub) turnOff(ctx context.Context, s *shutOff) {
+	if err := s.actuator.Set(ctx, false); err != nil {
+		metrics.ActuatorShutOffFailures.WithLabelValues(s.key).Inc()
+
+		// The actuator might keep running, so this needs attention
+		s.logger.Error("Could not turn actuator off", logging.KeyError, err)
+
+		return
+	}
+
+	w.reportShutOff(s)
+}
+
+// reportShutOff tells the gateway that an actuator has been turned off
+func (w *Hub) reportShutOff(s *shutOff) {
+	if s.report != nil {
+		w.queueDelivery(s.report)
+	}
+}
+
+// shutOffNow turns off the actuators with the given keys right away if they have a pending shut-off,
+// i.e. because they are about to be removed or the hub is being closed
+func (w *Hub) shutOffNow(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		lock := w.getActuatorLock(key)
+		lock.Lock()
+
+		if pending := w.takeShutOff(key); pending != nil {
+			pending.logger.Info("Turning actuator off before its runtime has elapsed")
+
+			w.turnOff(ctx, pending)
+		}
+
+		lock.Unlock()
+	}
+}
+
+// getPendingShutOffs returns the keys of all actuators which have a pending shut-off
+func (w *Hub) getPendingShutOffs() []string {
+	w.shutOffsLock.Lock()
+	defer w.shutOffsLock.Unlock()
+
+	keys := []string{}
+	for key := range w.shutOffs {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// checkShutOffs returns an error if actuators couldn't be turned off once their runtime had elapsed
+func (w *Hub) checkShutOffs() error {
+	w.shutOffsLock.Lock()
+	defer w.shutOffsLock.Unlock()
+
+	keys := []string{}
+	for key, s := range w.shutOffs {
+		if s.err != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sort.Strings(keys)
+
+	return fmt.Errorf("%w: %v", ErrShutOffFailed, keys)
+}
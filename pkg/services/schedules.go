@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	ErrEmptyScheduleID     = errors.New("schedule ID must not be empty")
+	ErrDuplicateScheduleID = errors.New("schedule ID is used more than once")
+	ErrInvalidTarget       = errors.New("exactly one of roomId and plantId must be set")
+	ErrInvalidTiming       = errors.New("exactly one of cron and interval must be set")
+	ErrIntervalTooShort    = errors.New("interval must be at least one second")
+	ErrInvalidDuration     = errors.New("duration must be positive")
+)
+
+// getSchedulesTopic returns the retained topic the schedules are managed with
+func (w *Gateway) getSchedulesTopic() string {
+	return path.Join("/gateways", w.thingName, "schedules")
+}
+
+// parseSchedules validates schedules and returns when each of them runs
+func parseSchedules(schedules mqttapi.Schedules) ([]cron.Schedule, error) {
+	timings := []cron.Schedule{}
+	ids := map[string]struct{}{}
+	errs := []error{}
+
+	for _, schedule := range schedules.Schedules {
+		if schedule.ID == "" {
+			errs = append(errs, ErrEmptyScheduleID)
+		}
+
+		if _, ok := ids[schedule.ID]; ok {
+			errs = append(errs, fmt.Errorf("%q: %w", schedule.ID, ErrDuplicateScheduleID))
+		}
+		ids[schedule.ID] = struct{}{}
+
+		if (schedule.RoomID == "") == (schedule.PlantID == "") {
+			errs = append(errs, fmt.Errorf("%q: %w", schedule.ID, ErrInvalidTarget))
+		}
+
+		if schedule.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("%q: %w", schedule.ID, ErrInvalidDuration))
+		}
+
+		var timing cron.Schedule
+		switch {
+		case (schedule.Cron == "") == (schedule.Interval == 0):
+			errs = append(errs, fmt.Errorf("%q: %w", schedule.ID, ErrInvalidTiming))
+
+		case schedule.Cron != "":
+			var err error
+			if timing, err = cron.ParseStandard(schedule.Cron); err != nil {
+				errs = append(errs, fmt.Errorf("%q: %w", schedule.ID, err))
+			}
+
+		case schedule.Interval < time.Second.Milliseconds():
+			errs = append(errs, fmt.Errorf("%q: %w", schedule.ID, ErrIntervalTooShort))
+
+		default:
+			timing = cron.Every(time.Duration(schedule.Interval) * time.Millisecond)
+		}
+
+		timings = append(timings, timing)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return timings, nil
+}
+
+// loadSchedules reads the schedules which have been persisted; if there are none, no schedules are returned
+func loadSchedules(file string) (mqttapi.Schedules, error) {
+	schedules := mqttapi.Schedules{}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return schedules, nil
+		}
+
+		return schedules, err
+	}
+
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return schedules, err
+	}
+
+	return schedules, nil
+}
+
+// saveSchedules persists schedules so that they keep running if the gateway is restarted while the broker is unreachable
+func saveSchedules(file string, schedules mqttapi.Schedules) error {
+	data, err := json.MarshalIndent(schedules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves partial schedules behind
+	if err := os.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// applySchedules replaces the schedules the gateway runs
+func (w *Gateway) applySchedules(ctx context.Context, schedules mqttapi.Schedules) error {
+	timings, err := parseSchedules(schedules)
+	if err != nil {
+		return err
+	}
+
+	scheduler := cron.New(cron.WithLogger(cron.DiscardLogger))
+	for i, schedule := range schedules.Schedules {
+		schedule := schedule
+
+		scheduler.Schedule(timings[i], cron.FuncJob(func() {
+			w.runSchedule(ctx, schedule)
+		}))
+	}
+
+	w.schedulesLock.Lock()
+	defer w.schedulesLock.Unlock()
+
+	// Runs which have already started complete in the background
+	if w.scheduler != nil {
+		w.scheduler.Stop()
+	}
+
+	w.schedules = schedules
+	w.scheduler = scheduler
+
+	w.scheduler.Start()
+
+	w.schedulerLogger.Info("Applied schedules", "schedules", len(schedules.Schedules))
+
+	return nil
+}
+
+// stopSchedules stops running the schedules
+func (w *Gateway) stopSchedules() {
+	w.schedulesLock.Lock()
+	defer w.schedulesLock.Unlock()
+
+	if w.scheduler != nil {
+		w.scheduler.Stop()
+
+		w.scheduler = nil
+	}
+}
+
+// isScheduleSkipped returns whether a run of a schedule is skipped because of the last measurement of its room or plant
+func isScheduleSkipped(condition *mqttapi.ScheduleCondition, measurement mqttapi.Measurement) bool {
+	if condition == nil {
+		return false
+	}
+
+	offset := 0.0
+	if condition.RelativeToDefault {
+		offset = measurement.DefaultValue
+	}
+
+	return (condition.Above != nil && measurement.Value > offset+*condition.Above) ||
+		(condition.Below != nil && measurement.Value < offset+*condition.Below)
+}
+
+// runSchedule turns the fan or sprinkler of a schedule on for the schedule's duration unless its condition is met
+func (w *Gateway) runSchedule(ctx context.Context, schedule mqttapi.Schedule) {
+	logger := w.schedulerLogger.With(logging.KeySchedule, schedule.ID)
+
+	id := schedule.RoomID
+	measurements := w.temperatures
+	set := w.setFanOn
+	if schedule.PlantID != "" {
+		id = schedule.PlantID
+		measurements = w.moistures
+		set = w.setSprinklerOn
+	}
+
+	w.measurementsLock.Lock()
+	measurement, ok := measurements[id]
+	w.measurementsLock.Unlock()
+
+	// Without a measurement, the schedule runs since it is unknown whether the condition is met
+	if ok && isScheduleSkipped(schedule.Unless, measurement) {
+		logger.Info("Skipping run of schedule since its condition is met", "measurement", measurement.Value, "default", measurement.DefaultValue)
+
+		return
+	}
+
+	// The hub turns the actuator off again once the duration has elapsed, even if it loses its connection to the gateway
+	duration := time.Duration(schedule.Duration) * time.Millisecond
+	if err := set(ctx, id, true, duration); err != nil {
+		logger.Warn("Could not run schedule, continuing", "id", id, logging.KeyError, err)
+
+		return
+	}
+
+	logger.Info("Ran schedule", "id", id, "duration", duration)
+}
+
+// updateSchedules applies and persists the schedules of a message on the schedules topic
+func (w *Gateway) updateSchedules(ctx context.Context, payload []byte) error {
+	// Clearing the retained message removes all schedules
+	schedules := mqttapi.Schedules{}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &schedules); err != nil {
+			return err
+		}
+	}
+
+	// The retained message is received again every time the gateway subscribes
+	w.schedulesLock.Lock()
+	unchanged := reflect.DeepEqual(w.schedules, schedules)
+	w.schedulesLock.Unlock()
+
+	if unchanged {
+		return nil
+	}
+
+	if err := w.applySchedules(ctx, schedules); err != nil {
+		return err
+	}
+
+	return saveSchedules(w.schedulesFile, schedules)
+}
+
+// subscribeSchedules subscribes to the retained schedules topic
+func (w *Gateway) subscribeSchedules(ctx context.Context) error {
+	if token := w.broker.Subscribe(
+		w.getSchedulesTopic(),
+		1,
+		func(client mqtt.Client, msg mqtt.Message) {
+			// Invalid schedules are ignored, so the previous schedules keep running
+			if err := w.updateSchedules(ctx, msg.Payload()); err != nil {
+				w.schedulerLogger.Warn("Could not update schedules, continuing", logging.KeyError, err)
+			}
+		},
+	); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
+
+// openSchedules starts running the schedules which have been persisted
+func (w *Gateway) openSchedules(ctx context.Context) error {
+	schedules, err := loadSchedules(w.schedulesFile)
+	if err != nil {
+		return err
+	}
+
+	return w.applySchedules(ctx, schedules)
+}
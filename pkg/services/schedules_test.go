@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+)
+
+// TestParseSchedules checks that invalid schedules are rejected.
+func TestParseSchedules(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		schedule mqttapi.Schedule
+		err      error
+	}{
+		{"cron", mqttapi.Schedule{ID: "water", PlantID: "Plant1", Cron: "0 6 * * *", Duration: 120000}, nil},
+		{"interval", mqttapi.Schedule{ID: "air", RoomID: "Room1", Interval: 3600000, Duration: 60000}, nil},
+		{"without ID", mqttapi.Schedule{PlantID: "Plant1", Cron: "0 6 * * *", Duration: 120000}, ErrEmptyScheduleID},
+		{"without room or plant", mqttapi.Schedule{ID: "water", Cron: "0 6 * * *", Duration: 120000}, ErrInvalidTarget},
+		{"with room and plant", mqttapi.Schedule{ID: "water", RoomID: "Room1", PlantID: "Plant1", Cron: "0 6 * * *", Duration: 120000}, ErrInvalidTarget},
+		{"with cron and interval", mqttapi.Schedule{ID: "water", PlantID: "Plant1", Cron: "0 6 * * *", Interval: 3600000, Duration: 120000}, ErrInvalidTiming},
+		{"with short interval", mqttapi.Schedule{ID: "water", PlantID: "Plant1", Interval: 500, Duration: 120000}, ErrIntervalTooShort},
+		{"without duration", mqttapi.Schedule{ID: "water", PlantID: "Plant1", Cron: "0 6 * * *"}, ErrInvalidDuration},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSchedules(mqttapi.Schedules{Schedules: []mqttapi.Schedule{tt.schedule}})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if _, err := parseSchedules(mqttapi.Schedules{Schedules: []mqttapi.Schedule{{ID: "water", PlantID: "Plant1", Cron: "0 61 * * *", Duration: 120000}}}); err == nil {
+		t.Fatal("expected error for invalid cron expression, got nil")
+	}
+
+	if _, err := parseSchedules(mqttapi.Schedules{Schedules: []mqttapi.Schedule{
+		{ID: "water", PlantID: "Plant1", Cron: "0 6 * * *", Duration: 120000},
+		{ID: "water", PlantID: "Plant2", Cron: "0 6 * * *", Duration: 120000},
+	}}); !errors.Is(err, ErrDuplicateScheduleID) {
+		t.Fatalf("expected error %v, got %v", ErrDuplicateScheduleID, err)
+	}
+}
+
+// TestRunSchedule checks that a schedule turns its sprinkler on for its duration unless its condition is met.
+func TestRunSchedule(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rpc.RemoteIDContextKey, "testremote")
+
+	gateway := newTestGateway(ctx, testGatewayOptions{})
+
+	runtimes := []time.Duration{}
+	gateway.Peers = func() map[string]HubRemote {
+		return map[string]HubRemote{
+			"testremote": {
+				SetSprinklerOn: func(ctx context.Context, plantID string, on bool, runtime time.Duration) error {
+					runtimes = append(runtimes, runtime)
+
+					return nil
+				},
+			},
+		}
+	}
+
+	if err := gateway.RegisterSprinklers(ctx, []string{"Plant1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterSprinklers: %v", err)
+	}
+
+	above := 0.0
+	schedule := mqttapi.Schedule{
+		ID:       "water",
+		PlantID:  "Plant1",
+		Cron:     "0 6 * * *",
+		Duration: 120000,
+		Unless: &mqttapi.ScheduleCondition{
+			Above:             &above,
+			RelativeToDefault: true,
+		},
+	}
+
+	for _, tt := range []struct {
+		name        string
+		measurement *mqttapi.MoistureMeasurement
+		runs        int
+	}{
+		{"without measurement", nil, 1},
+		{"with moisture below default", &mqttapi.MoistureMeasurement{Value: 25, DefaultValue: 30}, 1},
+		{"with moisture above default", &mqttapi.MoistureMeasurement{Value: 35, DefaultValue: 30}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			runtimes = []time.Duration{}
+
+			gateway.measurementsLock.Lock()
+			delete(gateway.moistures, "Plant1")
+			if tt.measurement != nil {
+				gateway.moistures["Plant1"] = *tt.measurement
+			}
+			gateway.measurementsLock.Unlock()
+
+			gateway.runSchedule(ctx, schedule)
+
+			if len(runtimes) != tt.runs {
+				t.Fatalf("expected %v runs, got %v", tt.runs, len(runtimes))
+			}
+
+			for _, runtime := range runtimes {
+				if runtime != 2*time.Minute {
+					t.Fatalf("expected sprinkler to be turned on for 2m, got %v", runtime)
+				}
+			}
+		})
+	}
+}
+
+// TestSchedules checks that the gateway runs the schedules which are set on the retained schedules topic and persists them.
+func TestSchedules(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, brokerAddr := startBroker(t)
+
+	if err := broker.Publish("/gateways/TestThing/schedules", []byte(`{"schedules":[{"id":"water","plantId":"Plant1","interval":1000,"duration":120000}]}`), true, 1); err != nil {
+		t.Fatalf("unexpected error during Publish: %v", err)
+	}
+
+	schedulesFile := filepath.Join(t.TempDir(), "schedules.json")
+
+	runtimes := make(chan time.Duration, 10)
+	peers := func() map[string]HubRemote {
+		return map[string]HubRemote{
+			"testremote": {
+				SetSprinklerOn: func(ctx context.Context, plantID string, on bool, runtime time.Duration) error {
+					runtimes <- runtime
+
+					return nil
+				},
+			},
+		}
+	}
+
+	gateway := connectGateway(t, ctx, brokerAddr, false, schedulesFile, peers)
+	t.Cleanup(gateway.stopSchedules)
+
+	if err := ConnectHub(gateway, "testremote", ""); err != nil {
+		t.Fatalf("unexpected error during ConnectHub: %v", err)
+	}
+
+	if err := gateway.RegisterSprinklers(context.WithValue(ctx, rpc.RemoteIDContextKey, "testremote"), []string{"Plant1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterSprinklers: %v", err)
+	}
+
+	select {
+	case runtime := <-runtimes:
+		if runtime != 2*time.Minute {
+			t.Fatalf("expected sprinkler to be turned on for 2m, got %v", runtime)
+		}
+
+	case <-time.After(integrationTimeout):
+		t.Fatal("timed out while waiting for schedule to run")
+	}
+
+	schedules, err := loadSchedules(schedulesFile)
+	if err != nil {
+		t.Fatalf("unexpected error during loadSchedules: %v", err)
+	}
+
+	if len(schedules.Schedules) != 1 || schedules.Schedules[0].ID != "water" {
+		t.Fatalf("expected schedule water to be persisted, got %v", schedules)
+	}
+}
@@ -0,0 +1,235 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+	"github.com/pojntfx/green-guardian-gateway/pkg/logging"
+)
+
+const (
+	// Fans and sprinklers are synchronised with named shadows, i.e. room-1 for the fan of room 1
+	shadowPrefixRoom  = "room-"
+	shadowPrefixPlant = "plant-"
+)
+
+var (
+	ErrInvalidShadowName = errors.New("ID can't be used in a shadow name")
+
+	// AWS IoT only allows these characters in shadow names
+	shadowNamePattern = regexp.MustCompile(`^[a-zA-Z0-9:_-]{1,64}$`)
+)
+
+// getShadowName returns the name of the shadow of a room's fan or a plant's sprinkler.
+// The namespace separator isn't allowed in shadow names, so it is replaced with a colon.
+func getShadowName(prefix, id string) (string, error) {
+	name := prefix + strings.ReplaceAll(id, NamespaceSeparator, ":")
+	if !shadowNamePattern.MatchString(name) {
+		return "", ErrInvalidShadowName
+	}
+
+	return name, nil
+}
+
+// getShadowTopic returns a topic of the named shadow API, i.e. $aws/things/<thing>/shadow/name/room-1/update
+func (w *Gateway) getShadowTopic(name string, suffix ...string) string {
+	return path.Join(append([]string{"$aws/things", w.thingName, "shadow/name", name}, suffix...)...)
+}
+
+// getShadowRegistrations returns the registrations of the fans and sprinklers by the prefixes of their shadows' names
+func (w *Gateway) getShadowRegistrations() map[string]*registrations {
+	return map[string]*registrations{
+		shadowPrefixRoom:  w.fans,
+		shadowPrefixPlant: w.sprinklers,
+	}
+}
+
+// getShadowActuator returns the shadow name prefix and ID of the fan or sprinkler which a shadow belongs to
+func (w *Gateway) getShadowActuator(name string) (string, string, bool) {
+	for prefix, registrations := range w.getShadowRegistrations() {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		// Shadow names can't be mapped back to IDs, so look for the registered ID which has this shadow name
+		for id := range registrations.getAll() {
+			if candidate, err := getShadowName(prefix, id); err == nil && candidate == name {
+				return prefix, id, true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+// applyShadow switches a fan or sprinkler to the desired state of its shadow
+func (w *Gateway) applyShadow(ctx context.Context, name string, desired mqttapi.ActuatorShadowState) {
+	if desired.On == nil {
+		return
+	}
+
+	prefix, id, ok := w.getShadowActuator(name)
+	if !ok {
+		// The shadow might belong to an actuator which another gateway or a hub which has disconnected manages
+		w.mqttLogger.Debug("Ignoring desired state of shadow without a registered actuator", logging.KeyShadow, name)
+
+		return
+	}
+
+	// Ignore cloud commands if local rules take priority
+	if !w.cloudCommandsAllowed() {
+		w.mqttLogger.Debug("Ignoring desired state of shadow since local rules take priority", logging.KeyShadow, name)
+
+		return
+	}
+
+	// The switched state is reported by setFanOn and setSprinklerOn
+	var err error
+	if prefix == shadowPrefixRoom {
+		err = w.setFanOn(ctx, id, *desired.On, 0)
+	} else {
+		err = w.setSprinklerOn(ctx, id, *desired.On, 0)
+	}
+
+	if err != nil {
+		// The state stays unreported, so the delta is sent again once the shadow is requested again
+		w.mqttLogger.Warn("Could not apply desired state of shadow, continuing", logging.KeyShadow, name, logging.KeyError, err)
+	}
+}
+
+// reportShadow reports the state a fan or sprinkler has been switched to in its shadow
+func (w *Gateway) reportShadow(prefix, id string, on bool) {
+	w.updateShadow(prefix, id, mqttapi.ShadowState{
+		Reported: &mqttapi.ActuatorShadowState{
+			On: &on,
+		},
+	})
+}
+
+// resetShadow reports the state a hub has switched a fan or sprinkler to on its own and sets it as the desired state
+func (w *Gateway) resetShadow(prefix, id string, on bool) {
+	w.updateShadow(prefix, id, mqttapi.ShadowState{
+		Desired: &mqttapi.ActuatorShadowState{
+			On: &on,
+		},
+		Reported: &mqttapi.ActuatorShadowState{
+			On: &on,
+		},
+	})
+}
+
+// updateShadow updates the shadow of a fan or sprinkler
+func (w *Gateway) updateShadow(prefix, id string, state mqttapi.ShadowState) {
+	if !w.shadows {
+		return
+	}
+
+	name, err := getShadowName(prefix, id)
+	if err != nil {
+		return
+	}
+
+	msg, err := json.Marshal(mqttapi.ShadowDocument{
+		State: state,
+	})
+	if err != nil {
+		w.mqttLogger.Warn("Could not encode state of shadow, continuing", logging.KeyShadow, name, logging.KeyError, err)
+
+		return
+	}
+
+	if err := w.publish(w.getShadowTopic(name, "update"), 1, false, msg); err != nil {
+		w.mqttLogger.Warn("Could not update state of shadow, continuing", logging.KeyShadow, name, logging.KeyError, err)
+	}
+}
+
+// requestShadows requests the shadows of fans or sprinklers so that their desired state is applied,
+// i.e. once they have been registered or once the gateway has reconnected to the broker
+func (w *Gateway) requestShadows(prefix string, ids []string) {
+	if !w.shadows {
+		return
+	}
+
+	for _, id := range ids {
+		name, err := getShadowName(prefix, id)
+		if err != nil {
+			w.mqttLogger.Warn("Not synchronising actuator with a shadow", "id", id, logging.KeyError, err)
+
+			continue
+		}
+
+		// If the broker is unreachable, the shadows are requested again once the gateway has reconnected
+		if err := w.publishToBroker(w.getShadowTopic(name, "get"), 1, false, []byte("{}")); err != nil {
+			w.mqttLogger.Warn("Could not request shadow, continuing", logging.KeyShadow, name, logging.KeyError, err)
+		}
+	}
+}
+
+// requestAllShadows requests the shadows of all registered fans and sprinklers
+func (w *Gateway) requestAllShadows() {
+	for prefix, registrations := range w.getShadowRegistrations() {
+		ids := []string{}
+		for id := range registrations.getAll() {
+			ids = append(ids, id)
+		}
+
+		w.requestShadows(prefix, ids)
+	}
+}
+
+// subscribeShadows subscribes to the desired states of the shadows of all fans and sprinklers
+func (w *Gateway) subscribeShadows(ctx context.Context) error {
+	// Subscribe to changes of the desired state
+	if token := w.broker.Subscribe(
+		w.getShadowTopic("+", "update", "delta"),
+		1,
+		func(client mqtt.Client, msg mqtt.Message) {
+			name := path.Base(path.Dir(path.Dir(msg.Topic())))
+
+			delta := mqttapi.ShadowDelta{}
+			if err := json.Unmarshal(msg.Payload(), &delta); err != nil {
+				w.mqttLogger.Warn("Could not parse shadow delta, continuing", logging.KeyShadow, name, logging.KeyError, err)
+
+				return
+			}
+
+			w.queueCommand(func() {
+				w.applyShadow(ctx, name, delta.State)
+			})
+		},
+	); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	// Subscribe to requested shadows, which contain a delta if the desired state differs from the reported one
+	if token := w.broker.Subscribe(
+		w.getShadowTopic("+", "get", "accepted"),
+		1,
+		func(client mqtt.Client, msg mqtt.Message) {
+			name := path.Base(path.Dir(path.Dir(msg.Topic())))
+
+			document := mqttapi.ShadowDocument{}
+			if err := json.Unmarshal(msg.Payload(), &document); err != nil {
+				w.mqttLogger.Warn("Could not parse shadow, continuing", logging.KeyShadow, name, logging.KeyError, err)
+
+				return
+			}
+
+			if document.State.Delta != nil {
+				w.queueCommand(func() {
+					w.applyShadow(ctx, name, *document.State.Delta)
+				})
+			}
+		},
+	); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
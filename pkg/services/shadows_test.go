@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+	mqttapi "github.com/pojntfx/green-guardian-gateway/pkg/api/mqtt"
+)
+
+// TestShadows checks that the gateway applies the desired state of a fan's shadow once the fan has been registered
+// and whenever it changes, and that it reports the state the fan has been switched to.
+func TestShadows(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, brokerAddr := startBroker(t)
+
+	// Capture the requests to the shadow service
+	requests := make(chan string, 10)
+	if err := broker.Subscribe("$aws/things/TestThing/shadow/name/+/get", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		requests <- pk.TopicName
+	}); err != nil {
+		t.Fatalf("unexpected error during Subscribe: %v", err)
+	}
+
+	reports := make(chan mqttapi.ShadowDocument, 10)
+	if err := broker.Subscribe("$aws/things/TestThing/shadow/name/+/update", 2, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		document := mqttapi.ShadowDocument{}
+		if err := json.Unmarshal(pk.Payload, &document); err != nil {
+			t.Errorf("unexpected error during Unmarshal: %v", err)
+
+			return
+		}
+
+		reports <- document
+	}); err != nil {
+		t.Fatalf("unexpected error during Subscribe: %v", err)
+	}
+
+	commands := make(chan bool, 10)
+	peers := func() map[string]HubRemote {
+		return map[string]HubRemote{
+			"testremote": {
+				SetFanOn: func(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+					commands <- on
+
+					return nil
+				},
+			},
+		}
+	}
+
+	gateway := connectGateway(t, ctx, brokerAddr, true, "", peers)
+
+	if err := ConnectHub(gateway, "testremote", ""); err != nil {
+		t.Fatalf("unexpected error during ConnectHub: %v", err)
+	}
+
+	if err := gateway.RegisterFans(context.WithValue(ctx, rpc.RemoteIDContextKey, "testremote"), []string{"greenhouse-1.Room1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterFans: %v", err)
+	}
+
+	// The namespace separator is replaced since it can't be used in shadow names
+	shadowTopic := "$aws/things/TestThing/shadow/name/room-greenhouse-1:Room1"
+
+	select {
+	case topic := <-requests:
+		if topic != shadowTopic+"/get" {
+			t.Fatalf("expected shadow to be requested on %v, got %v", shadowTopic+"/get", topic)
+		}
+
+	case <-time.After(integrationTimeout):
+		t.Fatal("timed out while waiting for shadow to be requested")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		topic   string
+		payload string
+		on      bool
+	}{
+		{
+			"requested shadow with delta",
+			shadowTopic + "/get/accepted",
+			`{"state":{"desired":{"on":true},"delta":{"on":true}},"version":1,"timestamp":1690000000}`,
+			true,
+		},
+		{
+			"changed desired state",
+			shadowTopic + "/update/delta",
+			`{"state":{"on":false},"version":2,"timestamp":1690000001}`,
+			false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := broker.Publish(tt.topic, []byte(tt.payload), false, 1); err != nil {
+				t.Fatalf("unexpected error during Publish: %v", err)
+			}
+
+			select {
+			case on := <-commands:
+				if on != tt.on {
+					t.Fatalf("expected fan to be switched to %v, got %v", tt.on, on)
+				}
+
+			case <-time.After(integrationTimeout):
+				t.Fatal("timed out while waiting for fan to be switched")
+			}
+
+			select {
+			case report := <-reports:
+				if report.State.Reported == nil || report.State.Reported.On == nil || *report.State.Reported.On != tt.on || report.State.Desired != nil {
+					t.Fatalf("expected reported state %v, got %v", tt.on, report.State)
+				}
+
+			case <-time.After(integrationTimeout):
+				t.Fatal("timed out while waiting for state to be reported")
+			}
+		})
+	}
+}
+
+// TestCloseGatewayUnsubscribesShadows checks that changes of shadows are no longer applied once the gateway has been closed.
+func TestCloseGatewayUnsubscribesShadows(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, brokerAddr := startBroker(t)
+
+	commands := make(chan bool, 10)
+	peers := func() map[string]HubRemote {
+		return map[string]HubRemote{
+			"testremote": {
+				SetFanOn: func(ctx context.Context, roomID string, on bool, runtime time.Duration) error {
+					commands <- on
+
+					return nil
+				},
+			},
+		}
+	}
+
+	gateway := connectGateway(t, ctx, brokerAddr, true, "", peers)
+
+	if err := ConnectHub(gateway, "testremote", ""); err != nil {
+		t.Fatalf("unexpected error during ConnectHub: %v", err)
+	}
+
+	if err := gateway.RegisterFans(context.WithValue(ctx, rpc.RemoteIDContextKey, "testremote"), []string{"Room1"}); err != nil {
+		t.Fatalf("unexpected error during RegisterFans: %v", err)
+	}
+
+	if err := CloseGateway(gateway); err != nil {
+		t.Fatalf("unexpected error during CloseGateway: %v", err)
+	}
+
+	if err := broker.Publish("$aws/things/TestThing/shadow/name/room-Room1/update/delta", []byte(`{"state":{"on":true},"version":1,"timestamp":1690000000}`), false, 1); err != nil {
+		t.Fatalf("unexpected error during Publish: %v", err)
+	}
+
+	select {
+	case on := <-commands:
+		t.Fatalf("expected fan not to be switched after closing the gateway, got %v", on)
+
+	case <-time.After(500 * time.Millisecond):
+	}
+}
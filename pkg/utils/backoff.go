@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"time"
+)
+
+// GetBackoff returns how long to wait before the given retry attempt (starting at 0).
+// The duration starts at initial, doubles for every attempt and is capped at maximum.
+func GetBackoff(attempt int, initial, maximum time.Duration) time.Duration {
+	backoff := initial
+	for i := 0; i < attempt; i++ {
+		backoff *= 2
+
+		if backoff >= maximum || backoff <= 0 {
+			return maximum
+		}
+	}
+
+	if backoff > maximum {
+		return maximum
+	}
+
+	return backoff
+}
@@ -1,7 +1,7 @@
 package utils
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
 	"time"
@@ -11,7 +11,7 @@ import (
 // If it does not exist, it returns the provided default value.
 func GetStringEnvOrDefault(key string, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
-		log.Printf("Using %v from environment", key)
+		slog.Debug("Using value from environment", "key", key)
 
 		return value
 	}
@@ -23,7 +23,7 @@ func GetStringEnvOrDefault(key string, defaultValue string) string {
 // If it does not exist or is not "true", it returns the provided default value.
 func GetBoolEnvOrDefault(key string, defaultValue bool) bool {
 	if value, exists := os.LookupEnv(key); exists {
-		log.Printf("Using %v from environment", key)
+		slog.Debug("Using value from environment", "key", key)
 
 		return value == "true"
 	}
@@ -36,7 +36,7 @@ func GetBoolEnvOrDefault(key string, defaultValue bool) bool {
 // It may return an error if the string cannot be converted into an integer.
 func GetIntEnvOrDefault(key string, defaultValue int) (int, error) {
 	if value, exists := os.LookupEnv(key); exists {
-		log.Printf("Using %v from environment", key)
+		slog.Debug("Using value from environment", "key", key)
 
 		return strconv.Atoi(value)
 	}
@@ -49,10 +49,23 @@ func GetIntEnvOrDefault(key string, defaultValue int) (int, error) {
 // It may return an error if the string cannot be parsed into a duration.
 func GetDurationEnvOrDefault(key string, defaultValue time.Duration) (time.Duration, error) {
 	if value, exists := os.LookupEnv(key); exists {
-		log.Printf("Using %v from environment", key)
+		slog.Debug("Using value from environment", "key", key)
 
 		return time.ParseDuration(value)
 	}
 
 	return defaultValue, nil
 }
+
+// GetFloatEnvOrDefault gets the floating-point value of the specified environment variable.
+// If it does not exist or is not a number, it returns the provided default value.
+// It may return an error if the string cannot be converted into a number.
+func GetFloatEnvOrDefault(key string, defaultValue float64) (float64, error) {
+	if value, exists := os.LookupEnv(key); exists {
+		slog.Debug("Using value from environment", "key", key)
+
+		return strconv.ParseFloat(value, 64)
+	}
+
+	return defaultValue, nil
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+const (
+	// Brokers and hubs are expected to support at least TLS 1.2
+	minTLSVersion = tls.VersionTLS12
+)
+
+var (
+	ErrInvalidCertificate = errors.New("could not parse certificate from CA file")
+	ErrNoIdentity         = errors.New("client certificate has no common name")
+)
+
+// LoadCertPool reads the PEM-encoded certificates in a CA file into a pool
+func LoadCertPool(ca string) (*x509.CertPool, error) {
+	rawCA, err := os.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rawCA) {
+		return nil, ErrInvalidCertificate
+	}
+
+	return pool, nil
+}
+
+// NewServerTLSConfig creates a TLS config which authenticates using the certificate and key;
+// if the CA is set, clients have to authenticate with a certificate signed by it
+func NewServerTLSConfig(ca, cert, key string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   minTLSVersion,
+	}
+
+	if ca != "" {
+		pool, err := LoadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// NewClientTLSConfig creates a TLS config which verifies the server using the CA (if set; otherwise the system's CAs are used)
+// and authenticates using the certificate and key (if set). If insecure is set, the server's certificate isn't verified.
+func NewClientTLSConfig(ca, cert, key, serverName string, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+		MinVersion:         minTLSVersion,
+	}
+
+	if ca != "" {
+		pool, err := LoadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cert != "" || key != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// GetPeerIdentity completes the handshake of a TLS connection and returns the common name of the peer's verified certificate
+func GetPeerIdentity(ctx context.Context, conn *tls.Conn) (string, error) {
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return "", err
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 || state.VerifiedChains[0][0].Subject.CommonName == "" {
+		return "", ErrNoIdentity
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName, nil
+}